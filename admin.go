@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// serveAdmin handles requests to /_admin/{command}
+func (server *Server) serveAdmin(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if len(key) == 0 {
+		res.WriteHeader(404)
+		return
+	}
+
+	// fsck and reindex don't take a path, but indices and limits do
+	switch {
+	case key[0] == "fsck" && len(key) == 1:
+		server.Fsck(ctx, res, req)
+	case key[0] == "reindex" && len(key) == 1:
+		server.Reindex(ctx, res, req)
+	case key[0] == "indices":
+		server.Indices(ctx, res, req, key[1:])
+	case key[0] == "limits":
+		server.Limits(ctx, res, req, key[1:])
+	default:
+		res.WriteHeader(404)
+	}
+}
+
+// Indices handles requests to /_admin/indices, which reports the lag and failures of
+// every index queue, and /_admin/indices/{name}, which also lists the dead-lettered operations.
+func (server *Server) Indices(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	} else if len(key) > 1 {
+		res.WriteHeader(404)
+		return
+	}
+
+	statuses, err := server.queue.Status(len(key) == 1)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	var body interface{} = statuses
+	if len(key) == 1 {
+		body = nil
+		for _, status := range statuses {
+			if status.Name == key[0] {
+				body = status
+			}
+		}
+
+		if body == nil {
+			res.WriteHeader(404)
+			return
+		}
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(body)
+}
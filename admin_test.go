@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestAdminPaths checks that commands that don't take a path only match exactly
+func TestAdminPaths(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for target, code := range map[string]int{
+		"/_admin":              http.StatusNotFound,
+		"/_admin/fsck":         http.StatusOK,
+		"/_admin/fsck/extra":   http.StatusNotFound,
+		"/_admin/reindex/x":    http.StatusNotFound,
+		"/_admin/indices":      http.StatusOK,
+		"/_admin/unknown":      http.StatusNotFound,
+		"/_admin/unknown/path": http.StatusNotFound,
+	} {
+		res := do(server, "GET", target, "", nil)
+		if res.Code != code {
+			t.Errorf("GET %s: expected %d, got %d %s", target, code, res.Code, res.Body.String())
+		}
+	}
+}
+
+// TestSameResourceKeywords checks that fsck compares keywords without their order,
+// since the package document doesn't keep it
+func TestSameResourceKeywords(t *testing.T) {
+	a := types.NewPackage("http://example.com/p", "p")
+	a.Keywords = []string{"b", "a"}
+	b := types.NewPackage("http://example.com/p", "p")
+	b.Keywords = []string{"a", "b"}
+	if !sameResource(a, b) {
+		t.Error("packages with the same keywords in a different order are different")
+	} else if a.Keywords[0] != "b" {
+		t.Error("sameResource sorted the keywords in place")
+	}
+
+	b.Keywords = []string{"a", "c"}
+	if sameResource(a, b) {
+		t.Error("packages with different keywords are the same")
+	}
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	files "github.com/ipfs/go-ipfs-files"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Archives (tar, zip, or multipart form data) upload as whole package subtrees:
+// directories become subpackages, N-Quads and JSON-LD entries become assertions
+// (named without their extension), and everything else becomes a file. There's
+// no Turtle parser, so .ttl entries are rejected rather than stored as files that
+// look like assertions. PUT replaces the package at the path with the archive's
+// contents (keeping its creation time and revision history), and POST merges the
+// archive's top-level entries into the existing package.
+// Packages also download as zip or tar archives with the same layout as
+// their value directories.
+
+var archiveFormats = map[string]bool{
+	"application/x-tar":   true,
+	"application/zip":     true,
+	"multipart/form-data": true,
+}
+
+// assertionExtensions maps the extensions of archive entries that become assertions to their formats
+var assertionExtensions = map[string]string{
+	types.NQuadsFileExtension: offers[0],
+	".jsonld":                 offers[1],
+}
+
+// fileFormats has the formats of some common extensions that the system's MIME types might not
+var fileFormats = map[string]string{
+	".csv": "text/csv",
+}
+
+// turtleExtension is the extension of the RDF entries that archives can't have
+const turtleExtension = ".ttl"
+
+// ErrInvalidArchiveEntry is returned for archive entries with paths outside the archive
+var ErrInvalidArchiveEntry = errors.New("Invalid archive entry path")
+
+// ErrTurtleArchiveEntry is returned for Turtle archive entries
+var ErrTurtleArchiveEntry = errors.New("Unsupported archive entry: Turtle isn't supported, convert it to N-Quads (.nq) or JSON-LD (.jsonld)")
+
+// ErrDuplicateArchiveEntry is returned when two archive entries get the same name in a package
+var ErrDuplicateArchiveEntry = errors.New("Duplicate archive entry")
+
+func isArchive(format string) bool {
+	t, _, err := mime.ParseMediaType(format)
+	return err == nil && archiveFormats[t]
+}
+
+// An uploadTree is one directory of an archive
+type uploadTree struct {
+	packages   map[string]*uploadTree
+	assertions map[string]*types.Assertion
+	files      map[string]*types.File
+}
+
+func newUploadTree() *uploadTree {
+	return &uploadTree{
+		packages:   map[string]*uploadTree{},
+		assertions: map[string]*types.Assertion{},
+		files:      map[string]*types.File{},
+	}
+}
+
+// has returns true if the tree already has a member with the given name.
+// Packages, assertions, and files share a namespace since they share a value directory.
+func (tree *uploadTree) has(name string) bool {
+	_, isPackage := tree.packages[name]
+	_, isAssertion := tree.assertions[name]
+	_, isFile := tree.files[name]
+	return isPackage || isAssertion || isFile
+}
+
+// dir returns the subtree for the given directory names, creating it if necessary
+func (tree *uploadTree) dir(names []string) (*uploadTree, error) {
+	for _, name := range names {
+		child, has := tree.packages[name]
+		if !has {
+			// A downloaded archive has a name.nq package document next to
+			// each subpackage directory, which gets regenerated instead
+			delete(tree.assertions, name)
+			if tree.has(name) {
+				return nil, fmt.Errorf("%w: %s", ErrDuplicateArchiveEntry, name)
+			}
+			child = newUploadTree()
+			tree.packages[name] = child
+		}
+		tree = child
+	}
+	return tree, nil
+}
+
+// splitEntry splits an archive entry path into its directory names and its name
+func splitEntry(name string) ([]string, string, error) {
+	for _, n := range strings.Split(name, "/") {
+		if n == ".." {
+			return nil, "", ErrInvalidArchiveEntry
+		}
+	}
+
+	name = strings.TrimPrefix(gopath.Clean("/"+name), "/")
+	if name == "" {
+		return nil, "", nil
+	}
+
+	names := strings.Split(name, "/")
+	return names[:len(names)-1], names[len(names)-1], nil
+}
+
+// an archiveReader calls f with every entry of an archive. Directories have a nil reader.
+type archiveReader func(body io.Reader, format string, f func(name string, r io.Reader) error) error
+
+func readTar(body io.Reader, format string, f func(name string, r io.Reader) error) error {
+	reader := tar.NewReader(body)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = f(header.Name, nil)
+		case tar.TypeReg:
+			err = f(header.Name, reader)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readZip buffers the archive in a temporary file, since zip archives are read from the end
+func readZip(body io.Reader, format string, f func(name string, r io.Reader) error) error {
+	file, err := ioutil.TempFile("", "pkgs-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, body)
+	if err != nil {
+		return err
+	}
+
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range reader.File {
+		if entry.FileInfo().IsDir() {
+			err = f(entry.Name, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := entry.Open()
+		if err != nil {
+			return err
+		}
+
+		err = f(entry.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMultipart reads every part with a filename, which can include a directory path
+// (as for browser directory uploads)
+func readMultipart(body io.Reader, format string, f func(name string, r io.Reader) error) error {
+	_, params, err := mime.ParseMediaType(format)
+	if err != nil {
+		return err
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Part.FileName strips the directories, so read the header directly
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if name := disposition["filename"]; name != "" {
+			err = f(name, part)
+			if err != nil {
+				return err
+			}
+		}
+		part.Close()
+	}
+}
+
+// readArchive adds every entry of an archive to IPFS and returns the directory tree.
+// key is the package that the archive will be uploaded to, and each file is limited
+// to the maximum size of the package that it will be in. It returns the status code
+// to fail with if it doesn't work.
+func (server *Server) readArchive(ctx context.Context, body io.Reader, format string, key []string, timestamp string) (*uploadTree, int, error) {
+	resource := types.GetURI(server.resource, key)
+	var read archiveReader
+	switch t, _, _ := mime.ParseMediaType(format); t {
+	case "application/x-tar":
+		read = readTar
+	case "application/zip":
+		read = readZip
+	case "multipart/form-data":
+		read = readMultipart
+	}
+
+	tree := newUploadTree()
+	status := 400
+	err := read(body, format, func(entry string, r io.Reader) error {
+		dirs, name, err := splitEntry(entry)
+		if err != nil {
+			return err
+		} else if name == "" || len(dirs) == 0 && name == manifestName {
+			return nil
+		} else if isReserved(append(key[:len(key):len(key)], append(dirs, name)...)) {
+			return fmt.Errorf("%w: %s is reserved", ErrInvalidArchiveEntry, entry)
+		}
+
+		if r == nil {
+			_, err = tree.dir(append(dirs, name))
+			return err
+		}
+
+		parent, err := tree.dir(dirs)
+		if err != nil {
+			return err
+		}
+
+		memberResource := resource + "/" + strings.Join(append(dirs, name), "/")
+		ext := gopath.Ext(name)
+		if ext == turtleExtension {
+			status = 415
+			return fmt.Errorf("%w: %s", ErrTurtleArchiveEntry, entry)
+		} else if rdfFormat, is := assertionExtensions[ext]; is && len(name) > len(ext) {
+			name = strings.TrimSuffix(name, ext)
+			memberResource = strings.TrimSuffix(memberResource, ext)
+			if _, isPackage := parent.packages[name]; isPackage {
+				return nil
+			} else if parent.has(name) {
+				return fmt.Errorf("%w: %s", ErrDuplicateArchiveEntry, entry)
+			}
+
+			a := &types.Assertion{Resource: memberResource, Title: name, Created: timestamp, Modified: timestamp}
+			s, err := server.readAssertion(ctx, a, rdfFormat, r)
+			if err != nil {
+				status = s
+				return fmt.Errorf("%s: %w", entry, err)
+			}
+			parent.assertions[name] = a
+			return nil
+		}
+
+		if parent.has(name) {
+			return fmt.Errorf("%w: %s", ErrDuplicateArchiveEntry, entry)
+		}
+
+		buffered := bufio.NewReader(r)
+		fileFormat := fileFormats[ext]
+		if fileFormat == "" {
+			fileFormat = mime.TypeByExtension(ext)
+		}
+		if fileFormat == "" {
+			head, _ := buffered.Peek(512)
+			fileFormat = http.DetectContentType(head)
+		}
+
+		upload, err := server.newUploadBody(append(key[:len(key):len(key)], dirs...), nil, -1, buffered)
+		if err != nil {
+			status = 500
+			return err
+		}
+
+		f := &types.File{Resource: memberResource, Title: name, Created: timestamp, Modified: timestamp, Format: fileFormat}
+		err = server.addFile(ctx, f, upload)
+		if err != nil {
+			status = uploadStatus(err)
+			return fmt.Errorf("%s: %w", entry, err)
+		}
+		parent.files[name] = f
+		return nil
+	})
+
+	return tree, status, err
+}
+
+// readAssertion parses, normalizes, and adds an RDF document to IPFS as the assertion a.
+// It returns the status code to fail with if it doesn't work.
+func (server *Server) readAssertion(ctx context.Context, a *types.Assertion, format string, body io.Reader) (int, error) {
+	dataset, err := parseDataset(format, a.Resource, body)
+	if err != nil {
+		return 400, err
+	}
+
+	opts := ld.NewJsonLdOptions(a.Resource)
+	opts.Format = "application/n-quads"
+	na := ld.NewNormalisationAlgorithm("URDNA2015")
+	normalized, err := na.Main(dataset, opts)
+	if err != nil {
+		return 400, err
+	}
+
+	data := []byte(normalized.(string))
+	err = server.setAssertion(ctx, a, files.NewBytesFile(data))
+	if err != nil {
+		return 502, err
+	}
+
+	a.Dataset, err = rdf.ReadQuads(bytes.NewReader(data))
+	if err != nil {
+		return 500, err
+	}
+	return 0, nil
+}
+
+// buildPackage writes the package documents for an uploaded tree, deepest first.
+// base is the package that's already at key, if there is one, which the new package
+// is the next revision of. If merge is true, base's members that the tree doesn't
+// replace are kept, and the subpackages among them are read from txn.
+func (server *Server) buildPackage(
+	ctx context.Context,
+	key []string,
+	tree *uploadTree,
+	base *types.Package,
+	merge bool,
+	timestamp string,
+	txn *badger.Txn,
+) (*types.Package, path.Resolved, error) {
+	name := getName(server.resource)
+	if len(key) > 0 {
+		name = key[len(key)-1]
+	}
+
+	pkg := types.NewPackage(types.GetURI(server.resource, key), name)
+	pkg.Created, pkg.Modified = timestamp, timestamp
+	dir, err := server.getDirectory(ctx, EmptyDirectoryPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if base != nil {
+		pkg.Created, pkg.Parent = base.Created, base.ID
+	}
+
+	if base != nil && merge {
+		pkg.Description, pkg.Keywords = base.Description, base.Keywords
+		for _, p := range base.Members.Packages {
+			if !tree.has(p.Title) {
+				child, err := getPackage(append(key[:len(key):len(key)], p.Title), txn)
+				if err != nil {
+					return nil, nil, err
+				}
+				pkg.Members.Packages = append(pkg.Members.Packages, p)
+				err = server.setLink(ctx, dir, p.Title, child.ValuePath())
+				if err != nil {
+					return nil, nil, err
+				}
+				err = server.setLink(ctx, dir, p.Title+types.NQuadsFileExtension, p.Path())
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		for _, a := range base.Members.Assertions {
+			if !tree.has(a.Name()) {
+				pkg.Members.Assertions = append(pkg.Members.Assertions, a)
+				err := server.setLink(ctx, dir, a.Name()+types.NQuadsFileExtension, a.Path())
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		for _, f := range base.Members.Files {
+			if !tree.has(f.Name()) {
+				pkg.Members.Files = append(pkg.Members.Files, f)
+				err := server.setLink(ctx, dir, f.Name(), f.Path())
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(tree.packages))
+	for name := range tree.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childKey := append(key[:len(key):len(key)], name)
+		childBase, err := getExistingPackage(childKey, txn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		child, childValue, err := server.buildPackage(ctx, childKey, tree.packages[name], childBase, false, timestamp, txn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pkg.Members.Packages = append(pkg.Members.Packages, child.CopyResource())
+		err = server.setLink(ctx, dir, name, childValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = server.setLink(ctx, dir, name+types.NQuadsFileExtension, child.Path())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for name, a := range tree.assertions {
+		pkg.Members.Assertions = append(pkg.Members.Assertions, a)
+		err = server.setLink(ctx, dir, name+types.NQuadsFileExtension, a.Path())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for name, f := range tree.files {
+		pkg.Members.Files = append(pkg.Members.Files, f)
+		err = server.setLink(ctx, dir, name, f.Path())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pkg.Sort()
+	value, err := server.putDirectory(ctx, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = server.setValue(ctx, pkg, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = server.normalize(ctx, pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pkg, value, nil
+}
+
+// putArchive handles PUT and POST requests with archive bodies
+func (server *Server) putArchive(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string, merge bool) {
+	timestamp := time.Now().Format(time.RFC3339)
+	tree, status, err := server.readArchive(ctx, req.Body, req.Header.Get("Content-Type"), key, timestamp)
+	if err != nil {
+		res.WriteHeader(status)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	var pkg *types.Package
+	var buildErr error
+	err = server.write(key, func(txn *badger.Txn) (err error) {
+		err = checkLocks(req, key, writeSubtree, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkPreconditions(req, key, txn)
+		if err != nil {
+			return err
+		}
+
+		var base *types.Package
+		if merge {
+			base, err = getPackage(key, txn)
+		} else {
+			base, err = getExistingPackage(key, txn)
+		}
+		if err != nil {
+			return err
+		}
+
+		pkg, _, buildErr = server.buildPackage(ctx, key, tree, base, merge, timestamp, txn)
+		if buildErr != nil {
+			return buildErr
+		}
+
+		err = server.set(ctx, key, pkg, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, pkg, txn)
+	})
+
+	if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err == ErrNotPackage || err == ErrParentNotPackage {
+		res.WriteHeader(409)
+		return
+	} else if err != nil && err == buildErr {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("ETag", pkg.ETag())
+	res.Header().Add("Link", makeSelfLink(pkg.URI()))
+	res.WriteHeader(204)
+}
+
+// A manifestEntry describes one member of a downloaded archive
+type manifestEntry struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Title    string `json:"title,omitempty"`
+	Created  string `json:"created,omitempty"`
+	Modified string `json:"modified,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Extent   int    `json:"extent,omitempty"`
+}
+
+// manifestName is the name of the manifest at the top of a downloaded archive
+const manifestName = ".manifest.json"
+
+// an archiveWriter writes the entries of a downloaded archive
+type archiveWriter interface {
+	dir(name string, modified time.Time) error
+	file(name string, size int64, modified time.Time, r io.Reader) error
+	Close() error
+}
+
+type tarWriter struct{ *tar.Writer }
+
+func (w tarWriter) dir(name string, modified time.Time) error {
+	return w.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modified})
+}
+
+func (w tarWriter) file(name string, size int64, modified time.Time, r io.Reader) error {
+	err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type zipWriter struct{ *zip.Writer }
+
+func (w zipWriter) dir(name string, modified time.Time) error {
+	_, err := w.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modified})
+	return err
+}
+
+func (w zipWriter) file(name string, size int64, modified time.Time, r io.Reader) error {
+	f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// writeArchive streams the package tree to res as a zip or tar archive, with the same
+// names as the value directories, followed by a manifest of every member.
+func (server *Server) writeArchive(ctx context.Context, res io.Writer, format string, pkg *types.Package) error {
+	var w archiveWriter
+	if format == "application/zip" {
+		w = zipWriter{zip.NewWriter(res)}
+	} else {
+		w = tarWriter{tar.NewWriter(res)}
+	}
+
+	manifest := []*manifestEntry{}
+	err := server.archivePackage(ctx, w, "", pkg, &manifest)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = w.file(manifestName, int64(len(data)), time.Now(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (server *Server) archivePackage(ctx context.Context, w archiveWriter, prefix string, pkg *types.Package, manifest *[]*manifestEntry) error {
+	for _, p := range pkg.Members.Packages {
+		// Inboxes only change through notifications, so they can't be imported again
+		if p.Title == inboxName {
+			continue
+		}
+
+		child, err := server.parse(ctx, p)
+		if err != nil {
+			return err
+		}
+
+		name := prefix + p.Title
+		modified, _ := time.Parse(time.RFC3339, child.Modified)
+		*manifest = append(*manifest, &manifestEntry{
+			Path:     name,
+			Type:     p.Type(),
+			ID:       p.ID,
+			Title:    child.Title,
+			Created:  child.Created,
+			Modified: child.Modified,
+		})
+
+		err = server.archiveMember(ctx, w, name+types.NQuadsFileExtension, modified, p.Path())
+		if err != nil {
+			return err
+		}
+
+		err = w.dir(name, modified)
+		if err != nil {
+			return err
+		}
+
+		err = server.archivePackage(ctx, w, name+"/", child, manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range pkg.Members.Assertions {
+		name := prefix + a.Name() + types.NQuadsFileExtension
+		modified, _ := time.Parse(time.RFC3339, a.Modified)
+		*manifest = append(*manifest, &manifestEntry{
+			Path:     name,
+			Type:     a.Type(),
+			ID:       a.ID,
+			Title:    a.Title,
+			Created:  a.Created,
+			Modified: a.Modified,
+		})
+
+		err := server.archiveMember(ctx, w, name, modified, a.Path())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range pkg.Members.Files {
+		name := prefix + f.Name()
+		modified, _ := time.Parse(time.RFC3339, f.Modified)
+		*manifest = append(*manifest, &manifestEntry{
+			Path:     name,
+			Type:     f.Type(),
+			ID:       f.ID,
+			Title:    f.Title,
+			Created:  f.Created,
+			Modified: f.Modified,
+			Format:   f.Format,
+			Extent:   f.Extent,
+		})
+
+		err := server.archiveMember(ctx, w, name, modified, f.Path())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) archiveMember(ctx context.Context, w archiveWriter, name string, modified time.Time, p path.Resolved) error {
+	node, err := server.api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	size, err := node.Size()
+	if err != nil {
+		return err
+	}
+
+	return w.file(name, size, modified, files.ToFile(node))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestArchiveEntries checks that archives with Turtle entries or entries at reserved
+// paths are rejected, and that failing to add an entry to IPFS is a 502
+func TestArchiveEntries(t *testing.T) {
+	server, api := newTestServer(t)
+	header := map[string]string{"Content-Type": "application/x-tar"}
+	for _, r := range []struct {
+		target  string
+		entries map[string]string
+		status  int
+	}{
+		{"/", map[string]string{"a.txt": "a\n", "b.ttl": "<a> <b> <c> ."}, http.StatusUnsupportedMediaType},
+		{"/", map[string]string{"_admin/a.txt": "a\n"}, http.StatusBadRequest},
+		{"/", map[string]string{"_a.txt": "a\n"}, http.StatusBadRequest},
+		{"/", map[string]string{"a.nq": "not n-quads"}, http.StatusBadRequest},
+	} {
+		res := do(server, "POST", r.target, tarBody(t, r.entries), header)
+		if res.Code != r.status {
+			t.Errorf("POST %s with %v: %d %s, expected %d", r.target, r.entries, res.Code, res.Body.String(), r.status)
+		}
+	}
+
+	api.err = errors.New("IPFS is unavailable")
+	for _, entries := range []map[string]string{{"a.txt": "a\n"}, {"a.nq": "<http://example.com/a> <http://example.com/b> \"c\" .\n"}} {
+		res := do(server, "POST", "/", tarBody(t, entries), header)
+		if res.Code != http.StatusBadGateway || !strings.Contains(res.Body.String(), api.err.Error()) {
+			t.Errorf("POST / with %v while IPFS is unavailable: %d %s", entries, res.Code, res.Body.String())
+		}
+	}
+	api.err = nil
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	root, err := getPackage(nil, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range root.Members.Files {
+		if f.Name() == "a.txt" || strings.HasPrefix(f.Name(), "_") {
+			t.Errorf("%s was written", f.Name())
+		}
+	}
+}
+
+// TestArchiveRevision checks that replacing a package with an archive keeps its creation
+// time and makes the new package (and its subpackages) revisions of the old ones
+func TestArchiveRevision(t *testing.T) {
+	server, _ := newTestServer(t)
+	header := map[string]string{"Content-Type": "application/x-tar"}
+
+	get := func(p string) *types.Package {
+		t.Helper()
+		txn := server.db.NewTransaction(false)
+		defer txn.Discard()
+		pkg, err := getPackage(types.ParsePath(p), txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkg
+	}
+
+	res := do(server, "PUT", "/p", tarBody(t, map[string]string{"a.txt": "a\n", "sub/b.txt": "b\n"}), header)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT /p: %d %s", res.Code, res.Body.String())
+	}
+
+	old, oldSub := get("/p"), get("/p/sub")
+	if old.Parent != "" {
+		t.Errorf("/p has parent %s, expected none", old.Parent)
+	}
+
+	res = do(server, "PUT", "/p", tarBody(t, map[string]string{"c.txt": "c\n", "sub/d.txt": "d\n"}), header)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT /p: %d %s", res.Code, res.Body.String())
+	}
+
+	for _, r := range []struct {
+		path string
+		old  *types.Package
+	}{{"/p", old}, {"/p/sub", oldSub}} {
+		pkg := get(r.path)
+		if pkg.ID == r.old.ID {
+			t.Errorf("%s didn't change", r.path)
+		} else if pkg.Parent != r.old.ID {
+			t.Errorf("%s has parent %q, expected %q", r.path, pkg.Parent, r.old.ID)
+		} else if pkg.Created != r.old.Created {
+			t.Errorf("%s was created %q, expected %q", r.path, pkg.Created, r.old.Created)
+		}
+	}
+
+	if p := get("/p"); len(p.Members.Files) != 1 || p.Members.Files[0].Name() != "c.txt" {
+		t.Errorf("PUT /p didn't replace its members")
+	}
+}
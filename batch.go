@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// A batch applies a list of operations (putting files and assertions, creating
+// packages, deleting, and moving) in one transaction. Instead of writing a new
+// revision of every ancestor after each operation like commit does, the packages
+// that the operations change are only edited in memory until the end, when each of
+// them is normalized and written to the catalog once, deepest first. Writing them
+// after every operation would make the transaction grow with the square of the
+// number of members. Either every operation is applied or none are.
+//
+// The body is a JSON array of operations, or multipart/form-data with the JSON
+// array in a part named "operations" followed by parts for the contents of
+// the files and assertions that reference them by name.
+
+// ErrInvalidOperation is returned for batch operations that are malformed
+var ErrInvalidOperation = errors.New("Invalid batch operation")
+
+// ErrExists is returned when a batch operation would create a resource that already exists
+var ErrExists = errors.New("Resource already exists")
+
+// ErrMoveInto is returned for moves of a package into itself
+var ErrMoveInto = errors.New("Invalid move: destination is inside the source")
+
+// ErrMoveMount is returned for moves of mounts, which have no children in the catalog to move
+var ErrMoveMount = errors.New("Invalid move: mounts must be materialized before they're moved")
+
+type batchOperation struct {
+	Op          string `json:"op"`
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Part        string `json:"part,omitempty"`
+
+	key         []string
+	destination []string
+	r           types.Resource
+}
+
+type batchResult struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A batchPackage is a package that's been changed by a batch and not normalized yet.
+// parent is what its Parent will be once it is.
+type batchPackage struct {
+	key    []string
+	pkg    *types.Package
+	value  path.Resolved
+	parent string
+}
+
+type batch struct {
+	server    *Server
+	txn       *badger.Txn
+	timestamp string
+	created   map[string]bool
+	dirty     map[string]*batchPackage
+}
+
+// isReserved reports whether clients can't write to key directly: system paths,
+// and inboxes and everything in them, which only change through notifications
+func isReserved(key []string) bool {
+	return len(key) > 0 && strings.HasPrefix(key[0], "_") || inInbox(key)
+}
+
+func isInside(key, ancestor []string) bool {
+	if len(key) < len(ancestor) {
+		return false
+	}
+	for i, name := range ancestor {
+		if key[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// validate parses the paths of op and checks that it has everything it needs
+func (op *batchOperation) validate() error {
+	op.key = types.ParsePath(op.Path)
+	if len(op.key) == 0 || isReserved(op.key) {
+		return fmt.Errorf("%w: invalid path %q", ErrInvalidOperation, op.Path)
+	}
+
+	switch op.Op {
+	case "put":
+		if op.Type != "file" && op.Type != "assertion" {
+			return fmt.Errorf("%w: type must be \"file\" or \"assertion\"", ErrInvalidOperation)
+		}
+	case "move":
+		op.destination = types.ParsePath(op.Destination)
+		if len(op.destination) == 0 || isReserved(op.destination) {
+			return fmt.Errorf("%w: invalid destination %q", ErrInvalidOperation, op.Destination)
+		}
+	case "mkcol", "delete":
+	default:
+		return fmt.Errorf("%w: unknown op %q", ErrInvalidOperation, op.Op)
+	}
+
+	return nil
+}
+
+// readBatch reads the operations of a batch request. For multipart requests,
+// it also returns the reader for the rest of the parts.
+func readBatch(req *http.Request) ([]*batchOperation, *multipart.Reader, error) {
+	var ops []*batchOperation
+	var parts *multipart.Reader
+	format, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if format == "multipart/form-data" {
+		parts = multipart.NewReader(req.Body, params["boundary"])
+		part, err := parts.NextPart()
+		if err != nil {
+			return nil, nil, err
+		} else if part.FormName() != "operations" {
+			return nil, nil, fmt.Errorf("%w: the first part must be named \"operations\"", ErrInvalidOperation)
+		}
+
+		err = json.NewDecoder(part).Decode(&ops)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if format == "application/json" {
+		err := json.NewDecoder(req.Body).Decode(&ops)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		return nil, nil, fmt.Errorf("%w: expected application/json or multipart/form-data", ErrInvalidOperation)
+	}
+
+	for _, op := range ops {
+		err := op.validate()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return ops, parts, nil
+}
+
+// prepare adds the contents of a put operation to IPFS. It returns the status code to fail with if it doesn't work.
+func (server *Server) prepare(ctx context.Context, op *batchOperation, body io.Reader, format, timestamp string) (int, error) {
+	if op.Format != "" {
+		format = op.Format
+	} else if format == "" {
+		return 400, fmt.Errorf("%w: missing format", ErrInvalidOperation)
+	}
+
+	resource := types.GetURI(server.resource, op.key)
+	name := op.key[len(op.key)-1]
+	if op.Type == "assertion" {
+		if format != offers[0] && format != offers[1] && format != offers[2] {
+			return 415, fmt.Errorf("%w: unsupported assertion format %q", ErrInvalidOperation, format)
+		}
+		a := &types.Assertion{Resource: resource, Title: name, Created: timestamp, Modified: timestamp}
+		op.r = a
+		return server.readAssertion(ctx, a, format, body)
+	}
+
+	upload, err := server.newUploadBody(op.key[:len(op.key)-1], nil, -1, body)
+	if err != nil {
+		return uploadStatus(err), err
+	}
+
+	f := &types.File{Resource: resource, Title: name, Created: timestamp, Modified: timestamp, Format: format}
+	op.r = f
+	err = server.addFile(ctx, f, upload)
+	if err != nil {
+		return uploadStatus(err), err
+	}
+	return 0, nil
+}
+
+// load returns the batchPackage for the package at key, reading it from the catalog if it's not dirty yet
+func (b *batch) load(key []string) (*batchPackage, error) {
+	k := string(getKey(key))
+	if p, has := b.dirty[k]; has {
+		return p, nil
+	}
+
+	pkg, err := getPackage(key, b.txn)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &batchPackage{key: key, pkg: pkg, value: pkg.ValuePath(), parent: pkg.ID}
+	if b.created[k] {
+		// This package was created in the batch, so the ID it has now was never committed
+		p.parent = pkg.Parent
+	}
+
+	b.dirty[k] = p
+	return p, nil
+}
+
+// setMember replaces the member at key in its parent package with r, or deletes it if r is nil.
+// The parent is only changed in memory; its catalog entry is written when the batch finishes.
+func (b *batch) setMember(ctx context.Context, key []string, r types.Resource, value path.Resolved) error {
+	parent, err := b.load(key[:len(key)-1])
+	if err != nil {
+		return err
+	}
+
+	parent.value, err = b.server.setMember(ctx, parent.pkg, parent.value, key[len(key)-1], r, value)
+	return err
+}
+
+// flush writes the catalog entries of the dirty packages at key and beneath it,
+// for operations that read that subtree from the catalog
+func (b *batch) flush(key []string) error {
+	k := string(getKey(key))
+	for dirty, p := range b.dirty {
+		if dirty == k || strings.HasPrefix(dirty, k+"/") {
+			err := b.server.setResource(p.key, p.pkg, b.txn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forget discards the changes to the package at key and to the packages beneath it,
+// which have been deleted or replaced
+func (b *batch) forget(key []string) {
+	k := string(getKey(key))
+	for dirty := range b.dirty {
+		if dirty == k || strings.HasPrefix(dirty, k+"/") {
+			delete(b.dirty, dirty)
+		}
+	}
+}
+
+// checkParent checks that the parent of key is a package
+func (b *batch) checkParent(key []string) error {
+	item, err := b.txn.Get(getKey(key[:len(key)-1]))
+	if err != nil {
+		return err
+	} else if item.UserMeta() != byte(types.PackageType) {
+		return ErrParentNotPackage
+	}
+	return nil
+}
+
+// checkLocks checks that the If header of req submits the lock tokens that op needs.
+// Untagged lists in the If header apply to /_batch, so tokens have to be tagged with their resource.
+func (b *batch) checkLocks(req *http.Request, op *batchOperation) error {
+	switch op.Op {
+	case "delete":
+		return checkLocks(req, op.key, removeSubtree, b.txn)
+	case "move":
+		err := checkLocks(req, op.key, removeSubtree, b.txn)
+		if err != nil {
+			return err
+		}
+		return checkLocks(req, op.destination, writeResource, b.txn)
+	default:
+		return checkLocks(req, op.key, writeResource, b.txn)
+	}
+}
+
+func (b *batch) put(ctx context.Context, key []string, r types.Resource) (bool, error) {
+	// server.set reads the parent outside of txn, which doesn't see changes earlier in the batch
+	err := b.checkParent(key)
+	if err != nil {
+		return false, err
+	}
+
+	err = b.flush(key)
+	if err != nil {
+		return false, err
+	}
+
+	old, err := getResource(key, b.txn)
+	created := err == badger.ErrKeyNotFound
+	if err != nil && !created {
+		return false, err
+	}
+
+	err = b.server.set(ctx, key, r, b.txn)
+	if err != nil {
+		return false, err
+	}
+
+	if _, is := old.(*types.Package); is {
+		b.forget(key)
+	}
+
+	return created, b.setMember(ctx, key, r, nil)
+}
+
+func (b *batch) mkcol(ctx context.Context, key []string) error {
+	err := b.checkParent(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.txn.Get(getKey(key))
+	if err == nil {
+		return ErrExists
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	pkg := types.NewPackage(types.GetURI(b.server.resource, key), key[len(key)-1])
+	pkg.Created, pkg.Modified = b.timestamp, b.timestamp
+	_, err = b.server.normalize(ctx, pkg)
+	if err != nil {
+		return err
+	}
+
+	err = b.server.set(ctx, key, pkg, b.txn)
+	if err != nil {
+		return err
+	}
+
+	b.created[string(getKey(key))] = true
+	return b.setMember(ctx, key, pkg.CopyResource(), pkg.ValuePath())
+}
+
+func (b *batch) delete(ctx context.Context, key []string) error {
+	err := b.flush(key)
+	if err != nil {
+		return err
+	}
+
+	r, err := getResource(key, b.txn)
+	if err != nil {
+		return err
+	}
+
+	if pkg, is := r.(*types.Package); is {
+		err = b.server.deleteChildren(ctx, key, pkg, b.txn)
+		if err != nil {
+			return err
+		}
+		b.forget(key)
+	}
+
+	err = b.server.deleteEntry(key, r, b.txn)
+	if err != nil {
+		return err
+	}
+
+	err = removeLocks(key, b.txn)
+	if err != nil {
+		return err
+	}
+
+	return b.setMember(ctx, key, nil, nil)
+}
+
+func (b *batch) move(ctx context.Context, src, dst []string) error {
+	if isInside(dst, src) {
+		return ErrMoveInto
+	}
+
+	r, err := getResource(src, b.txn)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.txn.Get(getKey(dst))
+	if err == nil {
+		return ErrExists
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	err = b.checkParent(dst)
+	if err != nil {
+		return err
+	}
+
+	resource := types.GetURI(b.server.resource, dst)
+	name := dst[len(dst)-1]
+
+	var moved types.Resource
+	var value path.Resolved
+	switch r := r.(type) {
+	case *types.Package:
+		pkg, pkgValue, err := b.relocate(ctx, src, dst, r)
+		if err != nil {
+			return err
+		}
+		moved, value = pkg, pkgValue
+	case *types.Assertion:
+		a := *r
+		a.Resource, a.Title, a.Modified = resource, name, b.timestamp
+		moved = &a
+	case *types.File:
+		f := *r
+		f.Resource, f.Title, f.Modified = resource, name, b.timestamp
+		moved = &f
+	}
+
+	err = b.server.deleteEntry(src, r, b.txn)
+	if err != nil {
+		return err
+	}
+
+	err = removeLocks(src, b.txn)
+	if err != nil {
+		return err
+	}
+
+	err = b.setMember(ctx, src, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	err = b.server.setEntry(dst, moved, b.txn)
+	if err != nil {
+		return err
+	}
+
+	if pkg, is := moved.(*types.Package); is {
+		return b.setMember(ctx, dst, pkg.CopyResource(), value)
+	}
+	return b.setMember(ctx, dst, moved, nil)
+}
+
+// relocate writes a copy of the package at src for dst, along with new catalog entries
+// for everything beneath it. Every resource URI in the subtree changes, so every package
+// in it gets a new revision. The catalog entries beneath src are deleted, but neither
+// src's entry nor dst's is written.
+func (b *batch) relocate(ctx context.Context, src, dst []string, pkg *types.Package) (*types.Package, path.Resolved, error) {
+	mounted, err := isMounted(src, b.txn)
+	if err != nil {
+		return nil, nil, err
+	} else if mounted {
+		return nil, nil, ErrMoveMount
+	}
+
+	value, parent := pkg.ValuePath(), pkg.ID
+	k := string(getKey(src))
+	if p, has := b.dirty[k]; has {
+		pkg, value, parent = p.pkg, p.value, p.parent
+		delete(b.dirty, k)
+	} else if b.created[k] {
+		parent = pkg.Parent
+	}
+
+	moved := types.NewPackage(types.GetURI(b.server.resource, dst), dst[len(dst)-1])
+	moved.Created, moved.Modified, moved.Parent = pkg.Created, b.timestamp, parent
+	moved.Description, moved.Keywords = pkg.Description, pkg.Keywords
+	moved.Members.Packages = append(moved.Members.Packages, pkg.Members.Packages...)
+
+	for _, a := range pkg.Members.Assertions {
+		name, c := a.Name(), *a
+		if c.Resource != "" {
+			c.Resource = types.GetURI(moved.Resource, []string{name})
+		}
+		err := b.server.deleteEntry(append(src[:len(src):len(src)], name), a, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = b.server.setEntry(append(dst[:len(dst):len(dst)], name), &c, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+		moved.Members.Assertions = append(moved.Members.Assertions, &c)
+	}
+
+	for _, f := range pkg.Members.Files {
+		name, c := f.Name(), *f
+		if c.Resource != "" {
+			c.Resource = types.GetURI(moved.Resource, []string{name})
+		}
+		err := b.server.deleteEntry(append(src[:len(src):len(src)], name), f, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = b.server.setEntry(append(dst[:len(dst):len(dst)], name), &c, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+		moved.Members.Files = append(moved.Members.Files, &c)
+	}
+
+	for _, p := range pkg.Members.Packages {
+		childSrc, childDst := append(src[:len(src):len(src)], p.Title), append(dst[:len(dst):len(dst)], p.Title)
+		child, err := getPackage(childSrc, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		movedChild, childValue, err := b.relocate(ctx, childSrc, childDst, child)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = b.server.deleteEntry(childSrc, child, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = b.server.setEntry(childDst, movedChild, b.txn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, err = b.server.setMember(ctx, moved, value, p.Title, movedChild.CopyResource(), childValue)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = b.server.setValue(ctx, moved, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = b.server.normalize(ctx, moved)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return moved, value, nil
+}
+
+// finish normalizes every package that the batch changed, deepest first, and
+// returns the new root package and value directory. It returns nil if nothing changed.
+func (b *batch) finish(ctx context.Context) (id, value path.Resolved, err error) {
+	for len(b.dirty) > 0 {
+		depth := 0
+		for _, p := range b.dirty {
+			if len(p.key) > depth {
+				depth = len(p.key)
+			}
+		}
+
+		for k, p := range b.dirty {
+			if len(p.key) != depth {
+				continue
+			}
+
+			delete(b.dirty, k)
+			p.pkg.Modified, p.pkg.Parent = b.timestamp, p.parent
+			err = b.server.setValue(ctx, p.pkg, p.value)
+			if err != nil {
+				return
+			}
+
+			_, err = b.server.normalize(ctx, p.pkg)
+			if err != nil {
+				return
+			}
+
+			err = b.server.setResource(p.key, p.pkg, b.txn)
+			if err != nil {
+				return
+			}
+
+			if depth == 0 {
+				id, value = p.pkg.Path(), p.value
+				continue
+			}
+
+			err = b.setMember(ctx, p.key, p.pkg.CopyResource(), p.value)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// batchStatus returns the status code of a batch operation that failed with err
+func batchStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidOperation) || err == ErrInvalidIf:
+		return 400
+	case err == badger.ErrKeyNotFound:
+		return 404
+	case err == ErrParentNotPackage || err == ErrExists || err == ErrMoveMount:
+		return 409
+	case err == ErrMoveInto:
+		return 403
+	case err == ErrPrecondition:
+		return 412
+	case err == ErrLocked:
+		return 423
+	default:
+		return 500
+	}
+}
+
+// Batch handles POST requests to /_batch
+func (server *Server) Batch(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+
+	ops, parts, err := readBatch(req)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	results := make([]*batchResult, len(ops))
+	for i, op := range ops {
+		results[i] = &batchResult{Op: op.Op, Path: op.Path, Status: 424}
+	}
+
+	// If an operation fails, the others fail with 424 Failed Dependency
+	fail := func(i, status int, err error) {
+		results[i].Status = status
+		results[i].Error = err.Error()
+		res.Header().Add("Content-Type", "application/json")
+		res.WriteHeader(status)
+		json.NewEncoder(res).Encode(results)
+	}
+
+	timestamp := time.Now().Format(time.RFC3339)
+	for parts != nil {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		i := 0
+		for ; i < len(ops); i++ {
+			if ops[i].Op == "put" && ops[i].Part != "" && ops[i].Part == part.FormName() && ops[i].r == nil {
+				break
+			}
+		}
+
+		if i == len(ops) {
+			res.WriteHeader(400)
+			res.Write([]byte(fmt.Sprintf("%s: no operation for part %q", ErrInvalidOperation.Error(), part.FormName())))
+			return
+		}
+
+		status, err := server.prepare(ctx, ops[i], part, part.Header.Get("Content-Type"), timestamp)
+		if err != nil {
+			fail(i, status, err)
+			return
+		}
+	}
+
+	for i, op := range ops {
+		if op.Op != "put" || op.r != nil {
+			continue
+		} else if op.Part != "" {
+			fail(i, 400, fmt.Errorf("%w: missing part %q", ErrInvalidOperation, op.Part))
+			return
+		}
+
+		status, err := server.prepare(ctx, op, strings.NewReader(op.Content), "", timestamp)
+		if err != nil {
+			fail(i, status, err)
+			return
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	txn := server.db.NewTransaction(true)
+	defer server.discard(txn)
+
+	b := &batch{
+		server:    server,
+		txn:       txn,
+		timestamp: timestamp,
+		created:   map[string]bool{},
+		dirty:     map[string]*batchPackage{},
+	}
+
+	statuses := make([]int, len(ops))
+	for i, op := range ops {
+		err := b.checkLocks(req, op)
+		if err != nil {
+			fail(i, batchStatus(err), err)
+			return
+		}
+
+		status := 201
+		switch op.Op {
+		case "put":
+			var created bool
+			created, err = b.put(ctx, op.key, op.r)
+			if !created {
+				status = 204
+			}
+		case "mkcol":
+			err = b.mkcol(ctx, op.key)
+		case "delete":
+			err, status = b.delete(ctx, op.key), 204
+		case "move":
+			err = b.move(ctx, op.key, op.destination)
+		}
+
+		if err != nil {
+			fail(i, batchStatus(err), err)
+			return
+		}
+
+		statuses[i] = status
+	}
+
+	id, value, err := b.finish(ctx)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	// The IDs of packages can change after their own operation, so they're read at the end
+	for i, op := range ops {
+		results[i].Status = statuses[i]
+		key := op.key
+		if op.Op == "move" {
+			key = op.destination
+		} else if op.Op == "delete" {
+			continue
+		}
+
+		if r, err := getResource(key, txn); err == nil {
+			results[i].ID = r.URI()
+		}
+	}
+
+	if id != nil {
+		err = server.commitTxn(txn)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		// The write is durable now, so failing to move the pins is only logged
+		err = server.update(ctx, id, value)
+		if err != nil {
+			log.Println("Error updating pins:", err)
+		}
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(results)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// postBatch posts the operations to /_batch and returns the response and the results
+func postBatch(t *testing.T, server *Server, ops []map[string]string) (*httptest.ResponseRecorder, []*batchResult) {
+	t.Helper()
+	body, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := do(server, "POST", "/_batch", string(body), map[string]string{"Content-Type": "application/json"})
+	var results []*batchResult
+	err = json.Unmarshal(res.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatalf("POST /_batch: %d %s", res.Code, res.Body.String())
+	}
+	return res, results
+}
+
+func putOp(p, content string) map[string]string {
+	return map[string]string{"op": "put", "path": p, "type": "file", "format": "text/plain", "content": content}
+}
+
+// exists returns whether the catalog has an entry at p
+func exists(t *testing.T, server *Server, p string) bool {
+	t.Helper()
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	_, err := txn.Get([]byte(p))
+	if err == badger.ErrKeyNotFound {
+		return false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// TestBatchLarge checks that a batch of a thousand files into one package fits in one transaction
+func TestBatchLarge(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	ops := []map[string]string{{"op": "mkcol", "path": "/p"}}
+	for i := 0; i < 1000; i++ {
+		ops = append(ops, putOp(fmt.Sprintf("/p/%04d.txt", i), fmt.Sprintf("file %d\n", i)))
+	}
+
+	res, results := postBatch(t, server, ops)
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST /_batch: %d %s", res.Code, results[len(results)-1].Error)
+	}
+
+	for i, result := range results {
+		if result.Status != http.StatusCreated || result.ID == "" {
+			t.Fatalf("operation %d: %+v", i, result)
+		}
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	pkg, err := getPackage([]string{"p"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(pkg.Members.Files) != 1000 {
+		t.Errorf("expected 1000 files, got %d", len(pkg.Members.Files))
+	}
+}
+
+// TestBatchRollback checks that a failing operation fails the whole batch
+// and that the operations around it fail with 424
+func TestBatchRollback(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res, results := postBatch(t, server, []map[string]string{
+		{"op": "mkcol", "path": "/p"},
+		putOp("/p/a.txt", "a\n"),
+		putOp("/missing/b.txt", "b\n"),
+		putOp("/p/c.txt", "c\n"),
+	})
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.Code)
+	}
+
+	statuses := make([]int, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	if expected := []int{424, 424, 404, 424}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, statuses)
+	}
+
+	for _, p := range []string{"/p", "/p/a.txt", "/p/c.txt"} {
+		if exists(t, server, p) {
+			t.Errorf("%s was written by a batch that failed", p)
+		}
+	}
+}
+
+// TestBatchStatuses checks the status of each kind of operation, and moves
+// and deletes of resources that were changed earlier in the same batch
+func TestBatchStatuses(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res := putFile(server, "/old.txt", "old\n", nil)
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+
+	res, results := postBatch(t, server, []map[string]string{
+		putOp("/old.txt", "new\n"),
+		{"op": "mkcol", "path": "/d"},
+		putOp("/d/x.txt", "x\n"),
+		{"op": "mkcol", "path": "/d/sub"},
+		putOp("/d/sub/y.txt", "y\n"),
+		{"op": "move", "path": "/d", "destination": "/e"},
+		{"op": "delete", "path": "/e/x.txt"},
+		{"op": "mkcol", "path": "/f"},
+		putOp("/f/z.txt", "z\n"),
+		{"op": "delete", "path": "/f"},
+	})
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST /_batch: %d %s", res.Code, res.Body.String())
+	}
+
+	statuses := make([]int, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	if expected := []int{204, 201, 201, 201, 201, 201, 204, 201, 201, 204}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, statuses)
+	}
+
+	for p, has := range map[string]bool{
+		"/old.txt":     true,
+		"/d":           false,
+		"/d/x.txt":     false,
+		"/d/sub/y.txt": false,
+		"/e":           true,
+		"/e/x.txt":     false,
+		"/e/sub":       true,
+		"/e/sub/y.txt": true,
+		"/f":           false,
+		"/f/z.txt":     false,
+	} {
+		if exists(t, server, p) != has {
+			t.Errorf("expected %s to exist: %t", p, has)
+		}
+	}
+
+	res = do(server, "GET", "/old.txt", "", nil)
+	if res.Body.String() != "new\n" {
+		t.Errorf("GET /old.txt: %q", res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	e, err := getPackage([]string{"e"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(e.Members.Files) != 0 || len(e.Members.Packages) != 1 {
+		t.Errorf("expected /e to have only the package sub, got %+v", e.Members)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	cid "github.com/ipfs/go-cid"
+	merkledag "github.com/ipfs/go-merkledag"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Packages export as CARv1 archives (https://ipld.io/specs/transport/car/carv1/)
+// with two roots: the package document and its value directory. The value directory
+// links to every member's document or file, and to the value directories of the
+// subpackages, so walking both roots reaches every block in the tree.
+//
+// Importing a CAR archive puts its blocks into IPFS as they're read, but nothing
+// is written to the catalog until the whole archive has been read and checked,
+// so a truncated or incomplete archive only leaves unpinned blocks behind.
+
+const carFormat = "application/vnd.ipld.car"
+
+// maxSectionSize bounds the blocks that an imported CAR archive can contain
+const maxSectionSize = 4 << 20
+
+// ErrInvalidCAR is returned for CAR archives that can't be read
+var ErrInvalidCAR = errors.New("Invalid CAR archive")
+
+// ErrIncompleteCAR is returned for CAR archives that are missing blocks of the package tree
+var ErrIncompleteCAR = errors.New("Incomplete CAR archive: missing blocks of the package tree")
+
+// cborHead encodes the head of a CBOR data item with the given major type and argument
+func cborHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		head := []byte{major | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(n))
+		return head
+	case n <= 0xffffffff:
+		head := []byte{major | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(n))
+		return head
+	default:
+		head := make([]byte, 9)
+		head[0] = major | 27
+		binary.BigEndian.PutUint64(head[1:], n)
+		return head
+	}
+}
+
+// carHeader encodes the DAG-CBOR header {"roots": [...], "version": 1}
+func carHeader(roots []cid.Cid) []byte {
+	header := []byte{0xa2}
+	header = append(header, cborHead(3, 5)...)
+	header = append(header, "roots"...)
+	header = append(header, cborHead(4, uint64(len(roots)))...)
+	for _, root := range roots {
+		// CIDs are tag 42 byte strings with a leading zero byte
+		b := root.Bytes()
+		header = append(header, 0xd8, 42)
+		header = append(header, cborHead(2, uint64(len(b)+1))...)
+		header = append(header, 0)
+		header = append(header, b...)
+	}
+	header = append(header, cborHead(3, 7)...)
+	header = append(header, "version"...)
+	return append(header, cborHead(0, 1)...)
+}
+
+func writeSection(w io.Writer, data ...[]byte) error {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(varint[:binary.PutUvarint(varint, uint64(length))])
+	if err != nil {
+		return err
+	}
+
+	for _, d := range data {
+		_, err = w.Write(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCAR writes every block of the package tree to w as a CAR archive
+func (server *Server) exportCAR(ctx context.Context, w io.Writer, pkg *types.Package) error {
+	roots := []cid.Cid{pkg.Path().Cid(), pkg.ValuePath().Cid()}
+
+	buffer := bufio.NewWriter(w)
+	err := writeSection(buffer, carHeader(roots))
+	if err != nil {
+		return err
+	}
+
+	seen := map[cid.Cid]bool{}
+	stack := []cid.Cid{roots[1], roots[0]}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		r, err := server.api.Block().Get(ctx, path.IpldPath(c))
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		err = writeSection(buffer, c.Bytes(), data)
+		if err != nil {
+			return err
+		}
+
+		if c.Type() == cid.DagProtobuf {
+			node, err := merkledag.DecodeProtobuf(data)
+			if err != nil {
+				return err
+			}
+
+			// Push the links in reverse so that blocks are written in depth-first order
+			links := node.Links()
+			for i := len(links) - 1; i >= 0; i-- {
+				stack = append(stack, links[i].Cid)
+			}
+		}
+	}
+
+	return buffer.Flush()
+}
+
+func readSection(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	} else if length == 0 || length > maxSectionSize {
+		return nil, ErrInvalidCAR
+	}
+
+	section := make([]byte, length)
+	_, err = io.ReadFull(r, section)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return section, err
+}
+
+// carVersion1 is how every CARv1 header ends: the "version" key and the integer 1
+var carVersion1 = append(append(cborHead(3, 7), "version"...), cborHead(0, 1)...)
+
+// importCAR puts every block of a CAR archive into IPFS, checking each block
+// against its CID. It returns an error if the archive is truncated, or if any
+// of its blocks link to blocks that aren't in the archive.
+func (server *Server) importCAR(ctx context.Context, body io.Reader) (map[cid.Cid]bool, error) {
+	r := bufio.NewReader(body)
+	header, err := readSection(r)
+	if err != nil {
+		return nil, ErrInvalidCAR
+	} else if !bytes.HasSuffix(header, carVersion1) {
+		return nil, fmt.Errorf("%w: only CARv1 archives are supported", ErrInvalidCAR)
+	}
+
+	imported := map[cid.Cid]bool{}
+	linked := map[cid.Cid]bool{}
+	for {
+		section, err := readSection(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCAR, err.Error())
+		}
+
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCAR, err.Error())
+		}
+
+		data := section[n:]
+		prefix := c.Prefix()
+		sum, err := prefix.Sum(data)
+		if err != nil || !sum.Equals(c) {
+			return nil, fmt.Errorf("%w: block %s doesn't match its CID", ErrInvalidCAR, c.String())
+		}
+
+		if c.Type() == cid.DagProtobuf {
+			node, err := merkledag.DecodeProtobuf(data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidCAR, err.Error())
+			}
+			for _, link := range node.Links() {
+				linked[link.Cid] = true
+			}
+		}
+
+		if imported[c] {
+			continue
+		}
+
+		format := cid.CodecToStr[prefix.Codec]
+		if prefix.Version == 0 {
+			format = "v0"
+		}
+
+		stat, err := server.api.Block().Put(ctx, bytes.NewReader(data),
+			options.Block.Hash(prefix.MhType, prefix.MhLength),
+			options.Block.Format(format),
+		)
+		if err != nil {
+			return nil, err
+		} else if !stat.Path().Cid().Equals(c) {
+			return nil, fmt.Errorf("%w: block %s was stored as %s", ErrInvalidCAR, c.String(), stat.Path().Cid().String())
+		}
+
+		imported[c] = true
+	}
+
+	for c := range linked {
+		if !imported[c] {
+			return nil, ErrIncompleteCAR
+		}
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// exportPackage puts a package with a few members at /src and returns its ID and a CAR of it
+func exportPackage(t *testing.T, server *Server) (string, []byte) {
+	t.Helper()
+	entries := map[string]string{"a.txt": "a\n", "sub/b.txt": "b\n", "c.nq": "<http://example.com/a> <http://example.com/b> \"c\" .\n"}
+	res := do(server, "PUT", "/src", tarBody(t, entries), map[string]string{"Content-Type": "application/x-tar"})
+	if res.Code != http.StatusNoContent && res.Code != http.StatusCreated {
+		t.Fatalf("PUT /src: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "GET", "/src", "", map[string]string{"Accept": carFormat})
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET /src: %d %s", res.Code, res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	src, err := getPackage([]string{"src"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return src.ID, res.Body.Bytes()
+}
+
+func putCAR(server *Server, target, id string, car []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", target, bytes.NewReader(car))
+	req.Header.Set("Content-Type", carFormat)
+	req.Header.Add("Link", types.LinkTypeDirectContainer)
+	req.Header.Add("Link", makeSelfLink(id))
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	return res
+}
+
+// TestCARRoundTrip checks that a package exported as a CAR can be imported into
+// another server that doesn't have any of its blocks
+func TestCARRoundTrip(t *testing.T) {
+	server, _ := newTestServer(t)
+	id, car := exportPackage(t, server)
+
+	other, _ := newTestServer(t)
+	res := putCAR(other, "/dst", id, car)
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("importing the CAR: %d %s", res.Code, res.Body.String())
+	}
+
+	for p, content := range map[string]string{"/dst/a.txt": "a\n", "/dst/sub/b.txt": "b\n"} {
+		res = do(other, "GET", p, "", nil)
+		if res.Code != http.StatusOK || res.Body.String() != content {
+			t.Errorf("GET %s: %d %q", p, res.Code, res.Body.String())
+		}
+	}
+
+	txn := other.db.NewTransaction(false)
+	defer txn.Discard()
+	dst, err := getPackage([]string{"dst"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if dst.ID != id {
+		t.Errorf("imported package %s, expected %s", dst.ID, id)
+	} else if _, err := getResource([]string{"dst", "c"}, txn); err != nil {
+		t.Errorf("the assertion wasn't imported: %s", err)
+	}
+}
+
+// TestCARIncomplete checks that truncated CARs and CARs missing a block fail with 400
+// without writing anything to the catalog
+func TestCARIncomplete(t *testing.T) {
+	server, _ := newTestServer(t)
+	id, car := exportPackage(t, server)
+
+	// Drop the last raw block, which is linked from a directory in the archive
+	r := bufio.NewReader(bytes.NewReader(car))
+	header, err := readSection(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections := [][]byte{}
+	for {
+		section, err := readSection(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		sections = append(sections, section)
+	}
+
+	dropped := -1
+	for i, section := range sections {
+		_, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.Type() == cid.Raw {
+			dropped = i
+		}
+	}
+	if dropped == -1 {
+		t.Fatal("the CAR has no raw blocks")
+	}
+
+	var missing bytes.Buffer
+	err = writeSection(&missing, header)
+	for i, section := range sections {
+		if i != dropped && err == nil {
+			err = writeSection(&missing, section)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string][]byte{"truncated": car[:len(car)-5], "missing a block": missing.Bytes()} {
+		other, _ := newTestServer(t)
+		res := putCAR(other, "/dst", id, body)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("importing a CAR %s: expected 400, got %d %s", name, res.Code, res.Body.String())
+		}
+
+		txn := other.db.NewTransaction(false)
+		for _, p := range []string{"/dst", "/dst/a.txt", "/dst/sub"} {
+			if _, err := getResource(types.ParsePath(p), txn); err == nil {
+				t.Errorf("importing a CAR %s wrote %s", name, p)
+			}
+		}
+
+		root, err := getPackage(nil, txn)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(root.Members.Packages) != 0 {
+			t.Errorf("importing a CAR %s added members to the root", name)
+		}
+		txn.Discard()
+	}
+}
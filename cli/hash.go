@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	unixfs "github.com/ipfs/go-unixfs"
+	balanced "github.com/ipfs/go-unixfs/importer/balanced"
+	helpers "github.com/ipfs/go-unixfs/importer/helpers"
+	multibase "github.com/multiformats/go-multibase"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// discard is a DAG service that throws away every node it's given,
+// so that we can compute CIDs without talking to an IPFS node.
+type discard struct{}
+
+func (discard) Get(context.Context, cid.Cid) (ipld.Node, error) { return nil, ipld.ErrNotFound }
+func (discard) GetMany(context.Context, []cid.Cid) <-chan *ipld.NodeOption {
+	c := make(chan *ipld.NodeOption)
+	close(c)
+	return c
+}
+func (discard) Add(context.Context, ipld.Node) error        { return nil }
+func (discard) AddMany(context.Context, []ipld.Node) error  { return nil }
+func (discard) Remove(context.Context, cid.Cid) error       { return nil }
+func (discard) RemoveMany(context.Context, []cid.Cid) error { return nil }
+
+// hashFile computes the base32 CID that the server would get by adding r to IPFS
+// (CIDv1 with raw leaves, the same as addOpts in the pkgs daemon)
+func hashFile(r io.Reader) (string, error) {
+	c, _, err := hashNode(r)
+	return c, err
+}
+
+// hashNode is hashFile, but it also returns the cumulative size of the node,
+// which is the size of the links to it in value directories
+func hashNode(r io.Reader) (string, uint64, error) {
+	params := helpers.DagBuilderParams{
+		Dagserv:    discard{},
+		RawLeaves:  true,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		CidBuilder: cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256},
+	}
+
+	db, err := params.New(chunker.DefaultSplitter(r))
+	if err != nil {
+		return "", 0, err
+	}
+
+	node, err := balanced.Layout(db)
+	if err != nil {
+		return "", 0, err
+	}
+
+	size, err := node.Size()
+	if err != nil {
+		return "", 0, err
+	}
+
+	c, err := node.Cid().StringOfBase(multibase.Base32)
+	return c, size, err
+}
+
+// hashDirectory computes the base32 CID of the directory with the given links,
+// the same way the pkgs daemon builds value directories
+func hashDirectory(links []*ipld.Link) (string, error) {
+	dir := unixfs.EmptyDirNode()
+	dir.SetCidBuilder(cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256})
+	for _, link := range links {
+		err := dir.AddRawLink(link.Name, link)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir.Cid().StringOfBase(multibase.Base32)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// listPageSize is how many members ls asks for at a time
+var listPageSize = 1000
+
+var linkNextPattern = regexp.MustCompile(`^<([^<>]+)>; rel="next"$`)
+
+// nextLink returns the target of the rel="next" link in a response, or nil if there isn't one
+func nextLink(res *http.Response) *url.URL {
+	for _, link := range res.Header["Link"] {
+		if match := linkNextPattern.FindStringSubmatch(link); match != nil {
+			u, err := url.Parse(match[1])
+			if err != nil {
+				return nil
+			}
+			return res.Request.URL.ResolveReference(u)
+		}
+	}
+	return nil
+}
+
+// listPackage fetches the package at key a page at a time, and returns it with all of its members.
+// sort is how the server orders the members (title, created, modified, or extent, or - and one of them).
+func listPackage(key []string, sort string) (*types.Package, error) {
+	u := types.GetURI(base, key)
+	if sort != "" {
+		u += "?sort=" + url.QueryEscape(sort)
+	}
+
+	var pkg *types.Package
+	for u != "" {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Add("Accept", "application/ld+json")
+		req.Header.Add("Prefer", fmt.Sprintf(`return=representation; max-member-count="%d"`, listPageSize))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			return nil, errors.New(res.Status)
+		}
+
+		self, t := types.ParseLinks(res.Header["Link"])
+		if self == "" || t != types.PackageType {
+			res.Body.Close()
+			return nil, fmt.Errorf("Resource %s is not a package", types.GetURI(base, key))
+		}
+
+		page := &types.Package{}
+		err = json.NewDecoder(res.Body).Decode(page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if pkg == nil {
+			pkg = page
+		} else {
+			pkg.Members.Packages = append(pkg.Members.Packages, page.Members.Packages...)
+			pkg.Members.Assertions = append(pkg.Members.Assertions, page.Members.Assertions...)
+			pkg.Members.Files = append(pkg.Members.Files, page.Members.Files...)
+		}
+
+		u = ""
+		if next := nextLink(res); next != nil {
+			u = next.String()
+		}
+	}
+
+	return pkg, nil
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -33,33 +36,15 @@ func main() {
 			{
 				Name:      "ls",
 				Usage:     "list the members of a package",
-				UsageText: "ls [resource]",
+				UsageText: "ls --sort [sort] [resource]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "sort",
+						Usage: "title, created, modified, or extent (prefixed with - for descending order)",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					arg := c.Args().First()
-					key := types.ParsePath(arg)
-					url := types.GetURI(base, key)
-					req, err := http.NewRequest("GET", url, nil)
-					if err != nil {
-						return err
-					}
-
-					req.Header.Add("Accept", "application/ld+json")
-					res, err := http.DefaultClient.Do(req)
-					if err != nil {
-						return err
-					}
-
-					if res.StatusCode != 200 {
-						return errors.New(res.Status)
-					}
-
-					self, t := types.ParseLinks(res.Header["Link"])
-					if self == "" || t != types.PackageType {
-						return fmt.Errorf("Resource %s is not a package", arg)
-					}
-
-					pkg := &types.Package{}
-					err = json.NewDecoder(res.Body).Decode(pkg)
+					pkg, err := listPackage(types.ParsePath(c.Args().First()), c.String("sort"))
 					if err != nil {
 						return err
 					}
@@ -318,6 +303,307 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "upload",
+				Usage:     "put a large file in resumable chunks",
+				UsageText: "upload --format [format] [file] [resource]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "format",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					path, resource := c.Args().Get(0), c.Args().Get(1)
+					if path == "" {
+						return errors.New("File path required")
+					} else if resource == "" {
+						return errors.New("Resource path required")
+					} else if strings.HasSuffix(resource, "/") {
+						return errors.New("Upload resource paths cannot end in a trailing slash")
+					} else if strings.HasSuffix(resource, ".") {
+						terms := strings.Split(path, "/")
+						name := terms[len(terms)-1]
+						if name != "" {
+							resource = strings.TrimSuffix(resource, ".") + name
+						}
+					}
+
+					key := types.ParsePath(resource)
+					if len(key) == 0 {
+						return errors.New("Cannot upload the root resource")
+					}
+
+					return upload(path, key, c.String("format"))
+				},
+			},
+			{
+				Name:      "push",
+				Usage:     "upload a directory as a package, replacing the package at resource",
+				UsageText: "push [directory] [resource]",
+				Action: func(c *cli.Context) error {
+					dir, resource := c.Args().Get(0), c.Args().Get(1)
+					if dir == "" {
+						return errors.New("Directory path required")
+					} else if resource == "" {
+						return errors.New("Resource path required")
+					}
+
+					r, w := io.Pipe()
+					go func() { w.CloseWithError(writeTar(w, dir)) }()
+
+					key := types.ParsePath(resource)
+					url := types.GetURI(base, key)
+					req, err := http.NewRequest("PUT", url, r)
+					if err != nil {
+						return err
+					}
+
+					req.Header.Add("Content-Type", "application/x-tar")
+					res, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return err
+					}
+
+					if res.StatusCode != 204 {
+						message, _ := ioutil.ReadAll(res.Body)
+						return fmt.Errorf("%s %s", res.Status, message)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "pull",
+				Usage:     "download a package into a directory",
+				UsageText: "pull [resource] [directory]",
+				Action: func(c *cli.Context) error {
+					resource, dir := c.Args().Get(0), c.Args().Get(1)
+					if dir == "" {
+						return errors.New("Directory path required")
+					}
+
+					key := types.ParsePath(resource)
+					url := types.GetURI(base, key)
+					req, err := http.NewRequest("GET", url, nil)
+					if err != nil {
+						return err
+					}
+
+					req.Header.Add("Accept", "application/x-tar")
+					res, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return err
+					}
+					defer res.Body.Close()
+
+					if res.StatusCode != 200 {
+						return errors.New(res.Status)
+					} else if res.Header.Get("Content-Type") != "application/x-tar" {
+						return fmt.Errorf("Resource %s is not a package", resource)
+					}
+
+					return readTar(res.Body, dir)
+				},
+			},
+			{
+				Name:      "sync",
+				Usage:     "sync the files in a directory with a package in both directions",
+				UsageText: "sync [directory] [resource]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print what would change without changing anything",
+					},
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "propagate deleted files in both directions",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					dir, resource := c.Args().Get(0), c.Args().Get(1)
+					if dir == "" {
+						return errors.New("Directory path required")
+					}
+
+					return syncDirectory(dir, resource, c.Bool("dry-run"), c.Bool("delete"))
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "export a package tree as a CAR archive",
+				UsageText: "export [resource] [file]",
+				Action: func(c *cli.Context) error {
+					key := types.ParsePath(c.Args().Get(0))
+					url := types.GetURI(base, key)
+					req, err := http.NewRequest("GET", url, nil)
+					if err != nil {
+						return err
+					}
+
+					req.Header.Add("Accept", "application/vnd.ipld.car")
+					res, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return err
+					}
+					defer res.Body.Close()
+
+					if res.StatusCode != 200 {
+						return errors.New(res.Status)
+					} else if res.Header.Get("Content-Type") != "application/vnd.ipld.car" {
+						return fmt.Errorf("Resource %s is not a package", c.Args().Get(0))
+					}
+
+					var w io.Writer = os.Stdout
+					if path := c.Args().Get(1); path != "" {
+						file, err := os.Create(path)
+						if err != nil {
+							return err
+						}
+						defer file.Close()
+						w = file
+					}
+
+					_, err = io.Copy(w, res.Body)
+					return err
+				},
+			},
+			{
+				Name:      "mount",
+				Usage:     "mount a package by ID or IPNS name without importing its members",
+				UsageText: "mount [ul: package ID or dweb:/ipns/ name] [resource]",
+				Action: func(c *cli.Context) error {
+					source, resource := c.Args().Get(0), c.Args().Get(1)
+					if source == "" {
+						return errors.New("Package ID or IPNS name required")
+					}
+
+					key := types.ParsePath(resource)
+					if len(key) == 0 {
+						return errors.New("Cannot mount the root resource")
+					}
+
+					body, err := json.Marshal(map[string]string{"source": source})
+					if err != nil {
+						return err
+					}
+
+					url := types.GetURI(base+"/_mounts", key)
+					req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+					if err != nil {
+						return err
+					}
+
+					req.Header.Add("Content-Type", "application/json")
+					res, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return err
+					}
+
+					if res.StatusCode != 201 {
+						return errors.New(res.Status)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "pin",
+				Usage:     "materialize a mounted package, importing all of its members",
+				UsageText: "pin [resource]",
+				Action: func(c *cli.Context) error {
+					key := types.ParsePath(c.Args().First())
+					url := types.GetURI(base+"/_mounts", key)
+					req, err := http.NewRequest("POST", url, nil)
+					if err != nil {
+						return err
+					}
+
+					res, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return err
+					}
+
+					if res.StatusCode != 204 {
+						return errors.New(res.Status)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "keygen",
+				Usage:     "generate an ed25519 signing key",
+				UsageText: "keygen [key file]",
+				Action: func(c *cli.Context) error {
+					path := c.Args().First()
+					if path == "" {
+						return errors.New("Key file path required")
+					} else if _, err := os.Stat(path); err == nil {
+						return fmt.Errorf("%s already exists", path)
+					}
+
+					key, err := types.ReadKey(path, true)
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(types.DidKey(key.Public().(ed25519.PublicKey)))
+					return nil
+				},
+			},
+			{
+				Name:      "sign",
+				Usage:     "sign the current revision of a package",
+				UsageText: "sign --key [key file] [resource]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "PEM-encoded ed25519 private key",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					key, err := types.ReadKey(c.String("key"), false)
+					if err != nil {
+						return err
+					}
+
+					id, err := sign(key, types.ParsePath(c.Args().First()))
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(id)
+					return nil
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "check the content hashes and signatures of a package tree",
+				UsageText: "verify --key [did:key] [resource]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "key",
+						Usage: "trusted did:key signer (can be repeated; any signer is accepted if omitted)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					v := &verifier{trusted: map[string]bool{}}
+					for _, did := range c.StringSlice("key") {
+						if _, err := types.ParseDidKey(did); err != nil {
+							return fmt.Errorf("Invalid did:key %s", did)
+						}
+						v.trusted[did] = true
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+					v.w = w
+					v.verifyPackage(types.ParsePath(c.Args().First()), "")
+					w.Flush()
+					if v.failures > 0 {
+						return fmt.Errorf("%d verification failures", v.failures)
+					}
+					return nil
+				},
+			},
 			{
 				Name:  "query",
 				Usage: "query the package server",
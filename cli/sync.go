@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// ul sync compares a local directory with a remote package in three ways: the local
+// files, the remote files, and the CIDs that both had after the last sync, which are
+// kept in a state file in the directory. Whichever side changed since the last sync
+// wins; if both changed, it's a conflict and neither is touched. Every write is
+// conditional on the remote ETag that the comparison was based on, so a file that
+// changes on the server while syncing is reported as a conflict too.
+//
+// Only files are synced: directories become subpackages, but remote assertions are
+// left alone and packages are never deleted.
+
+const syncStateName = ".ul-sync.json"
+
+type syncer struct {
+	dir     string
+	dryRun  bool
+	delete  bool
+	state   map[string]string
+	next    map[string]string
+	changes int
+	errors  int
+}
+
+func (s *syncer) log(action, path string) {
+	s.changes++
+	fmt.Printf("%s\t%s\n", action, path)
+}
+
+func (s *syncer) fail(path string, err error) {
+	s.errors++
+	fmt.Printf("error\t%s\t%s\n", path, err.Error())
+}
+
+func readSyncState(dir string) (map[string]string, error) {
+	state := map[string]string{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, syncStateName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+func (s *syncer) writeState() error {
+	data, err := json.MarshalIndent(s.next, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, syncStateName), data, 0644)
+}
+
+// fetchPackage fetches the package at key, or returns nil if it doesn't exist
+func fetchPackage(key []string) (*types.Package, error) {
+	req, err := http.NewRequest("GET", types.GetURI(base, key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Accept", "application/ld+json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, nil
+	} else if res.StatusCode != 200 {
+		return nil, errors.New(res.Status)
+	}
+
+	_, t := types.ParseLinks(res.Header["Link"])
+	if t != types.PackageType {
+		return nil, fmt.Errorf("/%s is not a package", strings.Join(key, "/"))
+	}
+
+	pkg := &types.Package{}
+	return pkg, json.NewDecoder(res.Body).Decode(pkg)
+}
+
+// syncPackage syncs the local directory rel (relative to s.dir) with the remote package at key
+func (s *syncer) syncPackage(key []string, rel string) error {
+	pkg, err := fetchPackage(key)
+	if err != nil {
+		return err
+	} else if pkg == nil {
+		s.log("mkpkg", "/"+strings.Join(key, "/"))
+		if !s.dryRun {
+			err = request("MKCOL", key, nil, nil, 201)
+			if err != nil {
+				return err
+			}
+		}
+		pkg = &types.Package{}
+	}
+
+	local := map[string]os.FileInfo{}
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, rel))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() != syncStateName && (info.IsDir() || info.Mode().IsRegular()) {
+			local[info.Name()] = info
+		}
+	}
+
+	remote := map[string]*types.File{}
+	for _, f := range pkg.Members.Files {
+		remote[f.Name()] = f
+	}
+
+	packages := map[string]bool{}
+	for _, p := range pkg.Members.Packages {
+		packages[p.Title] = true
+	}
+
+	names := make([]string, 0, len(local)+len(remote)+len(packages))
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if local[name] == nil {
+			names = append(names, name)
+		}
+	}
+	for name := range packages {
+		if local[name] == nil && remote[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childKey := append(key[:len(key):len(key)], name)
+		childRel := filepath.Join(rel, name)
+		info := local[name]
+		isDir := info != nil && info.IsDir()
+		if isDir && remote[name] != nil || info != nil && !isDir && packages[name] {
+			// A file on one side and a package on the other
+			s.log("conflict", filepath.ToSlash(childRel))
+			continue
+		} else if isDir || packages[name] {
+			if info == nil && !s.dryRun {
+				err = os.MkdirAll(filepath.Join(s.dir, childRel), 0755)
+				if err != nil {
+					return err
+				}
+			}
+			err = s.syncPackage(childKey, childRel)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = s.syncFile(childKey, filepath.ToSlash(childRel), info, remote[name])
+		if err != nil {
+			s.fail(filepath.ToSlash(childRel), err)
+		}
+	}
+
+	return nil
+}
+
+// syncFile syncs one file. info is nil if it doesn't exist locally and remote is nil if it doesn't exist remotely.
+func (s *syncer) syncFile(key []string, rel string, info os.FileInfo, remote *types.File) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(rel))
+	last := s.state[rel]
+
+	var local, remoteCID string
+	if info != nil {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		local, err = hashFile(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if remote != nil {
+		remoteCID = fileCID(remote.ID)
+	}
+
+	keep := func(cid string) {
+		if cid != "" {
+			s.next[rel] = cid
+		}
+	}
+
+	switch {
+	case local == remoteCID:
+		keep(local)
+	case local != last && remoteCID != last:
+		s.log("conflict", rel)
+		keep(last)
+	case local != last && local == "":
+		// Deleted locally
+		if !s.delete {
+			keep(last)
+			return nil
+		}
+		s.log("delete remote", rel)
+		if !s.dryRun {
+			err := request("DELETE", key, nil, map[string]string{"If-Match": etag(remoteCID)}, 204)
+			if err == errPrecondition {
+				s.log("conflict", rel)
+				keep(last)
+				return nil
+			}
+			return err
+		}
+	case local != last:
+		s.log("upload", rel)
+		keep(last)
+		if !s.dryRun {
+			return s.upload(key, rel, path, local, remoteCID)
+		}
+	case remoteCID == "":
+		// Deleted remotely
+		if !s.delete {
+			keep(last)
+			return nil
+		}
+		s.log("delete local", rel)
+		if !s.dryRun {
+			return os.Remove(path)
+		}
+	default:
+		s.log("download", rel)
+		keep(last)
+		if !s.dryRun {
+			return s.download(key, rel, path, remoteCID)
+		}
+	}
+
+	return nil
+}
+
+func etag(cid string) string { return "\"" + cid + "\"" }
+
+func (s *syncer) upload(key []string, rel, path, local, remoteCID string) error {
+	format := mime.TypeByExtension(filepath.Ext(path))
+	if format == "" {
+		format = "application/octet-stream"
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	headers := map[string]string{"Link": types.LinkTypeNonRDFSource, "Content-Type": format}
+	if remoteCID == "" {
+		headers["If-None-Match"] = "*"
+	} else {
+		headers["If-Match"] = etag(remoteCID)
+	}
+
+	err = request("PUT", key, file, headers, 204)
+	if err == errPrecondition {
+		s.log("conflict", rel)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s.next[rel] = local
+	return nil
+}
+
+func (s *syncer) download(key []string, rel, path, remoteCID string) error {
+	res, err := getResource(key, "*/*")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("ETag") != etag(remoteCID) {
+		s.log("conflict", rel)
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(path, res.Body)
+	if err != nil {
+		return err
+	}
+
+	s.next[rel] = remoteCID
+	return nil
+}
+
+var errPrecondition = errors.New(http.StatusText(412))
+
+// request sends a request to the resource at key and checks the status code
+func request(method string, key []string, body io.Reader, headers map[string]string, success int) error {
+	req, err := http.NewRequest(method, types.GetURI(base, key), body)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range headers {
+		req.Header.Add(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == 412 {
+		return errPrecondition
+	} else if res.StatusCode != success {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+func syncDirectory(dir, resource string, dryRun, delete bool) error {
+	state, err := readSyncState(dir)
+	if err != nil {
+		return err
+	}
+
+	s := &syncer{dir: dir, dryRun: dryRun, delete: delete, state: state, next: map[string]string{}}
+	err = s.syncPackage(types.ParsePath(resource), "")
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		err = s.writeState()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.changes == 0 {
+		fmt.Println("Up to date")
+	}
+
+	if s.errors > 0 {
+		return fmt.Errorf("%d errors", s.errors)
+	}
+	return nil
+}
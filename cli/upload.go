@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// uploadChunkSize is how many bytes upload sends in each PATCH
+var uploadChunkSize int64 = 16 << 20
+
+// uploadRetries is how many times in a row upload retries a failed PATCH
+var uploadRetries = 8
+
+// upload uploads the file at path to the resource at key with the tus protocol,
+// resuming from the offset the server reports whenever a chunk fails
+func upload(path string, key []string, format string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	length, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+
+	metadata := fmt.Sprintf("path %s,format %s",
+		base64.StdEncoding.EncodeToString([]byte(types.GetURI("", key))),
+		base64.StdEncoding.EncodeToString([]byte(format)),
+	)
+
+	req, err := http.NewRequest("POST", base+"/_uploads", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Tus-Resumable", "1.0.0")
+	req.Header.Add("Upload-Length", strconv.FormatInt(length, 10))
+	req.Header.Add("Upload-Metadata", metadata)
+	req.Header.Add("Repr-Digest", fmt.Sprintf("sha-256=:%s:", base64.StdEncoding.EncodeToString(h.Sum(nil))))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 201 {
+		return errors.New(res.Status)
+	}
+
+	location, err := res.Request.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	u := location.String()
+
+	var offset int64
+	for failures := 0; ; {
+		n := length - offset
+		if n > uploadChunkSize {
+			n = uploadChunkSize
+		}
+
+		res, err := patchChunk(u, file, offset, n)
+		if err == nil && res.StatusCode == 204 {
+			offset, err = strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil {
+				return err
+			} else if offset == length {
+				return nil
+			}
+			failures = 0
+			continue
+		} else if err == nil && res.StatusCode != 409 && res.StatusCode != 460 && res.StatusCode < 500 {
+			return errors.New(res.Status)
+		}
+
+		failures++
+		if failures > uploadRetries {
+			if err == nil {
+				err = errors.New(res.Status)
+			}
+			return err
+		}
+
+		delay := time.Second << uint(failures-1)
+		log.Printf("Retrying %s in %s after failing at offset %d\n", path, delay, offset)
+		time.Sleep(delay)
+
+		// If this fails too, the next PATCH fails with 409 Conflict and tries again
+		if o, err := uploadOffset(u); err == nil {
+			offset = o
+		}
+	}
+}
+
+// patchChunk sends the n bytes of file at offset to the upload at u
+func patchChunk(u string, file *os.File, offset, n int64) (*http.Response, error) {
+	chunk := make([]byte, n)
+	_, err := file.ReadAt(chunk, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("PATCH", u, bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := sha256.Sum256(chunk)
+	req.Header.Add("Tus-Resumable", "1.0.0")
+	req.Header.Add("Content-Type", "application/offset+octet-stream")
+	req.Header.Add("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Add("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(checksum[:]))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// uploadOffset returns the offset to resume the upload at u from
+func uploadOffset(u string) (int64, error) {
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Add("Tus-Resumable", "1.0.0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, errors.New(res.Status)
+	}
+
+	return strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+}
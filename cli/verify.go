@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	rdf "github.com/underlay/go-rdfjs"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+func getResource(key []string, accept string) (*http.Response, error) {
+	url := types.GetURI(base, key)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accept != "" {
+		req.Header.Add("Accept", accept)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+
+	return res, nil
+}
+
+// sign fetches the current revision of the package at key,
+// signs it, and attaches the proof to it on the server.
+func sign(priv ed25519.PrivateKey, key []string) (string, error) {
+	res, err := getResource(key, "application/n-quads")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	id, t := types.ParseLinks(res.Header["Link"])
+	if t != types.PackageType || !types.PackageURIPattern.MatchString(id) {
+		return "", fmt.Errorf("Resource %s is not a package", "/"+strings.Join(key, "/"))
+	}
+
+	document, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	created := time.Now().Format(time.RFC3339)
+	proof, err := types.MakeProof(priv, id, document, created)
+	if err != nil {
+		return "", err
+	}
+
+	url := types.GetURI(base+"/_proof", key)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(proof))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Content-Type", "application/n-quads")
+	req.Header.Add("If-Match", res.Header.Get("ETag"))
+	put, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer put.Body.Close()
+
+	if put.StatusCode != 204 {
+		return "", errors.New(put.Status)
+	}
+
+	return id, nil
+}
+
+// A verifier walks a package tree and checks content hashes and proofs
+type verifier struct {
+	trusted  map[string]bool
+	w        io.Writer
+	failures int
+}
+
+func (v *verifier) fail(key []string, format string, args ...interface{}) {
+	v.failures++
+	fmt.Fprintf(v.w, "FAIL\t/%s\t%s\n", strings.Join(key, "/"), fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) ok(key []string, id, note string) {
+	fmt.Fprintf(v.w, "ok\t/%s\t%s\t%s\n", strings.Join(key, "/"), id, note)
+}
+
+func submatch(pattern *regexp.Regexp) func(string) string {
+	return func(id string) string {
+		if match := pattern.FindStringSubmatch(id); match != nil {
+			return match[1]
+		}
+		return ""
+	}
+}
+
+var packageCID = submatch(types.PackageURIPattern)
+var assertionCID = submatch(types.AssertionURIPattern)
+var fileCID = submatch(types.FileURIPattern)
+
+// verifyPackage checks the package at key and everything beneath it. The members are
+// read from the package document whose hash and proof were checked, and the value
+// directory is rebuilt from them, so a server can't add, hide, or swap members.
+// It returns the package and the size of its document, or nil if it didn't verify.
+func (v *verifier) verifyPackage(key []string, expected string) (*types.Package, uint64) {
+	res, err := getResource(key, "application/n-quads")
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	}
+
+	id, t := types.ParseLinks(res.Header["Link"])
+	proofID := types.ParseProofLink(res.Header["Link"])
+	document, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	} else if t != types.PackageType {
+		v.fail(key, "not a package")
+		return nil, 0
+	} else if expected != "" && id != expected {
+		v.fail(key, "parent lists %s but the package is %s", expected, id)
+		return nil, 0
+	}
+
+	c, size, err := hashNode(bytes.NewReader(document))
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	} else if c != packageCID(id) {
+		v.fail(key, "content hashes to %s, expected %s", c, packageCID(id))
+		return nil, 0
+	}
+
+	if proofID == "" {
+		v.fail(key, "no proof for %s", id)
+	} else if method, err := v.verifyProof(key, id, proofID, document); err != nil {
+		v.fail(key, "proof %s: %s", proofID, err)
+	} else if did := strings.Split(method, "#")[0]; len(v.trusted) > 0 && !v.trusted[did] {
+		v.fail(key, "signed by untrusted key %s", did)
+	} else {
+		v.ok(key, id, "signed by "+did)
+	}
+
+	quads, err := rdf.ReadQuads(bytes.NewReader(document))
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	}
+
+	pkg, err := types.ReadPackage(quads)
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	}
+	pkg.ID = id
+
+	// Every member has to verify for the value directory to be checked
+	links, complete := []*ipld.Link{}, true
+	link := func(name, id string, size uint64) {
+		c, err := cid.Decode(id)
+		if err != nil {
+			complete = false
+			return
+		}
+		links = append(links, &ipld.Link{Name: name, Cid: c, Size: size})
+	}
+
+	for _, p := range pkg.Members.Packages {
+		child, size := v.verifyPackage(append(key[:len(key):len(key)], p.Name()), p.ID)
+		if child == nil {
+			complete = false
+			continue
+		}
+		link(p.Name(), fileCID(child.Value.ID), uint64(child.Value.Extent))
+		link(p.Name()+types.NQuadsFileExtension, packageCID(child.ID), size)
+	}
+
+	for _, a := range pkg.Members.Assertions {
+		size, ok := v.verifyMember(append(key[:len(key):len(key)], a.Name()), a.ID, assertionCID)
+		if !ok {
+			complete = false
+			continue
+		}
+		link(a.Name()+types.NQuadsFileExtension, assertionCID(a.ID), size)
+	}
+
+	for _, f := range pkg.Members.Files {
+		size, ok := v.verifyMember(append(key[:len(key):len(key)], f.Name()), f.ID, fileCID)
+		if !ok {
+			complete = false
+			continue
+		}
+		link(f.Name(), fileCID(f.ID), size)
+	}
+
+	if !complete {
+		return nil, 0
+	}
+
+	value, err := hashDirectory(links)
+	if err != nil {
+		v.fail(key, "%s", err)
+		return nil, 0
+	} else if value != fileCID(pkg.Value.ID) {
+		v.fail(key, "value directory of the members hashes to %s, expected %s", value, fileCID(pkg.Value.ID))
+		return nil, 0
+	}
+
+	return pkg, size
+}
+
+func (v *verifier) verifyProof(key []string, id, proofID string, document []byte) (string, error) {
+	res, err := getResource(append([]string{"_proof"}, key...), "application/n-quads")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	proof, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if c, err := hashFile(bytes.NewReader(proof)); err != nil {
+		return "", err
+	} else if c != assertionCID(proofID) {
+		return "", fmt.Errorf("proof document hashes to %s", c)
+	}
+
+	return types.VerifyProof(id, document, proof)
+}
+
+// verifyMember checks the assertion or file at key, and returns its size
+func (v *verifier) verifyMember(key []string, id string, pattern func(string) string) (uint64, bool) {
+	res, err := getResource(key, "application/n-quads")
+	if err != nil {
+		v.fail(key, "%s", err)
+		return 0, false
+	}
+	defer res.Body.Close()
+
+	if self, _ := types.ParseLinks(res.Header["Link"]); self != id {
+		v.fail(key, "parent lists %s but the resource is %s", id, self)
+		return 0, false
+	}
+
+	expected := pattern(id)
+	if expected == "" {
+		v.fail(key, "malformed ID %s", id)
+		return 0, false
+	}
+
+	c, size, err := hashNode(res.Body)
+	if err != nil {
+		v.fail(key, "%s", err)
+		return 0, false
+	} else if c != expected {
+		v.fail(key, "content hashes to %s, expected %s", c, expected)
+		return 0, false
+	}
+
+	v.ok(key, id, "")
+	return size, true
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// WebDAV write locks (RFC 4918 class 2). A lock is recorded in badger under
+// _locks/{token}, and covers its path, plus everything beneath it if its depth
+// is infinity. Exclusive locks can't overlap any other lock; shared locks can
+// overlap each other. Expired locks are ignored, and deleted the next time a
+// lock is taken.
+//
+// Writes submit lock tokens in the If header. Writing a resource needs the tokens
+// of the locks that cover it, and of a depth-0 lock on its parent if it adds a
+// member to the parent. Deleting or replacing a subtree also needs the tokens of
+// the locks beneath it, and deleting or moving a resource deletes its locks.
+// Locking a path that doesn't exist yet reserves it without creating anything.
+
+const lockPrefix = "_locks/"
+
+// lockGenerationKey is read with the locks and incremented whenever one is added
+// or removed. Badger only detects conflicts on keys that a transaction read, so
+// without it two overlapping LOCKs (or a LOCK and a write checking the locks)
+// could both commit without either seeing the other's new key under lockPrefix.
+const lockGenerationKey = "_gen/locks"
+const lockTokenScheme = "opaquelocktoken:"
+
+var defaultLockTimeout = 10 * time.Minute
+var maxLockTimeout = 24 * time.Hour
+
+// ErrLocked is returned for writes to locked resources that don't submit the lock token,
+// and for locks that conflict with an existing lock
+var ErrLocked = errors.New("Resource is locked")
+
+// ErrInvalidIf is returned for If headers that don't parse
+var ErrInvalidIf = errors.New("Invalid If header")
+
+// ErrInvalidLock is returned for LOCK requests with an invalid body or Depth header
+var ErrInvalidLock = errors.New("Invalid lock request: expected a lockinfo element with a write locktype, and a Depth of 0 or infinity")
+
+// ErrLockToken is returned for UNLOCK requests whose token doesn't identify a lock on the request URI
+var ErrLockToken = errors.New("Lock token doesn't match a lock on the resource")
+
+// What a write does, which decides which locks it has to submit the tokens of
+const (
+	writeResource = iota // writes the resource at key
+	writeSubtree         // replaces the resource at key and everything beneath it
+	removeSubtree        // deletes the resource at key and everything beneath it
+)
+
+type davLock struct {
+	Token   string `json:"token"`
+	Path    string `json:"path"`
+	Scope   string `json:"scope"`
+	Depth   string `json:"depth"`
+	Owner   string `json:"owner,omitempty"`
+	Timeout int64  `json:"timeout"`
+	Expires string `json:"expires"`
+}
+
+func lockKey(token string) []byte { return []byte(lockPrefix + token) }
+
+func (lock *davLock) key() []string { return types.ParsePath(lock.Path) }
+
+func (lock *davLock) expired(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, lock.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+// covers reports whether key is the lock's path or (for depth infinity) beneath it
+func (lock *davLock) covers(key []string) bool {
+	k := lock.key()
+	return len(k) == len(key) && isInside(key, k) || lock.Depth == "infinity" && isInside(key, k)
+}
+
+func (lock *davLock) refresh(timeout time.Duration) {
+	lock.Timeout = int64(timeout / time.Second)
+	lock.Expires = time.Now().Add(timeout).Format(time.RFC3339)
+}
+
+func setLock(lock *davLock, txn *badger.Txn) error {
+	v, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(lockKey(lock.Token), v)
+	if err != nil {
+		return err
+	}
+	return nextLockGeneration(txn)
+}
+
+func deleteLock(token string, txn *badger.Txn) error {
+	err := txn.Delete(lockKey(token))
+	if err != nil {
+		return err
+	}
+	return nextLockGeneration(txn)
+}
+
+// lockGeneration reads the lock generation, adding it to the transaction's reads
+func lockGeneration(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get([]byte(lockGenerationKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var generation uint64
+	err = item.Value(func(val []byte) error {
+		if len(val) == 8 {
+			generation = binary.BigEndian.Uint64(val)
+		}
+		return nil
+	})
+	return generation, err
+}
+
+func nextLockGeneration(txn *badger.Txn) error {
+	generation, err := lockGeneration(txn)
+	if err != nil {
+		return err
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, generation+1)
+	return txn.Set([]byte(lockGenerationKey), val)
+}
+
+// getLocks returns the locks that haven't expired, and the tokens of the ones that have
+func getLocks(txn *badger.Txn) (locks []*davLock, expired []string, err error) {
+	_, err = lockGeneration(txn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = []byte(lockPrefix)
+	iter := txn.NewIterator(iterOpts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		lock := &davLock{}
+		err = iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, lock) })
+		if err != nil {
+			return nil, nil, err
+		} else if lock.expired(now) {
+			expired = append(expired, lock.Token)
+		} else {
+			locks = append(locks, lock)
+		}
+	}
+	return
+}
+
+// removeLocks deletes the locks on key and beneath it
+func removeLocks(key []string, txn *badger.Txn) error {
+	locks, _, err := getLocks(txn)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range locks {
+		if isInside(lock.key(), key) {
+			err = deleteLock(lock.Token, txn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// An ifCondition is a state token or entity tag in an If header, optionally negated
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+// An ifList is a parenthesized list of conditions, which holds if all of them do.
+// resource is the tagged resource that they apply to, or empty for the request URI.
+type ifList struct {
+	resource   string
+	conditions []*ifCondition
+}
+
+// parseIf parses an If header into its lists
+func parseIf(header string) ([]*ifList, error) {
+	var lists []*ifList
+	var resource string
+	s := strings.TrimSpace(header)
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end == -1 {
+				return nil, ErrInvalidIf
+			}
+			resource, s = s[1:end], s[end+1:]
+		case '(':
+			list := &ifList{resource: resource}
+			s = strings.TrimSpace(s[1:])
+			for s != "" && s[0] != ')' {
+				c := &ifCondition{}
+				if strings.HasPrefix(s, "Not") {
+					c.not, s = true, strings.TrimSpace(s[3:])
+				}
+
+				if s == "" {
+					return nil, ErrInvalidIf
+				} else if s[0] == '<' {
+					end := strings.IndexByte(s, '>')
+					if end == -1 {
+						return nil, ErrInvalidIf
+					}
+					c.token, s = s[1:end], s[end+1:]
+				} else if s[0] == '[' {
+					end := strings.IndexByte(s, ']')
+					if end == -1 {
+						return nil, ErrInvalidIf
+					}
+					c.etag, s = strings.TrimPrefix(s[1:end], "W/"), s[end+1:]
+				} else {
+					return nil, ErrInvalidIf
+				}
+
+				list.conditions = append(list.conditions, c)
+				s = strings.TrimSpace(s)
+			}
+
+			if s == "" || len(list.conditions) == 0 {
+				return nil, ErrInvalidIf
+			}
+
+			lists, s = append(lists, list), s[1:]
+		default:
+			return nil, ErrInvalidIf
+		}
+		s = strings.TrimSpace(s)
+	}
+
+	if header != "" && len(lists) == 0 {
+		return nil, ErrInvalidIf
+	}
+
+	return lists, nil
+}
+
+// submitted returns the lock tokens that the If header submits
+func submitted(lists []*ifList) map[string]bool {
+	tokens := map[string]bool{}
+	for _, list := range lists {
+		for _, c := range list.conditions {
+			if c.token != "" && !c.not {
+				tokens[c.token] = true
+			}
+		}
+	}
+	return tokens
+}
+
+// evaluate reports whether any of the lists of an If header hold.
+// Untagged lists apply to the resource at key.
+func evaluate(lists []*ifList, key []string, locks []*davLock, txn *badger.Txn) (bool, error) {
+	for _, list := range lists {
+		k := key
+		if list.resource != "" {
+			u, err := url.Parse(list.resource)
+			if err != nil {
+				return false, ErrInvalidIf
+			}
+			k = types.ParsePath(u.Path)
+		}
+
+		holds := true
+		for _, c := range list.conditions {
+			var ok bool
+			if c.token != "" {
+				for _, lock := range locks {
+					if lock.Token == c.token && lock.covers(k) {
+						ok = true
+						break
+					}
+				}
+			} else {
+				r, err := getResource(k, txn)
+				if err == nil {
+					ok = r.ETag() == c.etag
+				} else if err != badger.ErrKeyNotFound {
+					return false, err
+				}
+			}
+
+			if ok == c.not {
+				holds = false
+				break
+			}
+		}
+
+		if holds {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkLocks checks the If header of req, and that it submits the tokens of the locks
+// that a write to key needs (see the top of this file). Reading the locks in txn means
+// that the commit fails if they change.
+func checkLocks(req *http.Request, key []string, write int, txn *badger.Txn) error {
+	lists, err := parseIf(req.Header.Get("If"))
+	if err != nil {
+		return err
+	}
+
+	locks, _, err := getLocks(txn)
+	if err != nil {
+		return err
+	}
+
+	if lists != nil {
+		holds, err := evaluate(lists, types.ParsePath(req.URL.Path), locks, txn)
+		if err != nil {
+			return err
+		} else if !holds {
+			return ErrPrecondition
+		}
+	}
+
+	if len(locks) == 0 {
+		return nil
+	}
+
+	member := write == removeSubtree
+	if !member && len(key) > 0 {
+		_, err = txn.Get(getKey(key))
+		if err == badger.ErrKeyNotFound {
+			member = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	tokens := submitted(lists)
+	var shared, sharedSubmitted bool
+	for _, lock := range locks {
+		k := lock.key()
+		applies := lock.covers(key) || write != writeResource && isInside(k, key)
+		if member && len(k) == len(key)-1 && isInside(key, k) {
+			applies = true
+		}
+
+		if !applies {
+			continue
+		} else if lock.Scope == "shared" {
+			shared = true
+			sharedSubmitted = sharedSubmitted || tokens[lock.Token]
+		} else if !tokens[lock.Token] {
+			return ErrLocked
+		}
+	}
+
+	if shared && !sharedSubmitted {
+		return ErrLocked
+	}
+
+	return nil
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	// Format the random bytes as a version 4 UUID
+	b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+	return fmt.Sprintf("%s%x-%x-%x-%x-%x", lockTokenScheme, b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// parseTimeout returns the first timeout in a Timeout header, capped at maxLockTimeout
+func parseTimeout(header string) time.Duration {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "Infinite" {
+			return maxLockTimeout
+		} else if strings.HasPrefix(t, "Second-") {
+			seconds, err := strconv.ParseInt(strings.TrimPrefix(t, "Second-"), 10, 64)
+			if err != nil || seconds <= 0 {
+				continue
+			} else if timeout := time.Duration(seconds) * time.Second; timeout/time.Second == time.Duration(seconds) && timeout < maxLockTimeout {
+				return timeout
+			}
+			return maxLockTimeout
+		}
+	}
+	return defaultLockTimeout
+}
+
+type lockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	LockType struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+	Owner *davRaw `xml:"DAV: owner"`
+}
+
+// davRaw is an element whose contents are copied verbatim
+type davRaw struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type davHref struct {
+	Href string `xml:"D:href"`
+}
+
+type activeLock struct {
+	XMLName   xml.Name `xml:"D:activelock"`
+	LockType  davRaw   `xml:"D:locktype"`
+	LockScope davRaw   `xml:"D:lockscope"`
+	Depth     string   `xml:"D:depth"`
+	Owner     *davRaw  `xml:"D:owner,omitempty"`
+	Timeout   string   `xml:"D:timeout"`
+	LockToken davHref  `xml:"D:locktoken"`
+	LockRoot  davHref  `xml:"D:lockroot"`
+}
+
+// active describes the lock for lockdiscovery, with the time it has left as its timeout
+func (lock *davLock) active() *activeLock {
+	timeout := lock.Timeout
+	if expires, err := time.Parse(time.RFC3339, lock.Expires); err == nil {
+		timeout = int64(time.Until(expires) / time.Second)
+	}
+
+	a := &activeLock{
+		LockType:  davRaw{"<D:write/>"},
+		LockScope: davRaw{"<D:" + lock.Scope + "/>"},
+		Depth:     lock.Depth,
+		Timeout:   "Second-" + strconv.FormatInt(timeout, 10),
+		LockToken: davHref{lock.Token},
+		LockRoot:  davHref{lock.Path},
+	}
+	if lock.Owner != "" {
+		a.Owner = &davRaw{lock.Owner}
+	}
+	return a
+}
+
+// writeLock writes the lockdiscovery response to a LOCK request.
+// New locks also get their token in the Lock-Token header.
+func writeLock(res http.ResponseWriter, lock *davLock, status int, issued bool) {
+	body, err := xml.Marshal(&struct {
+		XMLName       xml.Name    `xml:"D:prop"`
+		Namespace     string      `xml:"xmlns:D,attr"`
+		LockDiscovery *activeLock `xml:"D:lockdiscovery>D:activelock"`
+	}{Namespace: "DAV:", LockDiscovery: lock.active()})
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("Content-Type", `application/xml; charset="utf-8"`)
+	if issued {
+		res.Header().Add("Lock-Token", "<"+lock.Token+">")
+	}
+	res.WriteHeader(status)
+	res.Write([]byte(xml.Header))
+	res.Write(body)
+}
+
+// Lock handles WebDAV LOCK requests, which take a new lock or refresh an existing one
+func (server *Server) Lock(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	key := types.ParsePath(req.URL.Path)
+	timeout := parseTimeout(req.Header.Get("Timeout"))
+
+	info := &lockInfo{}
+	err := xml.NewDecoder(req.Body).Decode(info)
+	if err == io.EOF {
+		info = nil
+	} else if err != nil || info.LockType.Write == nil || (info.LockScope.Exclusive == nil) == (info.LockScope.Shared == nil) {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidLock.Error()))
+		return
+	}
+
+	depth := req.Header.Get("Depth")
+	if depth == "" || depth == "Infinity" {
+		depth = "infinity"
+	} else if depth != "0" && depth != "infinity" {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidLock.Error()))
+		return
+	}
+
+	var lock *davLock
+	var created bool
+	err = server.write(key, func(txn *badger.Txn) error {
+		locks, expired, err := getLocks(txn)
+		if err != nil {
+			return err
+		}
+
+		for _, token := range expired {
+			err = deleteLock(token, txn)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A LOCK without a body refreshes the lock submitted in the If header
+		if info == nil {
+			lists, err := parseIf(req.Header.Get("If"))
+			if err != nil {
+				return err
+			}
+
+			tokens := submitted(lists)
+			for _, l := range locks {
+				if tokens[l.Token] && l.covers(key) {
+					lock = l
+					lock.refresh(timeout)
+					err = setLock(lock, txn)
+					if err != nil {
+						return err
+					}
+					return server.commitTxn(txn)
+				}
+			}
+
+			return ErrPrecondition
+		}
+
+		lock = &davLock{Path: "/" + strings.Join(key, "/"), Scope: "exclusive", Depth: depth}
+		if info.LockScope.Shared != nil {
+			lock.Scope = "shared"
+		}
+		if info.Owner != nil {
+			lock.Owner = strings.TrimSpace(info.Owner.InnerXML)
+		}
+
+		for _, l := range locks {
+			overlaps := l.covers(key) || lock.covers(l.key())
+			if overlaps && (l.Scope == "exclusive" || lock.Scope == "exclusive") {
+				return ErrLocked
+			}
+		}
+
+		_, err = txn.Get(getKey(key))
+		if err == badger.ErrKeyNotFound {
+			created = true
+			if len(key) == 0 {
+				return err
+			}
+			item, err := txn.Get(getKey(key[:len(key)-1]))
+			if err != nil {
+				return err
+			} else if item.UserMeta() != byte(types.PackageType) {
+				return ErrParentNotPackage
+			}
+		} else if err != nil {
+			return err
+		}
+
+		lock.Token, err = newLockToken()
+		if err != nil {
+			return err
+		}
+
+		lock.refresh(timeout)
+		err = setLock(lock, txn)
+		if err != nil {
+			return err
+		}
+		return server.commitTxn(txn)
+	})
+
+	if err == ErrInvalidIf {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == badger.ErrKeyNotFound || err == ErrParentNotPackage {
+		res.WriteHeader(409)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if info == nil {
+		writeLock(res, lock, 200, false)
+	} else if created {
+		writeLock(res, lock, 201, true)
+	} else {
+		writeLock(res, lock, 200, true)
+	}
+}
+
+// Unlock handles WebDAV UNLOCK requests
+func (server *Server) Unlock(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	key := types.ParsePath(req.URL.Path)
+	token := strings.TrimSpace(req.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		res.WriteHeader(400)
+		return
+	}
+
+	token = token[1 : len(token)-1]
+	err := server.write(key, func(txn *badger.Txn) error {
+		_, err := lockGeneration(txn)
+		if err != nil {
+			return err
+		}
+
+		item, err := txn.Get(lockKey(token))
+		if err == badger.ErrKeyNotFound {
+			return ErrLockToken
+		} else if err != nil {
+			return err
+		}
+
+		lock := &davLock{}
+		err = item.Value(func(val []byte) error { return json.Unmarshal(val, lock) })
+		if err != nil {
+			return err
+		} else if lock.expired(time.Now()) || !lock.covers(key) {
+			return ErrLockToken
+		}
+
+		err = deleteLock(token, txn)
+		if err != nil {
+			return err
+		}
+		return server.commitTxn(txn)
+	})
+
+	if err == ErrLockToken {
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(204)
+}
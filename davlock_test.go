@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>test</D:owner>
+</D:lockinfo>`
+
+func TestLock(t *testing.T) {
+	server, _ := newTestServer(t)
+	res := putFile(server, "/hello.txt", "Hello World!\n", nil)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "LOCK", "/hello.txt", lockBody, map[string]string{"Content-Type": "application/xml"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("LOCK: %d %s", res.Code, res.Body.String())
+	}
+
+	token := res.Header().Get("Lock-Token")
+	if token == "" {
+		t.Fatal("LOCK: no Lock-Token")
+	}
+
+	res = putFile(server, "/hello.txt", "Goodbye!\n", nil)
+	if res.Code != http.StatusLocked {
+		t.Fatalf("PUT without the lock token: expected 423, got %d", res.Code)
+	}
+
+	res = putFile(server, "/hello.txt", "Goodbye!\n", map[string]string{"If": "(" + token + ")"})
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT with the lock token: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "UNLOCK", "/hello.txt", "", map[string]string{"Lock-Token": token})
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: %d %s", res.Code, res.Body.String())
+	}
+
+	res = putFile(server, "/hello.txt", "Hello again!\n", nil)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT after UNLOCK: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "GET", "/hello.txt", "", nil)
+	if res.Body.String() != "Hello again!\n" {
+		t.Fatalf("GET: %q", res.Body.String())
+	}
+}
+
+// TestLockConcurrent checks that of two overlapping exclusive LOCKs made at the
+// same time, exactly one succeeds
+func TestLockConcurrent(t *testing.T) {
+	server, _ := newTestServer(t)
+	res := do(server, "MKCOL", "/a", "", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", res.Code, res.Body.String())
+	}
+
+	header := map[string]string{"Content-Type": "application/xml"}
+	for i := 0; i < 50; i++ {
+		codes := make(chan int, 2)
+		for _, target := range []string{"/a", "/a/b"} {
+			go func(target string) {
+				codes <- do(server, "LOCK", target, lockBody, header).Code
+			}(target)
+		}
+
+		a, b := <-codes, <-codes
+		locked := 0
+		for _, code := range []int{a, b} {
+			if code == http.StatusLocked {
+				locked++
+			} else if code != http.StatusOK && code != http.StatusCreated {
+				t.Fatalf("LOCK: unexpected status %d", code)
+			}
+		}
+		if locked != 1 {
+			t.Fatalf("expected exactly one LOCK to fail with 423, got %d and %d", a, b)
+		}
+
+		txn := server.db.NewTransaction(true)
+		locks, _, err := getLocks(txn)
+		if err == nil {
+			for _, lock := range locks {
+				if err = deleteLock(lock.Token, txn); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = txn.Commit()
+		}
+		txn.Discard()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
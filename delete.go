@@ -6,51 +6,64 @@ import (
 	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
-	rpc "github.com/underlay/pkgs/rpc"
 	types "github.com/underlay/pkgs/types"
 )
 
 // Delete a resource
 func (server *Server) Delete(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	key := types.ParsePath(req.URL.Path)
-	txn := server.db.NewTransaction(true)
-	defer txn.Discard()
+	timestamp := time.Now().Format(time.RFC3339)
+	err := server.write(key, func(txn *badger.Txn) error {
+		r, err := getResource(key, txn)
+		if err != nil {
+			return err
+		}
 
-	r, err := getResource(key, txn)
-	if err == badger.ErrKeyNotFound {
-		res.WriteHeader(404)
-		return
-	} else if err != nil {
-		res.WriteHeader(500)
-		res.Write([]byte(err.Error()))
-		return
-	}
+		err = checkLocks(req, key, removeSubtree, txn)
+		if err != nil {
+			return err
+		}
 
-	if pkg, is := r.(*types.Package); is {
-		err = server.deleteChildren(key, pkg, txn)
+		err = checkPreconditions(req, key, txn)
 		if err != nil {
-			return
+			return err
 		}
-	}
 
-	rpc.Delete(key, r, server.api)
-	err = txn.Delete(getKey(key))
-	if err != nil {
-		res.WriteHeader(500)
+		if pkg, is := r.(*types.Package); is {
+			err = server.deleteChildren(ctx, key, pkg, txn)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = server.deleteEntry(key, r, txn)
+		if err != nil {
+			return err
+		}
+
+		err = removeLocks(key, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, nil, txn)
+	})
+
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	timestamp := time.Now().Format(time.RFC3339)
-	err = server.commit(ctx, timestamp, key, nil, txn)
-	if err != nil {
-		res.WriteHeader(500)
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = txn.Commit()
-	if err != nil {
+	} else if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
 		return
@@ -60,9 +73,15 @@ func (server *Server) Delete(ctx context.Context, res http.ResponseWriter, req *
 }
 
 func (server *Server) deleteChildren(
+	ctx context.Context,
 	key []string, pkg *types.Package,
 	txn *badger.Txn,
 ) error {
+	// Mounts don't have any children in the catalog
+	if mounted, err := server.removeMount(ctx, key, pkg, txn); err != nil || mounted {
+		return err
+	}
+
 	for _, p := range pkg.Members.Packages {
 		childKey := append(key, p.Name())
 		childPkg, err := getPackage(childKey, txn)
@@ -70,13 +89,12 @@ func (server *Server) deleteChildren(
 			return err
 		}
 
-		err = server.deleteChildren(childKey, childPkg, txn)
+		err = server.deleteChildren(ctx, childKey, childPkg, txn)
 		if err != nil {
 			return err
 		}
 
-		rpc.Delete(childKey, childPkg, server.api)
-		err = txn.Delete(getKey(childKey))
+		err = server.deleteEntry(childKey, childPkg, txn)
 		if err != nil {
 			return err
 		}
@@ -84,8 +102,7 @@ func (server *Server) deleteChildren(
 
 	for _, a := range pkg.Members.Assertions {
 		childKey := append(key, a.Name())
-		rpc.Delete(childKey, a, server.api)
-		err := txn.Delete(getKey(childKey))
+		err := server.deleteEntry(childKey, a, txn)
 		if err != nil {
 			return err
 		}
@@ -93,8 +110,7 @@ func (server *Server) deleteChildren(
 
 	for _, f := range pkg.Members.Files {
 		childKey := append(key, f.Name())
-		rpc.Delete(childKey, f, server.api)
-		err := txn.Delete(getKey(childKey))
+		err := server.deleteEntry(childKey, f, txn)
 		if err != nil {
 			return err
 		}
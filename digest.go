@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
+	types "github.com/underlay/pkgs/types"
+)
+
+// File uploads (PUT and POST bodies, and resumable uploads) are checked against
+// the digests in their Content-MD5, Digest (RFC 3230), Content-Digest, and
+// Repr-Digest (RFC 9530) headers, and against the size limit of the package
+// they're uploaded to. Digests with algorithms other than md5, sha (SHA-1),
+// sha-256, and sha-512 are ignored. Files aren't encoded, so the content and
+// representation digests are the same thing.
+
+// ErrInvalidDigest is returned for digest headers that can't be parsed
+var ErrInvalidDigest = errors.New("Invalid digest header")
+
+// ErrDigestMismatch is returned for uploads that don't match their digests
+var ErrDigestMismatch = errors.New("Upload doesn't match its digest")
+
+// ErrTooLarge is returned for uploads larger than the size limit of their package
+var ErrTooLarge = errors.New("Upload exceeds the size limit of the package")
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// digestHeaders are the headers that newUploadBody checks
+var digestHeaders = []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"}
+
+// A digest is one expected hash of an upload
+type digest struct {
+	hash     hash.Hash
+	expected []byte
+}
+
+// parseDigests returns the digests in the digest headers of header
+func parseDigests(header http.Header) ([]*digest, error) {
+	digests := []*digest{}
+	add := func(algorithm, value string) error {
+		h, has := digestAlgorithms[strings.ToLower(strings.TrimSpace(algorithm))]
+		if !has {
+			return nil
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return ErrInvalidDigest
+		}
+
+		d := &digest{hash: h(), expected: expected}
+		if len(expected) != d.hash.Size() {
+			return ErrInvalidDigest
+		}
+
+		digests = append(digests, d)
+		return nil
+	}
+
+	for _, value := range header["Content-Md5"] {
+		if err := add("md5", value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Digest: sha-256=base64, md5=base64
+	for _, value := range header["Digest"] {
+		for _, member := range strings.Split(value, ",") {
+			i := strings.Index(member, "=")
+			if i == -1 {
+				return nil, ErrInvalidDigest
+			}
+			if err := add(member[:i], member[i+1:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Repr-Digest: sha-256=:base64:, sha-512=:base64:
+	for _, name := range []string{"Content-Digest", "Repr-Digest"} {
+		for _, value := range header[name] {
+			for _, member := range strings.Split(value, ",") {
+				member = strings.TrimSpace(strings.SplitN(member, ";", 2)[0])
+				i := strings.Index(member, "=")
+				if i == -1 {
+					return nil, ErrInvalidDigest
+				}
+
+				v := member[i+1:]
+				if len(v) < 2 || v[0] != ':' || v[len(v)-1] != ':' {
+					return nil, ErrInvalidDigest
+				}
+				if err := add(member[:i], v[1:len(v)-1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return digests, nil
+}
+
+// An uploadBody reads the body of a file upload. It fails with ErrTooLarge once
+// it has read more than limit bytes, and hashes everything it reads for digests.
+type uploadBody struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	digests  []*digest
+	exceeded bool
+}
+
+// newUploadBody wraps r, which is length bytes long (or -1 if that isn't known),
+// in the size limit of the package at key and the digests in header
+func (server *Server) newUploadBody(key []string, header http.Header, length int64, r io.Reader) (*uploadBody, error) {
+	limit, err := server.maxSize(key)
+	if err != nil {
+		return nil, err
+	} else if limit > 0 && length > limit {
+		return nil, ErrTooLarge
+	}
+
+	digests, err := parseDigests(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploadBody{r: r, limit: limit, digests: digests}, nil
+}
+
+func (body *uploadBody) Read(p []byte) (int, error) {
+	n, err := body.r.Read(p)
+	body.n += int64(n)
+	if body.limit > 0 && body.n > body.limit {
+		body.exceeded = true
+		return n, ErrTooLarge
+	}
+
+	for _, d := range body.digests {
+		d.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// verify returns ErrDigestMismatch unless every digest matches what's been read
+func (body *uploadBody) verify() error {
+	for _, d := range body.digests {
+		if !bytes.Equal(d.hash.Sum(nil), d.expected) {
+			return ErrDigestMismatch
+		}
+	}
+	return nil
+}
+
+// addFile adds body to IPFS as the file f, and then checks its size and digests
+func (server *Server) addFile(ctx context.Context, f *types.File, body *uploadBody) error {
+	err := server.setFile(ctx, f, files.NewReaderFile(body))
+	if body.exceeded {
+		return ErrTooLarge
+	} else if err != nil {
+		return err
+	}
+	return body.verify()
+}
+
+// uploadStatus returns the status code for an error from newUploadBody, addFile, or checkSizes
+func uploadStatus(err error) int {
+	switch {
+	case err == ErrInvalidDigest, err == ErrDigestMismatch:
+		return 400
+	case errors.Is(err, ErrTooLarge):
+		return 413
+	default:
+		return 502
+	}
+}
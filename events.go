@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Every set and delete of a catalog entry produces an event. Events are collected
+// for each transaction as it's written, stored in badger under _events/{seq} when it
+// commits (so that clients can resume from a Last-Event-ID), and then broadcast to
+// everyone listening on /_events.
+//
+// Stored events are pruned every eventPruneInterval, keeping at most eventRetention of
+// them and none older than eventMaxAge, except that events the webhook dispatcher
+// hasn't seen yet are always kept. The sequence number of the last pruned event is
+// stored at eventPrunedKey, so that clients resuming from before it get 410 Gone
+// instead of silently missing events.
+
+const eventPrefix = "_events/"
+const eventSequenceKey = "_seq/events"
+const eventPrunedKey = "_pruned/events"
+
+// ErrEventsPruned is returned when events after a Last-Event-ID have been pruned
+var ErrEventsPruned = errors.New("Events after the Last-Event-ID have been pruned")
+
+var eventRetention uint64 = 100000
+var eventMaxAge = 7 * 24 * time.Hour
+var eventPruneInterval = 10 * time.Minute
+
+// eventPruneBatch is the number of events deleted in each transaction
+const eventPruneBatch = 1000
+
+// eventHeartbeat is how often idle event streams get a comment, to keep proxies from closing them
+var eventHeartbeat = 15 * time.Second
+
+// An Event describes one change to the catalog. Old is empty for new resources
+// and New is empty for deleted ones. Root is the root package after the change.
+type Event struct {
+	Seq  uint64 `json:"-"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+	Root string `json:"root"`
+	Time string `json:"time"`
+}
+
+// Name is the SSE event name: "set" or "delete"
+func (event *Event) Name() string {
+	if event.New == "" {
+		return "delete"
+	}
+	return "set"
+}
+
+// In returns true if the event is for the resource at scope or one of its descendants
+func (event *Event) In(scope string) bool {
+	return scope == "/" || event.Path == scope || strings.HasPrefix(event.Path, scope+"/")
+}
+
+type eventLog struct {
+	db          *badger.DB
+	sequence    *badger.Sequence
+	mutex       sync.Mutex
+	pending     map[*badger.Txn][]*Event
+	subscribers map[chan *Event]bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newEventLog(db *badger.DB) (*eventLog, error) {
+	sequence, err := db.GetSequence([]byte(eventSequenceKey), 100)
+	if err != nil {
+		return nil, err
+	}
+
+	events := &eventLog{
+		db:          db,
+		sequence:    sequence,
+		pending:     map[*badger.Txn][]*Event{},
+		subscribers: map[chan *Event]bool{},
+		done:        make(chan struct{}),
+	}
+
+	events.wg.Add(1)
+	go events.run()
+	return events, nil
+}
+
+// Close stops pruning and releases the sequence
+func (events *eventLog) Close() {
+	close(events.done)
+	events.wg.Wait()
+	events.sequence.Release()
+}
+
+func (events *eventLog) run() {
+	defer events.wg.Done()
+	ticker := time.NewTicker(eventPruneInterval)
+	defer ticker.Stop()
+	for {
+		err := events.prune()
+		if err != nil {
+			log.Println("Error pruning events:", err)
+		}
+
+		select {
+		case <-events.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune deletes the stored events that are beyond eventRetention or older than
+// eventMaxAge and have already been dispatched to webhooks
+func (events *eventLog) prune() error {
+	var last, cursor uint64
+	err := events.db.View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iterOpts.Prefix = []byte(eventPrefix)
+		iterOpts.Reverse = true
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+		iter.Seek(eventKey(math.MaxUint64))
+		if iter.Valid() {
+			last = binary.BigEndian.Uint64(iter.Item().Key()[len(eventPrefix):])
+		}
+
+		item, err := txn.Get([]byte(webhookCursorKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			cursor = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-eventMaxAge)
+	for {
+		var seqs []uint64
+		err := events.db.View(func(txn *badger.Txn) error {
+			iterOpts := badger.DefaultIteratorOptions
+			iterOpts.Prefix = []byte(eventPrefix)
+			iter := txn.NewIterator(iterOpts)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid() && len(seqs) < eventPruneBatch; iter.Next() {
+				item := iter.Item()
+				seq := binary.BigEndian.Uint64(item.Key()[len(eventPrefix):])
+				if seq > cursor {
+					return nil
+				} else if last-seq < eventRetention {
+					event := &Event{}
+					err := item.Value(func(val []byte) error { return json.Unmarshal(val, event) })
+					if err != nil {
+						return err
+					}
+
+					t, err := time.Parse(time.RFC3339, event.Time)
+					if err != nil || !t.Before(cutoff) {
+						return err
+					}
+				}
+				seqs = append(seqs, seq)
+			}
+			return nil
+		})
+		if err != nil || len(seqs) == 0 {
+			return err
+		}
+
+		err = events.db.Update(func(txn *badger.Txn) error {
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, seqs[len(seqs)-1])
+			err := txn.Set([]byte(eventPrunedKey), value)
+			if err != nil {
+				return err
+			}
+
+			for _, seq := range seqs {
+				err = txn.Delete(eventKey(seq))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || len(seqs) < eventPruneBatch {
+			return err
+		}
+	}
+}
+
+// pruned returns the sequence number of the last pruned event, or zero if none have been
+func pruned(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get([]byte(eventPrunedKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var seq uint64
+	err = item.Value(func(val []byte) error {
+		seq = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return seq, err
+}
+
+// add collects an event for the change at key, which is being written to txn
+func (events *eventLog) add(txn *badger.Txn, key []string, t, old, new string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	event := &Event{Path: "/" + strings.Join(key, "/"), Type: t, Old: old, New: new}
+	events.pending[txn] = append(events.pending[txn], event)
+}
+
+// discard forgets the events collected for txn
+func (events *eventLog) discard(txn *badger.Txn) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	delete(events.pending, txn)
+}
+
+// record writes the events collected for txn to txn, and returns them
+func (events *eventLog) record(txn *badger.Txn) ([]*Event, error) {
+	events.mutex.Lock()
+	pending := events.pending[txn]
+	delete(events.pending, txn)
+	events.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	root, err := getPackage(nil, txn)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().Format(time.RFC3339)
+	for _, event := range pending {
+		event.Root, event.Time = root.ID, timestamp
+
+		// Sequence numbers start at zero, but event IDs start at one
+		seq, err := events.sequence.Next()
+		if err != nil {
+			return nil, err
+		}
+		event.Seq = seq + 1
+
+		value, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+
+		err = txn.Set(eventKey(event.Seq), value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+func eventKey(seq uint64) []byte {
+	key := make([]byte, len(eventPrefix)+8)
+	binary.BigEndian.PutUint64(key[copy(key, eventPrefix):], seq)
+	return key
+}
+
+// publish sends events to every subscriber. Subscribers that can't keep up are dropped;
+// they can reconnect with Last-Event-ID and catch up from the log.
+func (events *eventLog) publish(published []*Event) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	for c := range events.subscribers {
+		if !send(c, published) {
+			delete(events.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+func send(c chan *Event, published []*Event) bool {
+	for _, event := range published {
+		select {
+		case c <- event:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (events *eventLog) subscribe() chan *Event {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	c := make(chan *Event, 64)
+	events.subscribers[c] = true
+	return c
+}
+
+func (events *eventLog) unsubscribe(c chan *Event) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if events.subscribers[c] {
+		delete(events.subscribers, c)
+		close(c)
+	}
+}
+
+// replayEvents calls f with every stored event after seq. It returns ErrEventsPruned
+// if some of them have been pruned.
+func (server *Server) replayEvents(seq uint64, f func(event *Event) error) error {
+	return server.db.View(func(txn *badger.Txn) error {
+		p, err := pruned(txn)
+		if err != nil {
+			return err
+		} else if seq < p {
+			return ErrEventsPruned
+		}
+
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.Prefix = []byte(eventPrefix)
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+		for iter.Seek(eventKey(seq + 1)); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			event := &Event{Seq: binary.BigEndian.Uint64(item.Key()[len(eventPrefix):])}
+			err := item.Value(func(val []byte) error { return json.Unmarshal(val, event) })
+			if err != nil {
+				return err
+			}
+
+			err = f(event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Events handles requests to /_events, streaming every change as Server-Sent Events,
+// and /_events/{path}, which only streams changes to path and its descendants.
+func (server *Server) Events(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+
+	flusher, is := res.(http.Flusher)
+	if !is {
+		res.WriteHeader(500)
+		return
+	}
+
+	var last uint64
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		last, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		txn := server.db.NewTransaction(false)
+		p, err := pruned(txn)
+		txn.Discard()
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		} else if last < p {
+			res.WriteHeader(410)
+			res.Write([]byte(ErrEventsPruned.Error()))
+			return
+		}
+	}
+
+	// Subscribe before replaying so that nothing falls in between
+	c := server.events.subscribe()
+	defer server.events.unsubscribe(c)
+
+	scope := "/" + strings.Join(key, "/")
+	send := func(event *Event) error {
+		if event.Seq <= last {
+			return nil
+		}
+		last = event.Seq
+		if !event.In(scope) {
+			return nil
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Name(), data)
+		return err
+	}
+
+	res.Header().Add("Content-Type", "text/event-stream")
+	res.Header().Add("Cache-Control", "no-cache")
+	res.WriteHeader(200)
+
+	if req.Header.Get("Last-Event-ID") != "" {
+		err := server.replayEvents(last, send)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			_, err := res.Write([]byte(": ping\n\n"))
+			if err != nil {
+				return
+			}
+		case event, open := <-c:
+			if !open {
+				return
+			} else if err := send(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// collect records an event for the change at key, which is being written to txn.
+// old is the resource being replaced or deleted (if any), and r is the new one (if any).
+func (server *Server) collect(txn *badger.Txn, key []string, old, r types.Resource) {
+	var t, oldID, newID string
+	if old != nil {
+		t, oldID = old.Type(), old.URI()
+	}
+	if r != nil {
+		t, newID = r.Type(), r.URI()
+	}
+	server.events.add(txn, key, t, oldID, newID)
+}
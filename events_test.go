@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEventsPruned checks that old events are pruned by count and by age, but not
+// before they're dispatched to webhooks, and that clients resuming from a pruned
+// event get 410
+func TestEventsPruned(t *testing.T) {
+	retention, maxAge := eventRetention, eventMaxAge
+	defer func() { eventRetention, eventMaxAge = retention, maxAge }()
+
+	server, _ := newTestServer(t)
+
+	put := func(p string) {
+		t.Helper()
+		res := putFile(server, p, "hello\n", nil)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	stored := func() []uint64 {
+		t.Helper()
+		seqs := []uint64{}
+		err := server.replayEvents(lastPruned(t, server), func(event *Event) error {
+			seqs = append(seqs, event.Seq)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seqs
+	}
+
+	resume := func(id uint64) *httptest.ResponseRecorder {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/_events", nil).WithContext(ctx)
+		req.Header.Set("Last-Event-ID", fmt.Sprint(id))
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, p := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		put(p)
+	}
+
+	err := server.webhooks.dispatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the dispatcher so that later events stay undispatched
+	server.webhooks.Close()
+	server.webhooks = &webhooks{wake: make(chan struct{}, 1), done: make(chan struct{})}
+
+	all := stored()
+	if len(all) < 3 {
+		t.Fatalf("expected at least 3 events, got %v", all)
+	}
+	last := all[len(all)-1]
+
+	eventRetention = 2
+	err = server.events.prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := stored(); len(seqs) != 2 || seqs[1] != last {
+		t.Errorf("expected the last two events to be kept, got %v", seqs)
+	}
+
+	err = server.replayEvents(0, func(event *Event) error { return nil })
+	if err != ErrEventsPruned {
+		t.Errorf("expected ErrEventsPruned replaying from 0, got %v", err)
+	}
+
+	if res := resume(1); res.Code != http.StatusGone {
+		t.Errorf("resuming from a pruned event: %d %s", res.Code, res.Body.String())
+	}
+
+	res := resume(last - 2)
+	if res.Code != http.StatusOK {
+		t.Errorf("resuming from the last pruned event: %d %s", res.Code, res.Body.String())
+	} else if !strings.Contains(res.Body.String(), fmt.Sprintf("id: %d\n", last)) {
+		t.Errorf("resuming from the last pruned event didn't replay event %d: %s", last, res.Body.String())
+	}
+
+	// Events that haven't been dispatched to webhooks are kept regardless of age
+	eventRetention, eventMaxAge = 1000, -time.Hour
+	put("/d.txt")
+	err = server.events.prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seqs := stored(); len(seqs) == 0 || seqs[0] != last+1 {
+		t.Errorf("expected the undispatched events after %d to be kept, got %v", last, seqs)
+	}
+}
+
+// lastPruned returns the sequence number of the last pruned event
+func lastPruned(t *testing.T, server *Server) uint64 {
+	t.Helper()
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	seq, err := pruned(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	multibase "github.com/multiformats/go-multibase"
+
+	rpc "github.com/underlay/pkgs/rpc"
+	types "github.com/underlay/pkgs/types"
+)
+
+// The package documents in IPFS are authoritative: fsck checks the badger catalog
+// and the indices against them. Repairs only ever rewrite catalog entries and
+// index state; they never create new package revisions, so problems with the
+// documents themselves (or with their value directories) are only reported.
+
+// A discrepancy is something that fsck found wrong with the catalog
+type discrepancy struct {
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// An fsckReport is the result of checking the whole catalog
+type fsckReport struct {
+	Root          string         `json:"root"`
+	Checked       int            `json:"checked"`
+	Discrepancies []*discrepancy `json:"discrepancies"`
+}
+
+// Unrepaired returns the number of discrepancies that are still outstanding
+func (report *fsckReport) Unrepaired() (n int) {
+	for _, d := range report.Discrepancies {
+		if !d.Repaired {
+			n++
+		}
+	}
+	return
+}
+
+type checker struct {
+	server *Server
+	repair bool
+	txn    *badger.Txn
+	seen   map[string]bool
+	report *fsckReport
+}
+
+var hashOnlyOpts = append(addOpts[:len(addOpts):len(addOpts)], options.Unixfs.HashOnly(true))
+
+// fsck walks the package tree from the root. If repair is true, it holds the server mutex
+// and writes every repair to the catalog in a single transaction.
+func (server *Server) fsck(ctx context.Context, repair bool) (*fsckReport, error) {
+	if repair {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+	}
+
+	txn := server.db.NewTransaction(repair)
+	defer server.discard(txn)
+
+	root, err := getPackage(nil, txn)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		server: server,
+		repair: repair,
+		txn:    txn,
+		seen:   map[string]bool{},
+		report: &fsckReport{Root: root.ID, Discrepancies: []*discrepancy{}},
+	}
+
+	_, err = c.checkPackage(ctx, nil, root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.checkOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	if repair {
+		err = server.commitTxn(txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.report, nil
+}
+
+// add records a discrepancy. It's repaired if fix is non-nil and returns no error.
+func (c *checker) add(key []string, fix func() error, format string, args ...interface{}) error {
+	d := &discrepancy{Path: "/" + strings.Join(key, "/"), Problem: fmt.Sprintf(format, args...)}
+	c.report.Discrepancies = append(c.report.Discrepancies, d)
+	if c.repair && fix != nil {
+		err := fix()
+		if err != nil {
+			return err
+		}
+		d.Repaired = true
+	}
+	return nil
+}
+
+func (c *checker) set(key []string, r types.Resource) func() error {
+	return func() error { return c.server.setEntry(key, r, c.txn) }
+}
+
+func sameResource(a, b types.Resource) bool {
+	x, err := marshalResource(a)
+	if err != nil {
+		return false
+	}
+	y, err := marshalResource(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// marshalResource serializes r for sameResource. Keywords are a set, and the
+// package document doesn't keep their order, so they're compared sorted.
+func marshalResource(r types.Resource) ([]byte, error) {
+	if p, is := r.(*types.Package); is && p != nil && len(p.Keywords) > 1 {
+		sorted := *p
+		sorted.Keywords = append([]string{}, p.Keywords...)
+		sort.Strings(sorted.Keywords)
+		r = &sorted
+	}
+	return json.Marshal(r)
+}
+
+// checkPackage checks the catalog entry entry at key against its package document,
+// then checks its members. It returns the package as parsed from IPFS.
+func (c *checker) checkPackage(ctx context.Context, key []string, entry *types.Package) (*types.Package, error) {
+	c.seen[string(getKey(key))] = true
+	c.report.Checked++
+
+	pkg, err := c.server.parse(ctx, &entry.Reference)
+	if err != nil {
+		return nil, c.add(key, nil, "cannot parse package document %s: %s", entry.ID, err)
+	}
+
+	// The proof isn't part of the package document
+	pkg.Proof = entry.Proof
+
+	normalized := *pkg
+	_, _, err = c.server.hashPackage(ctx, &normalized, hashOnlyOpts...)
+	if err != nil {
+		return nil, err
+	} else if normalized.ID != pkg.ID {
+		err = c.add(key, nil, "package document normalizes to %s", normalized.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !sameResource(pkg, entry) {
+		err = c.add(key, c.set(key, pkg), "catalog entry differs from package document %s", pkg.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, err := range rpc.Check(key, pkg, c.server.api) {
+		err = c.add(key, c.set(key, pkg), "index %s: %s", name, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The members of a mount aren't in the catalog
+	if mounted, err := isMounted(key, c.txn); err != nil || mounted {
+		return pkg, err
+	}
+
+	links, err := c.links(ctx, key, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	link := func(name, uri string, pattern func(string) string) error {
+		expected := pattern(uri)
+		actual, has := links[name]
+		delete(links, name)
+		if !has {
+			return c.add(key, nil, "value directory has no link %s", name)
+		} else if actual != expected {
+			return c.add(key, nil, "value directory links %s to %s, expected %s", name, actual, expected)
+		}
+		return nil
+	}
+
+	for _, p := range pkg.Members.Packages {
+		childKey := append(key[:len(key):len(key)], p.Title)
+		child, err := c.checkChildPackage(ctx, childKey, p)
+		if err != nil {
+			return nil, err
+		}
+
+		err = link(p.Title+types.NQuadsFileExtension, p.ID, packageCID)
+		if err != nil {
+			return nil, err
+		} else if child != nil {
+			err = link(p.Title, child.Value.ID, fileCID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, a := range pkg.Members.Assertions {
+		childKey := append(key[:len(key):len(key)], a.Name())
+		err = c.checkMember(ctx, childKey, a)
+		if err != nil {
+			return nil, err
+		}
+
+		err = link(a.Name()+types.NQuadsFileExtension, a.ID, assertionCID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range pkg.Members.Files {
+		childKey := append(key[:len(key):len(key)], f.Name())
+		err = c.checkMember(ctx, childKey, f)
+		if err != nil {
+			return nil, err
+		}
+
+		err = link(f.Name(), f.ID, fileCID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range links {
+		err = c.add(key, nil, "value directory has unexpected link %s", name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg, nil
+}
+
+// links returns the links of the package's value directory, and checks its extent
+func (c *checker) links(ctx context.Context, key []string, pkg *types.Package) (map[string]string, error) {
+	links := map[string]string{}
+
+	value := pkg.ValuePath()
+	if value == nil {
+		return links, c.add(key, nil, "malformed value directory %s", pkg.Value.ID)
+	}
+
+	stat, err := c.server.api.Object().Stat(ctx, value)
+	if err != nil {
+		return nil, err
+	} else if stat.CumulativeSize != pkg.Value.Extent {
+		err = c.add(key, nil, "value directory has extent %d, expected %d", stat.CumulativeSize, pkg.Value.Extent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ls, err := c.server.api.Object().Links(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range ls {
+		links[link.Name], err = link.Cid.StringOfBase(multibase.Base32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return links, nil
+}
+
+func (c *checker) checkChildPackage(ctx context.Context, key []string, p *types.Reference) (*types.Package, error) {
+	r, err := getResource(key, c.txn)
+	if err == badger.ErrKeyNotFound {
+		r = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entry, is := r.(*types.Package)
+	if !is || entry.ID != p.ID {
+		pkg, err := c.server.parse(ctx, p)
+		if err != nil {
+			c.seen[string(getKey(key))] = true
+			return nil, c.add(key, nil, "cannot parse package document %s: %s", p.ID, err)
+		}
+
+		fix := func() error {
+			if r != nil && !is {
+				err := c.server.queue.Delete(key, r, c.txn)
+				if err != nil {
+					return err
+				}
+			}
+			return c.set(key, pkg)()
+		}
+
+		if r == nil {
+			err = c.add(key, fix, "missing catalog entry for package %s", p.ID)
+		} else if !is {
+			err = c.add(key, fix, "catalog entry is not a package")
+		} else {
+			err = c.add(key, fix, "catalog has package %s, expected %s", entry.ID, p.ID)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry = pkg
+	}
+
+	return c.checkPackage(ctx, key, entry)
+}
+
+// checkMember checks the catalog entry for an assertion or file, which should be identical
+func (c *checker) checkMember(ctx context.Context, key []string, member types.Resource) error {
+	c.seen[string(getKey(key))] = true
+	c.report.Checked++
+
+	r, err := getResource(key, c.txn)
+	if err == badger.ErrKeyNotFound {
+		return c.add(key, c.set(key, member), "missing catalog entry for %s", member.URI())
+	} else if err != nil {
+		return err
+	}
+
+	if r.T() != member.T() {
+		fix := func() error {
+			if pkg, is := r.(*types.Package); is {
+				err := c.server.deleteChildren(ctx, key, pkg, c.txn)
+				if err != nil {
+					return err
+				}
+			}
+			err := c.server.queue.Delete(key, r, c.txn)
+			if err != nil {
+				return err
+			}
+			return c.set(key, member)()
+		}
+		return c.add(key, fix, "catalog entry has the wrong type")
+	} else if !sameResource(r, member) {
+		return c.add(key, c.set(key, member), "catalog entry differs from package member %s", member.URI())
+	}
+
+	for name, err := range rpc.Check(key, member, c.server.api) {
+		err = c.add(key, c.set(key, member), "index %s: %s", name, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkOrphans finds catalog entries that aren't reachable from the root
+func (c *checker) checkOrphans() error {
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.PrefetchValues = false
+	iterOpts.Prefix = []byte("/")
+	iter := c.txn.NewIterator(iterOpts)
+	defer iter.Close()
+
+	orphans := [][]string{}
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		k := string(iter.Item().Key())
+		if !c.seen[k] {
+			orphans = append(orphans, types.ParsePath(k))
+		}
+	}
+
+	for _, key := range orphans {
+		r, err := getResource(key, c.txn)
+		if err != nil {
+			return err
+		}
+
+		fix := func() error { return c.server.deleteEntry(key, r, c.txn) }
+
+		err = c.add(key, fix, "orphaned catalog entry for %s", r.URI())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func submatch(pattern *regexp.Regexp) func(string) string {
+	return func(uri string) string {
+		if match := pattern.FindStringSubmatch(uri); match != nil {
+			return match[1]
+		}
+		return ""
+	}
+}
+
+var packageCID = submatch(types.PackageURIPattern)
+var assertionCID = submatch(types.AssertionURIPattern)
+var fileCID = submatch(types.FileURIPattern)
+
+// Fsck handles requests to /_admin/fsck. GET checks the catalog and POST checks and repairs it.
+func (server *Server) Fsck(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+
+	report, err := server.fsck(ctx, req.Method == "POST")
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(report)
+}
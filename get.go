@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -14,7 +16,6 @@ import (
 	ld "github.com/piprate/json-gold/ld"
 	rdf "github.com/underlay/go-rdfjs"
 	types "github.com/underlay/pkgs/types"
-	ui "github.com/underlay/pkgs/ui"
 )
 
 var offers = []string{"application/n-quads", "application/ld+json", "application/json"}
@@ -25,9 +26,22 @@ func (server *Server) Get(ctx context.Context, res http.ResponseWriter, req *htt
 	txn := server.db.NewTransaction(false)
 	defer txn.Discard()
 	r, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		// Members of mounted packages are read from IPFS
+		r, err = server.getMounted(ctx, key, txn)
+		if err != nil && err != badger.ErrKeyNotFound {
+			res.WriteHeader(502)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	}
 	if err == badger.ErrKeyNotFound {
 		res.WriteHeader(404)
 		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
 	}
 
 	res.Header().Add("ETag", r.ETag())
@@ -36,9 +50,52 @@ func (server *Server) Get(ctx context.Context, res http.ResponseWriter, req *htt
 	res.Header().Add("Link", types.MakeLinkType(r.Type()))
 	switch r := r.(type) {
 	case *types.Package:
-		format := content.NegotiateContentType(req, append(offers, "text/html"), offers[0])
+		res.Header().Add("Link", types.MakeLinkConstrainedBy(links["shex.jsonld"]))
+		if r.Proof != "" {
+			res.Header().Add("Link", types.MakeLinkProof(r.Proof))
+		}
+		if inbox := server.inboxLink(key); inbox != "" {
+			res.Header().Add("Link", inbox)
+		}
+		format := content.NegotiateContentType(req, append(offers, "text/html", carFormat, "application/zip", "application/x-tar"), offers[0])
 		res.Header().Add("Content-Type", format)
+		if format != carFormat && format != "application/zip" && format != "application/x-tar" {
+			view, applied := parseView(req)
+			p, err := parsePaging(req, format)
+			if err != nil {
+				res.WriteHeader(400)
+				res.Write([]byte(err.Error()))
+				return
+			} else if p != nil {
+				server.getPage(ctx, res, req, key, r, p, view, applied, format, txn)
+				return
+			} else if applied != "" {
+				res.Header().Set("ETag", "W/"+r.ETag())
+				res.Header().Add("Preference-Applied", applied)
+				server.writeView(res, key, r, view, format, nil)
+				return
+			}
+		}
+
 		switch format {
+		case "application/zip", "application/x-tar":
+			extension := "tar"
+			if format == "application/zip" {
+				extension = "zip"
+			}
+			res.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, r.Title, extension))
+			res.WriteHeader(200)
+			err = server.writeArchive(ctx, res, format, r)
+			if err != nil {
+				log.Println("Error archiving", r.ID+":", err)
+			}
+		case carFormat:
+			res.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.car"`, r.Title))
+			res.WriteHeader(200)
+			err = server.exportCAR(ctx, res, r)
+			if err != nil {
+				log.Println("Error exporting", r.ID+":", err)
+			}
 		case offers[0]:
 			server.copyFile(ctx, res, r.Path())
 		case offers[1]:
@@ -50,13 +107,6 @@ func (server *Server) Get(ctx context.Context, res http.ResponseWriter, req *htt
 			err = json.NewEncoder(res).Encode(doc)
 		case offers[2]:
 			server.writeRDFJS(ctx, res, r.Path())
-		case "text/html":
-			res.WriteHeader(200)
-			err = ui.PageTemplate.Execute(res, &struct {
-				Pkg *types.Package
-				Key []string
-			}{r, key})
-			return
 		}
 	case *types.Assertion:
 		format := content.NegotiateContentType(req, offers, offers[0])
@@ -121,7 +171,12 @@ func (server *Server) writeRDFJS(ctx context.Context, res http.ResponseWriter, i
 		return
 	}
 	res.WriteHeader(200)
-	scanner := bufio.NewScanner(files.ToFile(node))
+	writeQuads(res, files.ToFile(node))
+}
+
+// writeQuads writes the n-quads in r as a JSON array of RDFJS quads
+func writeQuads(res http.ResponseWriter, r io.Reader) {
+	scanner := bufio.NewScanner(r)
 	res.Write([]byte{'['})
 	for limit := false; scanner.Scan(); {
 		if limit {
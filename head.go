@@ -16,6 +16,9 @@ func (server *Server) Head(ctx context.Context, res http.ResponseWriter, req *ht
 
 	key := types.ParsePath(req.URL.Path)
 	r, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		r, err = server.getMounted(ctx, key, txn)
+	}
 	if err == badger.ErrKeyNotFound {
 		res.WriteHeader(404)
 		return
@@ -30,7 +33,14 @@ func (server *Server) Head(ctx context.Context, res http.ResponseWriter, req *ht
 	res.Header().Add("Link", types.MakeLinkType(r.Type()))
 	switch r := r.(type) {
 	case *types.Package:
-		format := content.NegotiateContentType(req, append(offers, "text/html"), offers[0])
+		res.Header().Add("Link", types.MakeLinkConstrainedBy(links["shex.jsonld"]))
+		if r.Proof != "" {
+			res.Header().Add("Link", types.MakeLinkProof(r.Proof))
+		}
+		if inbox := server.inboxLink(key); inbox != "" {
+			res.Header().Add("Link", inbox)
+		}
+		format := content.NegotiateContentType(req, append(offers, "text/html", carFormat, "application/zip", "application/x-tar"), offers[0])
 		res.Header().Add("Content-Type", format)
 	case *types.Assertion:
 		format := content.NegotiateContentType(req, offers, offers[0])
@@ -3,17 +3,38 @@ package main
 import (
 	"context"
 	"net/http"
+	"strings"
+
+	types "github.com/underlay/pkgs/types"
 )
 
 func makeSelfLink(id string) string { return "<" + id + `>; rel="self"` }
 
+// Paths whose first segment begins with an underscore are reserved for the server
+const systemPrefix = "/_"
+
+// isReadOnly returns true for the methods that a mirror accepts, for both resources and system paths
+func isReadOnly(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "PROPFIND"
+}
+
 // ServeHTTP handles HTTP requests using the database and core API
 func (server *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	ctx := context.Background()
-	if req.Method == "GET" {
+	if server.mirror != nil && !isReadOnly(req.Method) {
+		res.WriteHeader(405)
+		res.Write([]byte(ErrMirror.Error()))
+	} else if isInboxWrite(req) {
+		res.WriteHeader(405)
+		res.Write([]byte(ErrInboxWrite.Error()))
+	} else if strings.HasPrefix(req.URL.Path, systemPrefix) {
+		server.serveSystem(ctx, res, req)
+	} else if req.Method == "GET" {
 		server.Get(ctx, res, req)
 	} else if req.Method == "HEAD" {
 		server.Head(ctx, res, req)
+	} else if req.Method == "OPTIONS" {
+		server.Options(ctx, res, req)
 	} else if req.Method == "POST" {
 		server.Post(ctx, res, req)
 	} else if req.Method == "PUT" {
@@ -23,14 +44,43 @@ func (server *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		// } else if req.Method == "PATCH" {
 		//  server.Patch(ctx, res, req)
 		// } else if req.Method == "COPY" {
-		// } else if req.Method == "LOCK" {
+	} else if req.Method == "LOCK" {
+		server.Lock(ctx, res, req)
 	} else if req.Method == "MKCOL" {
 		server.Mkcol(ctx, res, req)
-		// } else if req.Method == "MOVE" {
-		// } else if req.Method == "UNLOCK" {
+	} else if req.Method == "MOVE" {
+		server.Move(ctx, res, req)
+	} else if req.Method == "UNLOCK" {
+		server.Unlock(ctx, res, req)
+	} else if req.Method == "PROPFIND" {
+		server.Propfind(ctx, res, req)
+	} else if req.Method == "PROPPATCH" {
+		server.Proppatch(ctx, res, req)
 	} else {
 		res.WriteHeader(405)
 	}
 
 	return
 }
+
+func (server *Server) serveSystem(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	key := types.ParsePath(req.URL.Path)
+	switch key[0] {
+	case "_proof":
+		server.Proof(ctx, res, req, key[1:])
+	case "_events":
+		server.Events(ctx, res, req, key[1:])
+	case "_webhooks":
+		server.Webhooks(ctx, res, req, key[1:])
+	case "_mounts":
+		server.Mounts(ctx, res, req, key[1:])
+	case "_batch":
+		server.Batch(ctx, res, req)
+	case "_uploads":
+		server.Uploads(ctx, res, req, key[1:])
+	case "_admin":
+		server.serveAdmin(ctx, res, req, key[1:])
+	default:
+		res.WriteHeader(404)
+	}
+}
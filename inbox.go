@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	files "github.com/ipfs/go-ipfs-files"
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Every package advertises a Linked Data Notifications inbox at {package}/.inbox.
+// The inbox is an ordinary child package, created with the first notification,
+// and each notification is stored in it as an assertion, so it lists (and versions)
+// like any other container. Notifications are the only way to write to it: every
+// other write to an inbox or beneath it is refused, and archives leave it out.
+
+const inboxName = ".inbox"
+
+// ErrEmptyNotification is returned for notifications that don't contain any triples
+var ErrEmptyNotification = errors.New("Invalid notification: the document has no triples")
+
+// errNoTarget is returned when the package that a notification is addressed to doesn't exist
+var errNoTarget = errors.New("Notification target is not a package")
+
+// ErrInboxWrite is returned for writes to an inbox or the notifications in it,
+// which only change by POSTing notifications to the inbox
+var ErrInboxWrite = errors.New("Inboxes only accept notifications")
+
+func isInbox(key []string) bool { return len(key) > 0 && key[len(key)-1] == inboxName }
+
+// inInbox reports whether key is an inbox or is beneath one
+func inInbox(key []string) bool {
+	for _, name := range key {
+		if name == inboxName {
+			return true
+		}
+	}
+	return false
+}
+
+// isInboxWrite reports whether req writes to an inbox (or beneath one) other than
+// by POSTing a notification to it. LOCK and UNLOCK don't change anything.
+func isInboxWrite(req *http.Request) bool {
+	if isReadOnly(req.Method) || req.Method == "LOCK" || req.Method == "UNLOCK" {
+		return false
+	}
+
+	key := types.ParsePath(req.URL.Path)
+	if !inInbox(key) {
+		return false
+	}
+
+	return req.Method != "POST" || !isInbox(key) || strings.HasPrefix(req.URL.Path, systemPrefix)
+}
+
+// inboxLink returns the inbox link header for the package at key,
+// or an empty string if the package is itself an inbox
+func (server *Server) inboxLink(key []string) string {
+	if isInbox(key) {
+		return ""
+	}
+	return types.MakeLinkInbox(types.GetURI(server.resource, append(key[:len(key):len(key)], inboxName)))
+}
+
+// Notify handles POST requests to {package}/.inbox. The body must be a JSON-LD
+// (or N-Quads) document with at least one triple.
+func (server *Server) Notify(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	format := req.Header.Get("Content-Type")
+	if format != offers[0] && format != offers[1] {
+		res.WriteHeader(415)
+		return
+	}
+
+	inboxKey := append(key[:len(key):len(key)], inboxName)
+	inboxResource := types.GetURI(server.resource, inboxKey)
+	dataset, err := parseDataset(format, inboxResource, req.Body)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	empty := true
+	for _, graph := range dataset.Graphs {
+		if len(graph) > 0 {
+			empty = false
+		}
+	}
+
+	if empty {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrEmptyNotification.Error()))
+		return
+	}
+
+	opts := ld.NewJsonLdOptions(inboxResource)
+	opts.Format = "application/n-quads"
+	na := ld.NewNormalisationAlgorithm("URDNA2015")
+	normalized, err := na.Main(dataset, opts)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	data := []byte(normalized.(string))
+	timestamp := time.Now().Format(time.RFC3339)
+	a := &types.Assertion{Created: timestamp, Modified: timestamp}
+	err = server.setAssertion(ctx, a, files.NewBytesFile(data))
+	if err != nil {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	a.Dataset, err = rdf.ReadQuads(bytes.NewReader(data))
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	childKey := append(inboxKey, a.Name())
+	err = server.write(childKey, func(txn *badger.Txn) error {
+		_, err := getPackage(key, txn)
+		if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+			return errNoTarget
+		} else if err != nil {
+			return err
+		}
+
+		_, err = getPackage(inboxKey, txn)
+		if err == badger.ErrKeyNotFound {
+			inbox := types.NewPackage(inboxResource, inboxName)
+			_, err = server.normalize(ctx, inbox)
+			if err == nil {
+				err = server.set(ctx, inboxKey, inbox, txn)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = server.set(ctx, childKey, a, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, childKey, a, txn)
+	})
+
+	if err == errNoTarget {
+		res.WriteHeader(404)
+		return
+	} else if err == ErrNotPackage {
+		res.WriteHeader(409)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("Location", types.GetURI(server.resource, childKey))
+	res.Header().Add("ETag", a.ETag())
+	res.Header().Add("Link", makeSelfLink(a.URI()))
+	res.WriteHeader(201)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestNotify checks that a notification is stored in the inbox as an unnamed
+// assertion, like a POSTed assertion is
+func TestNotify(t *testing.T) {
+	server, _ := newTestServer(t)
+	body := `<http://example.com/a> <http://example.com/b> "c" .` + "\n"
+	res := do(server, "POST", "/"+inboxName, body, map[string]string{"Content-Type": "application/n-quads"})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", res.Code, res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	inbox, err := getPackage([]string{inboxName}, txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(inbox.Members.Assertions) != 1 {
+		t.Fatalf("the inbox has %d assertions, expected 1", len(inbox.Members.Assertions))
+	}
+
+	a := inbox.Members.Assertions[0]
+	if a.Resource != "" {
+		t.Errorf("the notification has resource %q, expected none", a.Resource)
+	}
+
+	key := []string{inboxName, a.Name()}
+	if location := res.Header().Get("Location"); location != types.GetURI(server.resource, key) {
+		t.Errorf("Location is %q, expected %q", location, types.GetURI(server.resource, key))
+	}
+
+	r, err := getResource(key, txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if r.URI() != a.ID {
+		t.Errorf("the notification is stored as %s, expected %s", r.URI(), a.ID)
+	}
+}
+
+// TestInboxWrites checks that notifications are the only way to write to an inbox,
+// and that archives leave it out
+func TestInboxWrites(t *testing.T) {
+	server, _ := newTestServer(t)
+	body := `<http://example.com/a> <http://example.com/b> "c" .` + "\n"
+	res := do(server, "POST", "/"+inboxName, body, map[string]string{"Content-Type": "application/n-quads"})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", res.Code, res.Body.String())
+	}
+
+	res = putFile(server, "/"+inboxName+"/a.txt", "a\n", nil)
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT in the inbox: expected 405, got %d", res.Code)
+	}
+
+	for _, method := range []string{"DELETE", "MKCOL", "PROPPATCH"} {
+		res = do(server, method, "/"+inboxName, "", nil)
+		if res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s of the inbox: expected 405, got %d", method, res.Code)
+		}
+	}
+
+	res = do(server, "POST", "/_webhooks/"+inboxName, `{"url": "http://example.com/hook"}`, nil)
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("subscribing to the inbox: expected 405, got %d", res.Code)
+	}
+
+	res = putFile(server, "/a.txt", "a\n", nil)
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "MOVE", "/a.txt", "", map[string]string{"Destination": "/" + inboxName + "/a.txt"})
+	if res.Code != http.StatusForbidden {
+		t.Errorf("MOVE into the inbox: expected 403, got %d", res.Code)
+	}
+
+	batch := `[{"op": "put", "path": "/` + inboxName + `/b.txt", "type": "file", "format": "text/plain", "content": "b\n"}]`
+	res = do(server, "POST", "/_batch", batch, map[string]string{"Content-Type": "application/json"})
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("batch put in the inbox: expected 400, got %d", res.Code)
+	}
+
+	res = do(server, "PUT", "/p", tarBody(t, map[string]string{inboxName + "/a.txt": "a\n"}), map[string]string{"Content-Type": "application/x-tar"})
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an archive with an inbox: expected 400, got %d", res.Code)
+	}
+
+	res = do(server, "GET", "/", "", map[string]string{"Accept": "application/x-tar"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET archive: %d %s", res.Code, res.Body.String())
+	}
+
+	r := tar.NewReader(res.Body)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if strings.HasPrefix(header.Name, inboxName) {
+			t.Errorf("the archive has the inbox entry %s", header.Name)
+		}
+	}
+}
@@ -18,7 +18,12 @@ type Rule interface {
 	Body() []*rdf.Quad
 }
 
-// An Index is the interface for database indices
+// An Index is the interface for database indices.
+// Set and Delete are only ever called for changes that have already been committed
+// to the catalog, and changes to any one resource arrive in the order they were made.
+// They may be called more than once for the same change (if the server stops before
+// recording that it was applied), so they must be idempotent: setting a resource
+// replaces whatever was there, and deleting a resource that isn't there is not an error.
 type Index interface {
 	Name() string
 	Init(resource string, api iface.CoreAPI, db *badger.DB, path string)
@@ -27,6 +32,28 @@ type Index interface {
 	Delete(key []string, resource types.Resource, dataset []*rdf.Quad, store *styx.Store) error
 }
 
+// A Checker is an Index that can report whether it agrees with the catalog about
+// a resource. Check should return a non-nil error describing the discrepancy if
+// it doesn't.
+type Checker interface {
+	Check(key []string, resource types.Resource, dataset []*rdf.Quad) error
+}
+
+// A Clearer is an Index that can remove everything in it, so that a reindex
+// rebuilds it from scratch instead of leaving stale entries behind.
+type Clearer interface {
+	Clear() error
+}
+
+// A Rebuilder is a Clearer that rebuilds into a new copy of the index while the
+// old one keeps answering queries. Clear starts the new copy, and Rebuilt replaces
+// the old copy with it once the reindex has replayed the catalog (ok is true), or
+// discards it if the reindex failed.
+type Rebuilder interface {
+	Clearer
+	Rebuilt(ok bool) error
+}
+
 type Generator interface {
 	Rule
 	Base() []rdf.Term
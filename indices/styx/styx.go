@@ -1,6 +1,8 @@
 package styx
 
 import (
+	"fmt"
+
 	badger "github.com/dgraph-io/badger/v2"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 
@@ -52,7 +54,46 @@ func (si *styxIndex) Delete(key []string, resource types.Resource, dataset []*rd
 		uri := types.GetURI(si.resource, key)
 		node := rdf.NewNamedNode(uri)
 		err := si.store.Delete(node)
-		if err != nil {
+		if err == styx.ErrNotFound {
+			// Already deleted - operations can be applied more than once
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (si *styxIndex) Check(key []string, resource types.Resource, dataset []*rdf.Quad) error {
+	if resource.T() != types.AssertionType || dataset == nil {
+		return nil
+	}
+
+	uri := types.GetURI(si.resource, key)
+	quads, err := si.store.Get(rdf.NewNamedNode(uri))
+	if err == styx.ErrNotFound {
+		return fmt.Errorf("missing graph %s", uri)
+	} else if err != nil {
+		return err
+	} else if len(quads) != len(dataset) {
+		return fmt.Errorf("graph %s has %d quads, expected %d", uri, len(quads), len(dataset))
+	}
+
+	return nil
+}
+
+// Clear deletes every graph in the store
+func (si *styxIndex) Clear() error {
+	list := si.store.List(nil)
+	nodes := []rdf.Term{}
+	for node := list.Next(); node != nil; node = list.Next() {
+		nodes = append(nodes, node)
+	}
+	list.Close()
+
+	for _, node := range nodes {
+		err := si.store.Delete(node)
+		if err != nil && err != styx.ErrNotFound {
 			return err
 		}
 	}
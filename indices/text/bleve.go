@@ -1,8 +1,11 @@
 package text
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"strings"
+	"sync"
 
 	bleve "github.com/blevesearch/bleve"
 	badger "github.com/dgraph-io/badger/v2"
@@ -19,6 +22,10 @@ var MatchPredicate = "pkgs:/text/match"
 
 type textIndex struct {
 	bleve.Index
+	path string
+	// next is the new index that a reindex is rebuilding, at path + ".next"
+	next  bleve.Index
+	mutex sync.RWMutex
 }
 
 // NewTextIndex creates a new text index
@@ -28,6 +35,14 @@ func (ti *textIndex) Name() string { return "text" }
 
 func (ti *textIndex) Init(resource string, api iface.CoreAPI, db *badger.DB, path string) {
 	log.Println("Initializing text index", path)
+	ti.path = path
+
+	// Discard whatever an interrupted reindex left behind
+	err := os.RemoveAll(ti.nextPath())
+	if err != nil {
+		log.Println(err)
+	}
+
 	index, err := bleve.Open(path)
 	if err == bleve.ErrorIndexMetaMissing {
 		log.Println("Creating new text index at", path)
@@ -45,7 +60,16 @@ func (ti *textIndex) Init(resource string, api iface.CoreAPI, db *badger.DB, pat
 	ti.Index = index
 }
 
+func (ti *textIndex) nextPath() string { return ti.path + ".next" }
+
 func (ti *textIndex) Close() {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	if ti.next != nil {
+		ti.next.Close()
+		ti.next = nil
+	}
+
 	if ti.Index == nil {
 		return
 	}
@@ -53,7 +77,93 @@ func (ti *textIndex) Close() {
 	ti.Index.Close()
 }
 
+// Clear starts rebuilding the bleve index into a new empty one, which gets every
+// write from then on while the old one keeps answering queries
+func (ti *textIndex) Clear() error {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	if ti.Index == nil {
+		return nil
+	}
+
+	if ti.next != nil {
+		err := ti.next.Close()
+		if err != nil {
+			return err
+		}
+		ti.next = nil
+	}
+
+	err := os.RemoveAll(ti.nextPath())
+	if err != nil {
+		return err
+	}
+
+	next, err := bleve.New(ti.nextPath(), getMapping())
+	if err != nil {
+		return err
+	}
+
+	ti.next = next
+	return nil
+}
+
+// Rebuilt replaces the bleve index with the new one when the reindex succeeded,
+// and discards the new one when it didn't
+func (ti *textIndex) Rebuilt(ok bool) error {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	if ti.next == nil {
+		return nil
+	}
+
+	err := ti.next.Close()
+	ti.next = nil
+	if err != nil || !ok {
+		os.RemoveAll(ti.nextPath())
+		return err
+	}
+
+	err = ti.Index.Close()
+	if err != nil {
+		return err
+	}
+
+	old := ti.path + ".old"
+	err = os.RemoveAll(old)
+	if err == nil {
+		err = os.Rename(ti.path, old)
+	}
+	if err == nil {
+		err = os.Rename(ti.nextPath(), ti.path)
+		if err != nil {
+			os.Rename(old, ti.path)
+		}
+	}
+
+	index, openErr := bleve.Open(ti.path)
+	if openErr != nil && err == nil {
+		// Put the old index back
+		err = openErr
+		os.RemoveAll(ti.path)
+		os.Rename(old, ti.path)
+		index, openErr = bleve.Open(ti.path)
+	}
+	if openErr != nil {
+		log.Println(openErr)
+		index = nil
+	}
+
+	ti.Index = index
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
 func (ti *textIndex) Set(key []string, resource types.Resource, dataset []*rdf.Quad, store *styx.Store) error {
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
 	if ti.Index == nil {
 		return nil
 	}
@@ -64,10 +174,16 @@ func (ti *textIndex) Set(key []string, resource types.Resource, dataset []*rdf.Q
 		return err
 	}
 
+	if ti.next != nil {
+		return ti.next.Index(id, resource)
+	}
+
 	return nil
 }
 
 func (ti *textIndex) Delete(key []string, resource types.Resource, dataset []*rdf.Quad, store *styx.Store) error {
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
 	if ti.Index == nil {
 		return nil
 	}
@@ -78,9 +194,40 @@ func (ti *textIndex) Delete(key []string, resource types.Resource, dataset []*rd
 		return err
 	}
 
+	if ti.next != nil {
+		return ti.next.Delete(id)
+	}
+
+	return nil
+}
+
+func (ti *textIndex) Check(key []string, resource types.Resource, dataset []*rdf.Quad) error {
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
+	if ti.Index == nil {
+		return nil
+	}
+
+	id := "/" + strings.Join(key, "/")
+	doc, err := ti.Index.Document(id)
+	if err != nil {
+		return err
+	} else if doc == nil {
+		return fmt.Errorf("missing document %s", id)
+	}
+
 	return nil
 }
 
+func (ti *textIndex) search(search *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	ti.mutex.RLock()
+	defer ti.mutex.RUnlock()
+	if ti.Index == nil {
+		return &bleve.SearchResult{}, nil
+	}
+	return ti.Index.Search(search)
+}
+
 var subject = rdf.NewVariable("subject")
 var predicate = rdf.NewNamedNode(MatchPredicate)
 var object = rdf.NewVariable("object")
@@ -183,7 +330,7 @@ func (iter *textIterator) Seek(index []rdf.Term) error {
 		query.Fuzziness = 2
 		search := bleve.NewSearchRequest(query)
 		search.Fields = []string{"id"}
-		result, err := iter.textIndex.Search(search)
+		result, err := iter.textIndex.search(search)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Packages can have a maximum size for the files uploaded into them and their
+// descendants, recorded under _limits/{path}. The limit of the nearest package
+// that has one applies, and packages without one fall back to PKGS_MAX_UPLOAD_SIZE
+// (server.maxUploadSize), where zero means no limit. Limits belong to paths, not
+// packages, so they stay where they are when a package is moved or deleted.
+
+const limitPrefix = "_limits"
+
+// A sizeLimit is the maximum size in bytes of files uploaded beneath Path
+type sizeLimit struct {
+	Path    string `json:"path"`
+	MaxSize int64  `json:"maxSize"`
+}
+
+func limitKey(key []string) []byte { return append([]byte(limitPrefix), getKey(key)...) }
+
+// maxSize returns the maximum size of files uploaded into the package at key, or zero for no limit
+func (server *Server) maxSize(key []string) (limit int64, err error) {
+	limit = server.maxUploadSize
+	err = server.db.View(func(txn *badger.Txn) error {
+		for i := len(key); i >= 0; i-- {
+			item, err := txn.Get(limitKey(key[:i]))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			l := &sizeLimit{}
+			err = item.Value(func(val []byte) error { return json.Unmarshal(val, l) })
+			limit = l.MaxSize
+			return err
+		}
+		return nil
+	})
+	return
+}
+
+// checkSizes returns ErrTooLarge if a file in pkg, which is being uploaded to key,
+// or in one of its subpackages, is larger than the limit of the package it's in.
+// It's for uploads that bring whole packages with them, like CAR archives.
+func (server *Server) checkSizes(ctx context.Context, key []string, pkg *types.Package) error {
+	limit, err := server.maxSize(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range pkg.Members.Files {
+		if limit == 0 {
+			break
+		}
+
+		node, err := server.api.Unixfs().Get(ctx, f.Path())
+		if err != nil {
+			return err
+		}
+
+		size, err := node.Size()
+		node.Close()
+		if err != nil {
+			return err
+		} else if size > limit {
+			return fmt.Errorf("%s: %w", f.Name(), ErrTooLarge)
+		}
+	}
+
+	for _, reference := range pkg.Members.Packages {
+		child, err := server.parse(ctx, reference)
+		if err != nil {
+			return err
+		}
+
+		err = server.checkSizes(ctx, append(key[:len(key):len(key)], reference.Name()), child)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Limits handles requests to /_admin/limits/{path}. GET returns the limit at path
+// (or every limit, for /_admin/limits), PUT sets it to the "maxSize" of a JSON body,
+// and DELETE removes it.
+func (server *Server) Limits(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if req.Method != "GET" && req.Method != "PUT" && req.Method != "DELETE" {
+		res.WriteHeader(405)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		server.getLimits(res, key)
+	case "PUT":
+		body := &struct {
+			MaxSize *int64 `json:"maxSize"`
+		}{}
+
+		err := json.NewDecoder(req.Body).Decode(body)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		} else if body.MaxSize == nil || *body.MaxSize < 0 {
+			res.WriteHeader(400)
+			res.Write([]byte("Invalid limit: expected a non-negative maxSize"))
+			return
+		}
+
+		val, _ := json.Marshal(&sizeLimit{Path: string(getKey(key)), MaxSize: *body.MaxSize})
+		err = server.db.Update(func(txn *badger.Txn) error {
+			_, err := getPackage(key, txn)
+			if err != nil {
+				return err
+			}
+			return txn.Set(limitKey(key), val)
+		})
+
+		if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err == ErrNotPackage {
+			res.WriteHeader(409)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		res.WriteHeader(204)
+	case "DELETE":
+		err := server.db.Update(func(txn *badger.Txn) error {
+			_, err := txn.Get(limitKey(key))
+			if err != nil {
+				return err
+			}
+			return txn.Delete(limitKey(key))
+		})
+
+		if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		res.WriteHeader(204)
+	}
+}
+
+func (server *Server) getLimits(res http.ResponseWriter, key []string) {
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	var result interface{}
+	if len(key) > 0 {
+		item, err := txn.Get(limitKey(key))
+		if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		l := &sizeLimit{}
+		err = item.Value(func(val []byte) error { return json.Unmarshal(val, l) })
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		result = l
+	} else {
+		limits := []*sizeLimit{}
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.Prefix = []byte(limitPrefix + "/")
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			l := &sizeLimit{}
+			err := iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, l) })
+			if err != nil {
+				res.WriteHeader(500)
+				res.Write([]byte(err.Error()))
+				return
+			}
+			limits = append(limits, l)
+		}
+		result = limits
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(result)
+}
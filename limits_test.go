@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestUploadLimits checks that the files in batches, archives, and CAR imports are
+// each held to the size limit of the package that they go into
+func TestUploadLimits(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, p := range []string{"/src", "/limited"} {
+		res := do(server, "MKCOL", p, "", nil)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("MKCOL %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	res := do(server, "PUT", "/_admin/limits/limited", `{"maxSize": 4}`, nil)
+	if res.Code != http.StatusNoContent && res.Code != http.StatusCreated {
+		t.Fatalf("PUT /_admin/limits/limited: %d %s", res.Code, res.Body.String())
+	}
+
+	tarHeader := map[string]string{"Content-Type": "application/x-tar"}
+	res = do(server, "POST", "/limited", tarBody(t, map[string]string{"small.txt": "abc", "big.txt": "123456789"}), tarHeader)
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POSTing an archive with a large file: %d %s", res.Code, res.Body.String())
+	}
+
+	// The limit applies to entries in a directory beneath the package
+	res = do(server, "POST", "/", tarBody(t, map[string]string{"limited/big.txt": "123456789"}), tarHeader)
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POSTing an archive with a large file in a limited directory: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "POST", "/", tarBody(t, map[string]string{"limited/small.txt": "abc", "src/big.txt": "123456789"}), tarHeader)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("POSTing an archive within the limits: %d %s", res.Code, res.Body.String())
+	}
+
+	operations, _ := json.Marshal([]*batchOperation{
+		{Op: "put", Path: "/limited/a.txt", Type: "file", Format: "text/plain", Content: "abc"},
+		{Op: "put", Path: "/limited/b.txt", Type: "file", Format: "text/plain", Content: "123456789"},
+	})
+	res = do(server, "POST", "/_batch", string(operations), map[string]string{"Content-Type": "application/json"})
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a batch with a large file: %d %s", res.Code, res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	for _, p := range []string{"/limited/big.txt", "/limited/a.txt", "/limited/b.txt"} {
+		if _, err := getResource(types.ParsePath(p), txn); err == nil {
+			t.Errorf("%s was written", p)
+		}
+	}
+
+	src, err := getPackage([]string{"src"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var car bytes.Buffer
+	err = server.exportCAR(context.Background(), &car, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importCAR := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", target, bytes.NewReader(car.Bytes()))
+		req.Header.Set("Content-Type", carFormat)
+		req.Header.Add("Link", types.LinkTypeDirectContainer)
+		req.Header.Add("Link", makeSelfLink(src.ID))
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res
+	}
+
+	res = importCAR("/limited/copy")
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("importing a CAR with a large file: %d %s", res.Code, res.Body.String())
+	}
+
+	res = importCAR("/copy")
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Errorf("importing a CAR within the limits: %d %s", res.Code, res.Body.String())
+	}
+}
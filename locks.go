@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Writes don't serialize on one mutex. Instead, commit locks the path of every
+// package that it writes a new revision of, from the written resource up to the
+// root, and reads each ancestor fresh once it holds its lock. Writes in unrelated
+// subtrees only wait for each other at their first common ancestor (usually just
+// the root), and the expensive work below it happens in parallel. Paths are always
+// locked deepest first, so two commits can't deadlock.
+//
+// The locks only cover the ancestors, which commit writes without reading them
+// through the write transaction. Everything else that a write reads through its
+// transaction is checked by badger, which fails the commit with ErrConflict if
+// any of it changed in the meantime; write retries those with a new transaction.
+//
+// write also holds the path of the resource being written for the whole
+// transaction, in a separate set of locks from commit's, so that writes to the
+// same resource wait for each other instead of conflicting over and over.
+//
+// Writes that touch more than one path (batches, mirror syncs, materializing
+// mounts, and fsck repairs) hold the server mutex exclusively instead, and
+// commit holds it shared.
+
+// maxRetries bounds how many times write retries a transaction that conflicted with
+// a concurrent write. After that it tries once more with every other write held back,
+// so that a write that keeps losing to the writes beneath it (like a PROPPATCH of a
+// busy package) can't starve.
+const maxRetries = 3
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// pathLocks hands out a mutex for each path that's being written, and forgets it once nobody holds it
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: map[string]*pathLock{}}
+}
+
+// lock locks the path key and returns a function that unlocks it
+func (l *pathLocks) lock(key []string) func() {
+	k := string(getKey(key))
+	l.mutex.Lock()
+	lock, has := l.locks[k]
+	if !has {
+		lock = &pathLock{}
+		l.locks[k] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, k)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// write runs f in a new write transaction, and runs it again in another one if
+// committing it conflicts with a concurrent write. f is expected to write the
+// resource at key and call commit, so it has to be safe to run more than once.
+func (server *Server) write(key []string, f func(txn *badger.Txn) error) (err error) {
+	unlock := server.writes.lock(key)
+	defer unlock()
+	for i := 0; i <= maxRetries; i++ {
+		if i < maxRetries {
+			server.writing.RLock()
+		} else {
+			server.writing.Lock()
+		}
+
+		txn := server.db.NewTransaction(true)
+		err = f(txn)
+		server.discard(txn)
+
+		if i < maxRetries {
+			server.writing.RUnlock()
+		} else {
+			server.writing.Unlock()
+		}
+
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+const proppatchBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:dcterms="http://purl.org/dc/terms/">
+  <D:set><D:prop><dcterms:description>description %d</dcterms:description></D:prop></D:set>
+</D:propertyupdate>`
+
+// TestConcurrentWrites puts files into two sibling packages in parallel, along with
+// a file that every writer overwrites, while it changes the packages' descriptions
+// (which conflicts with the writes into them). It checks that every write is in
+// the final tree and the event log, and that the events are in commit order.
+func TestConcurrentWrites(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, p := range []string{"/a", "/b"} {
+		res := do(server, "MKCOL", p, "", nil)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("MKCOL %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	const writers = 16
+	const writes = 8
+
+	var wait sync.WaitGroup
+	errors := make(chan error, 2*writers*writes+2*8)
+	sharedWrites := make(chan string, 2*writers*writes)
+	for _, dir := range []string{"/a", "/b"} {
+		for i := 0; i < writers; i++ {
+			wait.Add(1)
+			go func(dir string, i int) {
+				defer wait.Done()
+				for j := 0; j < writes; j++ {
+					target := fmt.Sprintf("%s/file-%d-%d.txt", dir, i, j)
+					res := putFile(server, target, target+"\n", nil)
+					if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+						errors <- fmt.Errorf("PUT %s: %d %s", target, res.Code, res.Body.String())
+					}
+
+					content := fmt.Sprintf("%s %d %d\n", dir, i, j)
+					res = putFile(server, dir+"/shared.txt", content, nil)
+					if res.Code == http.StatusCreated || res.Code == http.StatusNoContent {
+						sharedWrites <- dir
+					} else {
+						errors <- fmt.Errorf("PUT %s/shared.txt: %d %s", dir, res.Code, res.Body.String())
+					}
+				}
+			}(dir, i)
+		}
+	}
+
+	const descriptions = 8
+	for _, dir := range []string{"/a", "/b"} {
+		wait.Add(1)
+		go func(dir string) {
+			defer wait.Done()
+			for i := 0; i < descriptions; i++ {
+				res := do(server, "PROPPATCH", dir, fmt.Sprintf(proppatchBody, i), map[string]string{"Content-Type": "application/xml"})
+				if res.Code != http.StatusMultiStatus || !strings.Contains(res.Body.String(), "200 OK") {
+					errors <- fmt.Errorf("PROPPATCH %s: %d %s", dir, res.Code, res.Body.String())
+				}
+			}
+		}(dir)
+	}
+
+	wait.Wait()
+	close(errors)
+	close(sharedWrites)
+	for err := range errors {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	for _, dir := range []string{"/a", "/b"} {
+		for i := 0; i < writers; i++ {
+			for j := 0; j < writes; j++ {
+				target := fmt.Sprintf("%s/file-%d-%d.txt", dir, i, j)
+				res := do(server, "GET", target, "", nil)
+				if res.Code != http.StatusOK || res.Body.String() != target+"\n" {
+					t.Errorf("GET %s: %d %q", target, res.Code, res.Body.String())
+				}
+			}
+		}
+	}
+
+	// Every revision of the root has the previous one as its parent, so walking
+	// back from the final root gives the order that the commits happened in
+	ctx := context.Background()
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	root, err := getPackage(nil, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions := map[string]int{}
+	for pkg, i := root, 0; ; i-- {
+		revisions[pkg.ID] = i
+		if pkg.Parent == "" {
+			break
+		}
+		pkg, err = server.parse(ctx, &types.Reference{ID: pkg.Parent})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last uint64
+	lastRevision := -len(revisions)
+	shared := map[string]int{}
+	finalShared := map[string]string{}
+	err = server.replayEvents(0, func(event *Event) error {
+		if event.Seq <= last {
+			t.Errorf("event %d came after event %d", event.Seq, last)
+		}
+		last = event.Seq
+
+		revision, has := revisions[event.Root]
+		if !has {
+			t.Errorf("event %d has root %s, which isn't a revision of the root package", event.Seq, event.Root)
+		} else if revision < lastRevision {
+			t.Errorf("event %d is for an earlier commit than the event before it", event.Seq)
+		}
+		lastRevision = revision
+
+		for _, dir := range []string{"/a", "/b"} {
+			if event.Path == dir+"/shared.txt" {
+				shared[dir]++
+				finalShared[dir] = event.New
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dir := range sharedWrites {
+		shared[dir]--
+	}
+
+	for _, dir := range []string{"/a", "/b"} {
+		pkg, err := getPackage(types.ParsePath(dir), txn)
+		if err != nil {
+			t.Fatal(err)
+		} else if expected := fmt.Sprintf("description %d", descriptions-1); pkg.Description != expected {
+			t.Errorf("%s has description %q, expected %q", dir, pkg.Description, expected)
+		}
+
+		if shared[dir] != 0 {
+			t.Errorf("%s/shared.txt has %d more events than successful writes", dir, shared[dir])
+		}
+
+		r, err := getResource(types.ParsePath(dir+"/shared.txt"), txn)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.URI() != finalShared[dir] {
+			t.Errorf("%s/shared.txt is %s, but the last event set it to %s", dir, r.URI(), finalShared[dir])
+		}
+	}
+}
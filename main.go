@@ -2,17 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 	ipfs "github.com/ipfs/go-ipfs-http-client"
 	cors "github.com/rs/cors"
 
 	rpc "github.com/underlay/pkgs/rpc"
+	types "github.com/underlay/pkgs/types"
 )
 
 const defaultHost = "http://localhost:5001"
@@ -20,13 +28,89 @@ const defaultHost = "http://localhost:5001"
 var ipfsHost = os.Getenv("IPFS_HOST")
 var pkgsPath = os.Getenv("PKGS_PATH")
 var pkgsRoot = os.Getenv("PKGS_ROOT")
+var pkgsKey = os.Getenv("PKGS_KEY")
+
+// PKGS_IPNS is "value" (the default), "package", or "off", and only applies
+// when PKGS_ROOT isn't set, since then the root is the node's own IPNS name.
+var pkgsIPNS = os.Getenv("PKGS_IPNS")
+var pkgsIPNSLifetime = os.Getenv("PKGS_IPNS_LIFETIME")
+var pkgsIPNSTTL = os.Getenv("PKGS_IPNS_TTL")
+
+// PKGS_MIRROR is an IPNS name (dweb:/ipns/...) or the base URL of another pkgs
+// server; if it's set, the server is a read-only mirror of its root package.
+var pkgsMirror = os.Getenv("PKGS_MIRROR")
+var pkgsMirrorInterval = os.Getenv("PKGS_MIRROR_INTERVAL")
+
+// PKGS_MAX_UPLOAD_SIZE is the maximum size in bytes of uploaded files,
+// for packages that don't have their own limit
+var pkgsMaxUploadSize = os.Getenv("PKGS_MAX_UPLOAD_SIZE")
+
+// PKGS_WEBHOOK_ALLOW is a comma-separated list of CIDR networks that webhooks
+// can be delivered to even though they're loopback, link-local, or private addresses
+var pkgsWebhookAllow = os.Getenv("PKGS_WEBHOOK_ALLOW")
+
+// PKGS_EVENT_RETENTION is the number of events kept for clients resuming with
+// Last-Event-ID, and PKGS_EVENT_MAX_AGE is how long they're kept
+var pkgsEventRetention = os.Getenv("PKGS_EVENT_RETENTION")
+var pkgsEventMaxAge = os.Getenv("PKGS_EVENT_MAX_AGE")
+
+func parseDuration(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return d
+}
+
+// reindexFlag is a boolean-style flag that optionally takes an index name:
+// -reindex rebuilds every index and -reindex=name rebuilds just one.
+type reindexFlag struct {
+	set  bool
+	name string
+}
+
+func (f *reindexFlag) IsBoolFlag() bool { return true }
+func (f *reindexFlag) String() string   { return f.name }
+func (f *reindexFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.set, f.name = true, ""
+	case "false":
+		f.set, f.name = false, ""
+	default:
+		f.set, f.name = true, value
+	}
+	return nil
+}
+
+var reindex = &reindexFlag{}
+
+func init() {
+	flag.Var(reindex, "reindex", "rebuild every index (or just -reindex=name) from the catalog after starting")
+}
+
+// pkgs fsck [-repair] checks the catalog against IPFS and exits instead of starting the server
+var fsckCommand = flag.NewFlagSet("fsck", flag.ExitOnError)
+var fsckRepair = fsckCommand.Bool("repair", false, "repair the discrepancies that fsck finds")
 
 func main() {
+	flag.Parse()
+	if flag.Arg(0) == "fsck" {
+		fsckCommand.Parse(flag.Args()[1:])
+	} else if flag.NArg() > 0 {
+		log.Fatalln("Unknown command", flag.Arg(0))
+	}
+
 	if ipfsHost == "" {
 		ipfsHost = defaultHost
 	}
 
-	go rpc.ServeRPC()
+	if !fsckCommand.Parsed() {
+		go rpc.ServeRPC()
+	}
 
 	api, err := ipfs.NewURLApiWithClient(ipfsHost, http.DefaultClient)
 	if err != nil {
@@ -34,12 +118,28 @@ func main() {
 	}
 
 	ctx := context.Background()
-	if pkgsRoot == "" {
+	if pkgsMirror != "" {
+		if pkgsRoot == "" && isIPNS(pkgsMirror) {
+			pkgsRoot = "dweb:/ipns/" + strings.TrimPrefix(strings.TrimPrefix(pkgsMirror, "dweb:/ipns/"), "/ipns/")
+		} else if pkgsRoot == "" {
+			log.Fatalln("PKGS_ROOT must be set to the remote root URI to mirror", pkgsMirror)
+		}
+		pkgsIPNS = "off"
+	} else if pkgsRoot == "" {
 		key, err := api.Key().Self(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
 		pkgsRoot = fmt.Sprintf("dweb:/ipns/%s", key.ID().String())
+		if pkgsIPNS == "" {
+			pkgsIPNS = publishValue
+		}
+	} else {
+		pkgsIPNS = "off"
+	}
+
+	if pkgsIPNS != publishValue && pkgsIPNS != publishPackage && pkgsIPNS != "off" {
+		log.Fatalln("Invalid PKGS_IPNS value", pkgsIPNS)
 	}
 
 	if pkgsPath == "" {
@@ -70,11 +170,74 @@ func main() {
 		index.Init(pkgsRoot, api, db, path)
 	}
 
-	server, err := NewServer(ctx, pkgsRoot, db, api)
+	var key ed25519.PrivateKey
+	if pkgsKey != "" {
+		key, err = types.ReadKey(pkgsKey, true)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Signing packages as", types.DidKey(key.Public().(ed25519.PublicKey)))
+	}
+
+	if pkgsWebhookAllow != "" {
+		for _, cidr := range strings.Split(pkgsWebhookAllow, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Fatalln("Invalid PKGS_WEBHOOK_ALLOW value", pkgsWebhookAllow)
+			}
+			webhookAllow = append(webhookAllow, network)
+		}
+	}
+
+	if pkgsEventRetention != "" {
+		eventRetention, err = strconv.ParseUint(pkgsEventRetention, 10, 64)
+		if err != nil {
+			log.Fatalln("Invalid PKGS_EVENT_RETENTION value", pkgsEventRetention)
+		}
+	}
+	eventMaxAge = parseDuration(pkgsEventMaxAge, eventMaxAge)
+
+	server, err := NewServer(ctx, pkgsRoot, db, api, key)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	server.uploadPath = pkgsPath + "/uploads"
+	err = os.MkdirAll(server.uploadPath, 0755)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if pkgsMaxUploadSize != "" {
+		server.maxUploadSize, err = strconv.ParseInt(pkgsMaxUploadSize, 10, 64)
+		if err != nil || server.maxUploadSize < 0 {
+			log.Fatalln("Invalid PKGS_MAX_UPLOAD_SIZE value", pkgsMaxUploadSize)
+		}
+	}
+
+	if fsckCommand.Parsed() {
+		os.Exit(fsck(ctx, server, *fsckRepair))
+	}
+
+	if pkgsMirror != "" {
+		log.Println("Mirroring", pkgsMirror)
+		server.startMirror(pkgsMirror, parseDuration(pkgsMirrorInterval, time.Minute))
+	}
+
+	if pkgsIPNS != "off" {
+		lifetime := parseDuration(pkgsIPNSLifetime, 24*time.Hour)
+		ttl := parseDuration(pkgsIPNSTTL, time.Minute)
+		log.Printf("Publishing the root package %s to %s\n", pkgsIPNS, pkgsRoot)
+		server.publishIPNS(pkgsIPNS, lifetime, ttl)
+	}
+
+	if reindex.set {
+		_, err = server.reindex(ctx, reindex.name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	handler := cors.New(cors.Options{
 		AllowCredentials: false,
 		AllowedMethods: []string{
@@ -86,25 +249,66 @@ func main() {
 			http.MethodDelete,
 			"MKCOL",
 			"MOVE",
+			"LOCK",
+			"UNLOCK",
+			"PROPFIND",
+			"PROPPATCH",
+		},
+		AllowedHeaders: []string{
+			"Link", "If-Match", "If-None-Match", "Content-Type", "Accept",
+			"Content-MD5", "Digest", "Content-Digest", "Repr-Digest",
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum",
+			"If", "Depth", "Destination", "Overwrite", "Timeout", "Prefer", "Last-Event-ID", "Lock-Token",
 		},
-		AllowedHeaders: []string{"Link", "If-Match", "If-None-Match", "Content-Type", "Accept"},
-		ExposedHeaders: []string{"Content-Type", "Link", "ETag", "Content-Disposition", "Content-Length"},
-		Debug:          false,
+		ExposedHeaders: []string{
+			"Content-Type", "Link", "ETag", "Content-Disposition", "Content-Length", "Allow", "Accept-Post", "Accept-Put", "Accept-Ranges", "DAV",
+			"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires",
+			"Lock-Token", "Preference-Applied",
+		},
+		Debug: false,
 	}).Handler(server)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		_ = <-c
-		log.Println("Closing database")
-		server.Close()
-		log.Println("Closing indices")
-		for _, index := range rpc.INDICES {
-			index.Close()
-		}
+		closeServer(server)
 		os.Exit(1)
 	}()
 
 	log.Println("http://localhost:8086")
 	log.Fatal(http.ListenAndServe(":8086", handler))
 }
+
+func closeServer(server *Server) {
+	log.Println("Closing database")
+	server.Close()
+	log.Println("Closing indices")
+	for _, index := range rpc.INDICES {
+		index.Close()
+	}
+}
+
+// fsck prints the report as JSON and returns the exit code:
+// 0 if the catalog is (now) consistent, 1 if there are unrepaired discrepancies, and 2 on error.
+func fsck(ctx context.Context, server *Server, repair bool) int {
+	defer closeServer(server)
+
+	report, err := server.fsck(ctx, repair)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	log.Printf("Checked %d resources: %d discrepancies, %d unrepaired\n",
+		report.Checked, len(report.Discrepancies), report.Unrepaired())
+
+	if report.Unrepaired() > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+	multibase "github.com/multiformats/go-multibase"
+	rdf "github.com/underlay/go-rdfjs"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// A mirror is a read-only replica of another pkgs server. It follows the remote root
+// package, either by resolving an IPNS name (which must be published with
+// PKGS_IPNS=package, so that it names the package document) or by listening to a
+// remote server's /_events feed, and applies every new root to the local catalog
+// with diffChildren. Moving the pins to the new root fetches the whole tree.
+
+// ErrMirror is returned for requests that would write to a mirror
+var ErrMirror = errors.New("This server is a read-only mirror")
+
+// ErrMirrorRoot is returned when the remote root isn't a package
+var ErrMirrorRoot = errors.New("Invalid mirror: the remote root is not a package document")
+
+type mirror struct {
+	server   *Server
+	remote   string
+	interval time.Duration
+	client   *http.Client
+	done     chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// isIPNS returns true if remote is an IPNS name rather than an HTTP base URL
+func isIPNS(remote string) bool {
+	return strings.HasPrefix(remote, "dweb:/ipns/") || strings.HasPrefix(remote, "/ipns/")
+}
+
+// startMirror starts following remote, polling an IPNS name every interval or
+// reconnecting to a remote event feed after interval.
+func (server *Server) startMirror(remote string, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &mirror{
+		server:   server,
+		remote:   strings.TrimSuffix(remote, "/"),
+		interval: interval,
+		client:   &http.Client{},
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+
+	server.mirror = m
+	m.wg.Add(1)
+	if isIPNS(remote) {
+		go m.poll(ctx)
+	} else {
+		go m.follow(ctx)
+	}
+}
+
+// Close stops following the remote root
+func (m *mirror) Close() {
+	close(m.done)
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *mirror) wait() bool {
+	select {
+	case <-m.done:
+		return false
+	case <-time.After(m.interval):
+		return true
+	}
+}
+
+func (m *mirror) poll(ctx context.Context) {
+	defer m.wg.Done()
+	name := "/ipns/" + strings.TrimPrefix(strings.TrimPrefix(m.remote, "dweb:/ipns/"), "/ipns/")
+	for {
+		id, err := m.resolve(ctx, name)
+		if err == nil {
+			err = m.server.sync(ctx, id)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error mirroring", m.remote+":", err)
+		}
+
+		if !m.wait() {
+			return
+		}
+	}
+}
+
+// resolve returns the package ID that the IPNS name points to
+func (m *mirror) resolve(ctx context.Context, name string) (string, error) {
+	p, err := m.server.api.Name().Resolve(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := m.server.api.ResolvePath(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	return m.server.packageID(ctx, resolved)
+}
+
+// packageID finds the fragment of the package node in a package document
+func (server *Server) packageID(ctx context.Context, p path.Resolved) (string, error) {
+	node, err := server.api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	quads, err := rdf.ReadQuads(files.ToFile(node))
+	if err != nil {
+		return "", err
+	}
+
+	s, err := p.Cid().StringOfBase(multibase.Base32)
+	if err != nil {
+		return "", err
+	}
+
+	for _, quad := range quads {
+		if quad.Predicate().Equal(rdfType) && quad.Object().Equal(provCollection) &&
+			quad.Subject().TermType() == rdf.BlankNodeType {
+			return "ul:" + s + "#" + quad.Subject().Value(), nil
+		}
+	}
+
+	return "", ErrMirrorRoot
+}
+
+func (m *mirror) follow(ctx context.Context) {
+	defer m.wg.Done()
+	for {
+		err := m.listen(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error mirroring", m.remote+":", err)
+		}
+
+		if !m.wait() {
+			return
+		}
+	}
+}
+
+// listen syncs the current remote root, and then every root in the remote event feed
+func (m *mirror) listen(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.remote+"/_events", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "text/event-stream")
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return errors.New(res.Status)
+	}
+
+	// Only fetch the current root once the feed is open, so that nothing falls in between
+	head, err := http.NewRequestWithContext(ctx, "HEAD", m.remote+"/", nil)
+	if err != nil {
+		return err
+	}
+
+	rootRes, err := m.client.Do(head)
+	if err != nil {
+		return err
+	}
+	rootRes.Body.Close()
+
+	root, _ := types.ParseLinks(rootRes.Header["Link"])
+	err = m.server.sync(ctx, root)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		event := &Event{}
+		err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event)
+		if err != nil {
+			return err
+		}
+
+		err = m.server.sync(ctx, event.Root)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// sync replaces the local root package with the package id, if it's different
+func (server *Server) sync(ctx context.Context, id string) error {
+	if !types.PackageURIPattern.MatchString(id) {
+		return ErrMirrorRoot
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	txn := server.db.NewTransaction(true)
+	defer server.discard(txn)
+
+	old, err := getPackage(nil, txn)
+	if err != nil {
+		return err
+	} else if old.ID == id {
+		return nil
+	}
+
+	pkg, err := server.parse(ctx, &types.Reference{ID: id, Resource: server.resource})
+	if err != nil {
+		return err
+	}
+
+	err = server.diffChildren(ctx, nil, pkg, old, txn)
+	if err != nil {
+		return err
+	}
+
+	err = server.setEntry(nil, pkg, txn)
+	if err != nil {
+		return err
+	}
+
+	err = server.commitTxn(txn)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Mirrored", id)
+
+	// The write is durable now, so failing to move the pins is only logged
+	err = server.update(ctx, pkg.Path(), pkg.ValuePath())
+	if err != nil {
+		log.Println("Error updating pins:", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestMirrorReadOnly checks that a mirror refuses every write, including to system paths
+func TestMirrorReadOnly(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.mirror = &mirror{server: server, done: make(chan struct{}), cancel: func() {}}
+
+	for _, r := range []struct{ method, target, body string }{
+		{"PUT", "/a.txt", "a\n"},
+		{"MKCOL", "/a", ""},
+		{"PROPPATCH", "/", ""},
+		{"LOCK", "/", ""},
+		{"PUT", "/_proof", ""},
+		{"POST", "/_batch", "[]"},
+		{"POST", "/_admin/fsck", ""},
+		{"POST", "/_admin/reindex", ""},
+		{"PUT", "/_admin/limits/a", `{"maxSize": 1}`},
+		{"POST", "/_webhooks/", `{"url": "https://example.com/"}`},
+		{"PUT", "/_mounts/a", ""},
+		{"POST", "/_uploads", ""},
+	} {
+		res := do(server, r.method, r.target, r.body, nil)
+		if res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: %d %s", r.method, r.target, res.Code, res.Body.String())
+		}
+	}
+
+	for _, target := range []string{"/", "/_webhooks/", "/_admin/limits"} {
+		res := do(server, "GET", target, "", nil)
+		if res.Code != http.StatusOK {
+			t.Errorf("GET %s: %d %s", target, res.Code, res.Body.String())
+		}
+	}
+}
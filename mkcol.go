@@ -17,53 +17,56 @@ func (server *Server) Mkcol(ctx context.Context, res http.ResponseWriter, req *h
 		return
 	}
 
-	txn := server.db.NewTransaction(true)
-	defer txn.Discard()
-
-	_, err := txn.Get(getKey(key))
-	if err == badger.ErrKeyNotFound {
-	} else if err != nil {
-		res.WriteHeader(500)
-		res.Write([]byte(err.Error()))
-		return
-	} else {
-		res.WriteHeader(409)
-		return
-	}
-
 	resource := server.resource + "/" + strings.Join(key, "/")
 	name := key[len(key)-1]
 	pkg := types.NewPackage(resource, name)
 
-	_, err = server.normalize(ctx, pkg)
+	_, err := server.normalize(ctx, pkg)
 	if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
 		return
 	}
 
-	err = server.set(ctx, key, pkg, txn)
+	err = server.write(key, func(txn *badger.Txn) error {
+		_, err := txn.Get(getKey(key))
+		if err == nil {
+			return ErrExists
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		err = checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		err = server.set(ctx, key, pkg, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, pkg.Created, key, pkg, txn)
+	})
+
 	if err == badger.ErrKeyNotFound {
 		res.WriteHeader(404)
 		return
-	} else if err == ErrParentNotPackage {
+	} else if err == ErrExists || err == ErrParentNotPackage {
 		res.WriteHeader(409)
 		return
-	} else if err != nil {
-		res.WriteHeader(500)
+	} else if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = server.commit(ctx, pkg.Created, key, pkg, txn)
-	if err != nil {
-		res.WriteHeader(500)
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = txn.Commit()
-	if err != nil {
+	} else if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
 		return
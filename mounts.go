@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// A mount is a package member that points at another package (by ID or by IPNS
+// name) without copying its subtree into the catalog. The package document can't
+// tell the difference: the mount is an ordinary package member, and only its own
+// catalog entry exists. The mount itself is recorded under _mounts/{path}, and
+// GET resolves paths beneath it by parsing the package documents on the way down.
+// The members beneath a mount are queued for the indices after it's mounted, in
+// chunks outside of the mount's transaction (and removed when it's unmounted), so
+// queries see them without a catalog entry.
+// Materializing a mount imports the whole subtree and deletes the record, after
+// which it's an ordinary package. IPNS sources are resolved once, when they're
+// mounted; mounting the same source again follows the name to its current package.
+
+const mountPrefix = "_mounts"
+
+// errMountChanged stops queueing the members beneath a mount that was removed or replaced
+var errMountChanged = errors.New("Mount changed")
+
+// ErrInvalidMount is returned for mount sources that aren't package IDs or IPNS names
+var ErrInvalidMount = errors.New("Invalid mount: expected a ul: package ID or a dweb:/ipns/ name")
+
+// A mountRecord describes a mount. ID is what the source resolved to when it was mounted.
+type mountRecord struct {
+	Path    string `json:"path"`
+	Source  string `json:"source"`
+	ID      string `json:"id"`
+	Mounted string `json:"mounted"`
+}
+
+func mountKey(key []string) []byte { return append([]byte(mountPrefix), getKey(key)...) }
+
+func getMount(key []string, txn *badger.Txn) (*mountRecord, error) {
+	item, err := txn.Get(mountKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mountRecord{}
+	return m, item.Value(func(val []byte) error { return json.Unmarshal(val, m) })
+}
+
+// isMounted reports whether the package at key is a mount
+func isMounted(key []string, txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(mountKey(key))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unmount deletes the mount record at key, if there is one, and reports whether there was
+func unmount(key []string, txn *badger.Txn) (bool, error) {
+	mounted, err := isMounted(key, txn)
+	if err != nil || !mounted {
+		return false, err
+	}
+	return true, txn.Delete(mountKey(key))
+}
+
+// removeMount deletes the mount record at key, if there is one, and queues the removal
+// of the members beneath it (pkg is the mounted package) from the indices.
+// It reports whether there was a mount.
+func (server *Server) removeMount(ctx context.Context, key []string, pkg *types.Package, txn *badger.Txn) (bool, error) {
+	mounted, err := unmount(key, txn)
+	if err != nil || !mounted {
+		return false, err
+	}
+
+	return true, server.walkMounted(ctx, key, pkg, func(key []string, r types.Resource) error {
+		return server.queue.Delete(key, r, txn)
+	})
+}
+
+// walkMounted calls f with every resource beneath the mounted package pkg at key,
+// parsing the package documents on the way down
+func (server *Server) walkMounted(ctx context.Context, key []string, pkg *types.Package, f func(key []string, r types.Resource) error) error {
+	for _, p := range pkg.Members.Packages {
+		childKey := append(key[:len(key):len(key)], p.Name())
+		child, err := server.parse(ctx, p)
+		if err != nil {
+			return err
+		}
+
+		err = f(childKey, child)
+		if err != nil {
+			return err
+		}
+
+		err = server.walkMounted(ctx, childKey, child, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range pkg.Members.Assertions {
+		err := f(append(key[:len(key):len(key)], a.Name()), a)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range pkg.Members.Files {
+		err := f(append(key[:len(key):len(key)], file.Name()), file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveSource returns the package ID that a mount source currently points to
+func (server *Server) resolveSource(ctx context.Context, source string) (string, error) {
+	if types.PackageURIPattern.MatchString(source) {
+		return source, nil
+	} else if !isIPNS(source) {
+		return "", ErrInvalidMount
+	}
+
+	name := "/ipns/" + strings.TrimPrefix(strings.TrimPrefix(source, "dweb:/ipns/"), "/ipns/")
+	p, err := server.api.Name().Resolve(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := server.api.ResolvePath(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	return server.packageID(ctx, resolved)
+}
+
+// mount writes the mounted package pkg (whose ID source resolved to) at key, without
+// its children, and commits txn. It returns the mount record.
+func (server *Server) mount(ctx context.Context, key []string, source string, pkg *types.Package, txn *badger.Txn) (*mountRecord, error) {
+	parentItem, err := txn.Get(getKey(key[:len(key)-1]))
+	if err != nil {
+		return nil, err
+	} else if parentItem.UserMeta() != byte(types.PackageType) {
+		return nil, ErrParentNotPackage
+	}
+
+	old, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if oldPackage, is := old.(*types.Package); is {
+		err = server.deleteChildren(ctx, key, oldPackage, txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp := time.Now().Format(time.RFC3339)
+	record := &mountRecord{Path: "/" + strings.Join(key, "/"), Source: source, ID: pkg.ID, Mounted: timestamp}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = txn.Set(mountKey(key), value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.setEntry(key, pkg, txn)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, server.commit(ctx, timestamp, key, pkg, txn)
+}
+
+// mountChunk is the number of members beneath a mount queued in each transaction
+var mountChunk = 1000
+
+// queueMounted queues the members beneath the mount record at key (pkg is the mounted
+// package) for the indices after the mount is committed, walking the package documents
+// outside of any transaction and queueing mountChunk members at a time. It stops if
+// the mount has been removed or replaced in the meantime, since that queues its own
+// operations.
+func (server *Server) queueMounted(ctx context.Context, key []string, record *mountRecord, pkg *types.Package) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	type member struct {
+		key      []string
+		resource types.Resource
+	}
+
+	chunk := make([]member, 0, mountChunk)
+	flush := func() error {
+		err := server.write(key, func(txn *badger.Txn) error {
+			m, err := getMount(key, txn)
+			if err == badger.ErrKeyNotFound {
+				return errMountChanged
+			} else if err != nil {
+				return err
+			} else if m.ID != record.ID || m.Mounted != record.Mounted {
+				return errMountChanged
+			}
+
+			// Rewriting the record makes a concurrent unmount, which reads it,
+			// conflict and queue its removals after these
+			err = txn.Set(mountKey(key), value)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range chunk {
+				err = server.queue.Set(m.key, m.resource, txn)
+				if err != nil {
+					return err
+				}
+			}
+
+			return server.commitTxn(txn)
+		})
+		chunk = chunk[:0]
+		return err
+	}
+
+	err = server.walkMounted(ctx, key, pkg, func(key []string, r types.Resource) error {
+		chunk = append(chunk, member{key, r})
+		if len(chunk) < mountChunk {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(chunk) > 0 {
+		err = flush()
+	}
+	if err == errMountChanged {
+		return nil
+	}
+	return err
+}
+
+// materialize imports the whole subtree of the mount at key into the catalog.
+// The package documents don't change, so there's no new revision.
+func (server *Server) materialize(ctx context.Context, key []string) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	txn := server.db.NewTransaction(true)
+	defer server.discard(txn)
+
+	mounted, err := unmount(key, txn)
+	if err != nil {
+		return err
+	} else if !mounted {
+		return badger.ErrKeyNotFound
+	}
+
+	pkg, err := getPackage(key, txn)
+	if err != nil {
+		return err
+	}
+
+	err = server.setChildren(ctx, key, pkg, txn)
+	if err != nil {
+		return err
+	}
+
+	return server.commitTxn(txn)
+}
+
+// getMounted resolves a path beneath a mount by walking down from the mount's package.
+// It returns badger.ErrKeyNotFound if the path isn't beneath a mount or doesn't exist.
+func (server *Server) getMounted(ctx context.Context, key []string, txn *badger.Txn) (types.Resource, error) {
+	for i := len(key) - 1; i > 0; i-- {
+		mounted, err := isMounted(key[:i], txn)
+		if err != nil {
+			return nil, err
+		} else if !mounted {
+			continue
+		}
+
+		pkg, err := getPackage(key[:i], txn)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, name := range key[i:] {
+			last := i+j == len(key)-1
+			if _, p := pkg.SearchPackages(name, false); p != nil {
+				pkg, err = server.parse(ctx, p)
+				if err != nil {
+					return nil, err
+				}
+				if last {
+					return pkg, nil
+				}
+				continue
+			} else if !last {
+				return nil, badger.ErrKeyNotFound
+			}
+
+			isCid := cidPattern.MatchString(name)
+			if _, a := pkg.SearchAssertions(name, isCid); a != nil {
+				return a, nil
+			} else if _, f := pkg.SearchFiles(name, isCid); f != nil {
+				return f, nil
+			}
+		}
+
+		return nil, badger.ErrKeyNotFound
+	}
+
+	return nil, badger.ErrKeyNotFound
+}
+
+// Mounts handles requests to /_mounts/{path}. GET returns the mount at path (or every
+// mount, for /_mounts), PUT mounts the package given by the "source" of a JSON body,
+// and POST materializes the mount.
+func (server *Server) Mounts(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if req.Method != "GET" && req.Method != "PUT" && req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	} else if len(key) == 0 && req.Method != "GET" {
+		res.WriteHeader(409)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		server.getMounts(res, key)
+	case "POST":
+		err := server.materialize(ctx, key)
+		if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		res.WriteHeader(204)
+	case "PUT":
+		body := &struct {
+			Source string `json:"source"`
+		}{}
+
+		err := json.NewDecoder(req.Body).Decode(body)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		// The mounted package is resolved and parsed before the write, and the
+		// members beneath it are queued after it, so that neither holds the path
+		var pkg *types.Package
+		var record *mountRecord
+		id, err := server.resolveSource(ctx, body.Source)
+		if err == nil {
+			ref := &types.Reference{ID: id, Resource: types.GetURI(server.resource, key), Title: key[len(key)-1]}
+			pkg, err = server.parse(ctx, ref)
+		}
+		if err == nil {
+			err = server.write(key, func(txn *badger.Txn) (err error) {
+				record, err = server.mount(ctx, key, body.Source, pkg, txn)
+				return
+			})
+		}
+
+		if err == ErrInvalidMount || err == ErrParsePackage || err == ErrMirrorRoot {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		} else if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err == ErrParentNotPackage {
+			res.WriteHeader(409)
+			return
+		} else if err != nil {
+			res.WriteHeader(502)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		// The mount is committed either way; a reindex queues whatever this misses
+		err = server.queueMounted(ctx, key, record, pkg)
+		if err != nil {
+			log.Println("Error queueing the members of mount", record.Path+":", err)
+		}
+
+		res.Header().Add("ETag", pkg.ETag())
+		res.Header().Add("Link", makeSelfLink(pkg.URI()))
+		res.WriteHeader(201)
+	}
+}
+
+func (server *Server) getMounts(res http.ResponseWriter, key []string) {
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	var result interface{}
+	if len(key) > 0 {
+		m, err := getMount(key, txn)
+		if err == badger.ErrKeyNotFound {
+			res.WriteHeader(404)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		result = m
+	} else {
+		mounts := []*mountRecord{}
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.Prefix = []byte(mountPrefix + "/")
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			m := &mountRecord{}
+			err := iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, m) })
+			if err != nil {
+				res.WriteHeader(500)
+				res.Write([]byte(err.Error()))
+				return
+			}
+			mounts = append(mounts, m)
+		}
+		result = mounts
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(result)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestMountIndices checks that the members beneath a mount can be read, and that
+// they're added to the indices when it's mounted, removed when it's deleted, and
+// replayed when the indices are rebuilt
+func TestMountIndices(t *testing.T) {
+	// Queue the members beneath the mount in more than one chunk
+	chunk := mountChunk
+	mountChunk = 3
+	defer func() { mountChunk = chunk }()
+
+	index := newTestIndex()
+	server, _ := newTestServerWithIndices(t, index)
+
+	entries := map[string]string{"a.txt": "a\n", "sub/b.txt": "b\n", "c.nq": "<http://example.com/a> <http://example.com/b> \"c\" .\n"}
+	res := do(server, "PUT", "/src", tarBody(t, entries), map[string]string{"Content-Type": "application/x-tar"})
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT /src: %d %s", res.Code, res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	src, err := getPackage([]string{"src"}, txn)
+	txn.Discard()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount := func(p string) {
+		t.Helper()
+		res := do(server, "PUT", "/_mounts"+p, `{"source": "`+src.ID+`"}`, nil)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("PUT /_mounts%s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	mount("/m")
+	res = do(server, "GET", "/m/sub/b.txt", "", nil)
+	if res.Code != http.StatusOK || res.Body.String() != "b\n" {
+		t.Errorf("GET /m/sub/b.txt: %d %q", res.Code, res.Body.String())
+	}
+
+	members := []string{"/m/a.txt", "/m/sub", "/m/sub/b.txt", "/m/c"}
+	index.wait(t, true, append(members, "/m")...)
+
+	res = do(server, "DELETE", "/m", "", nil)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /m: %d %s", res.Code, res.Body.String())
+	}
+	index.wait(t, false, append(members, "/m")...)
+
+	mount("/n")
+	index.wait(t, true, "/n/sub/b.txt")
+
+	index.mutex.Lock()
+	index.resources = map[string]string{}
+	index.mutex.Unlock()
+
+	done, err := server.reindex(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	index.wait(t, true, "/n", "/n/a.txt", "/n/sub", "/n/sub/b.txt", "/n/c", "/src/sub/b.txt")
+}
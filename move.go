@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Move handles WebDAV MOVE requests. The move itself is a batch move operation;
+// if the destination exists, it's deleted first, unless the Overwrite header is F.
+func (server *Server) Move(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	src := types.ParsePath(req.URL.Path)
+	destination, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || req.Header.Get("Destination") == "" {
+		res.WriteHeader(400)
+		return
+	} else if destination.Host != "" && destination.Host != req.Host {
+		res.WriteHeader(502)
+		return
+	}
+
+	dst := types.ParsePath(destination.Path)
+	if len(src) == 0 || len(dst) == 0 || isReserved(dst) || isInside(src, dst) && len(src) == len(dst) {
+		res.WriteHeader(403)
+		return
+	}
+
+	overwrite := req.Header.Get("Overwrite") != "F"
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	txn := server.db.NewTransaction(true)
+	defer server.discard(txn)
+
+	b := &batch{
+		server:    server,
+		txn:       txn,
+		timestamp: time.Now().Format(time.RFC3339),
+		created:   map[string]bool{},
+		dirty:     map[string]*batchPackage{},
+	}
+
+	err = checkLocks(req, src, removeSubtree, txn)
+	if err == nil {
+		err = checkLocks(req, dst, writeSubtree, txn)
+	}
+
+	if err != nil {
+		res.WriteHeader(batchStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	status := 201
+	_, err = txn.Get(getKey(dst))
+	if err == nil {
+		if !overwrite {
+			res.WriteHeader(412)
+			return
+		} else if isInside(src, dst) {
+			// Deleting the destination would delete the source too
+			res.WriteHeader(409)
+			return
+		}
+
+		status = 204
+		err = b.delete(ctx, dst)
+	} else if err == badger.ErrKeyNotFound {
+		err = nil
+	}
+
+	if err == nil {
+		err = b.move(ctx, src, dst)
+	}
+
+	if err != nil {
+		res.WriteHeader(batchStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	id, value, err := b.finish(ctx)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	moved, err := getResource(dst, txn)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	err = server.commitTxn(txn)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	// The write is durable now, so failing to move the pins is only logged
+	err = server.update(ctx, id, value)
+	if err != nil {
+		log.Println("Error updating pins:", err)
+	}
+
+	res.Header().Add("ETag", moved.ETag())
+	res.Header().Add("Link", makeSelfLink(moved.URI()))
+	res.WriteHeader(status)
+}
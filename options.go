@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+	types "github.com/underlay/pkgs/types"
+)
+
+// CORS preflights are answered before they get here, so the Options handler only
+// sees plain OPTIONS requests. It says which methods the resource at the path
+// allows (Allow) and which formats it accepts (Accept-Post and Accept-Put), so that
+// generic LDP and WebDAV clients can discover them. There's no PATCH, so there's
+// no Accept-Patch, and no range requests, so Accept-Ranges is always none.
+
+var readMethods = []string{"OPTIONS", "GET", "HEAD", "PROPFIND"}
+
+// archiveOffers are the archive formats that packages accept, in the order they're advertised
+var archiveOffers = []string{"application/x-tar", "application/zip", "multipart/form-data"}
+
+// davCompliance is the DAV header: class 1, and class 2 for locking
+const davCompliance = "1, 2"
+
+// Options handles HTTP OPTIONS requests
+func (server *Server) Options(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("DAV", davCompliance)
+	res.Header().Add("Accept-Ranges", "none")
+	if req.RequestURI == "*" {
+		res.Header().Add("Allow", strings.Join(append(readMethods[:len(readMethods):len(readMethods)], "POST", "PUT", "DELETE", "LOCK", "UNLOCK", "MKCOL", "MOVE", "PROPPATCH"), ", "))
+		res.WriteHeader(204)
+		return
+	}
+
+	key := types.ParsePath(req.URL.Path)
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	// Resources beneath mounts aren't in the catalog, and can only be read
+	writable := server.mirror == nil
+	r, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		writable = false
+		r, err = server.getMounted(ctx, key, txn)
+	}
+
+	if err == badger.ErrKeyNotFound && isInbox(key) && server.mirror == nil {
+		// Inboxes are created with their first notification
+		_, err = getPackage(key[:len(key)-1], txn)
+		if err == nil {
+			res.Header().Add("Allow", "OPTIONS, POST")
+			res.Header().Add("Accept-Post", strings.Join(offers[:2], ", "))
+			res.WriteHeader(204)
+			return
+		}
+	}
+
+	if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("Link", makeSelfLink(r.URI()))
+	res.Header().Add("Link", types.LinkTypeResource)
+	res.Header().Add("Link", types.MakeLinkType(r.Type()))
+
+	methods := readMethods
+	if writable {
+		methods = append(methods[:len(methods):len(methods)], "PUT", "LOCK", "UNLOCK")
+		if len(key) > 0 {
+			methods = append(methods, "DELETE", "MOVE")
+		}
+	}
+
+	switch r.(type) {
+	case *types.Package:
+		res.Header().Add("Link", types.MakeLinkConstrainedBy(links["shex.jsonld"]))
+		if inbox := server.inboxLink(key); inbox != "" {
+			res.Header().Add("Link", inbox)
+		}
+		if writable {
+			methods = append(methods, "POST", "PROPPATCH")
+			if isInbox(key) {
+				res.Header().Add("Accept-Post", strings.Join(offers[:2], ", "))
+			} else {
+				res.Header().Add("Accept-Post", strings.Join(append(append(offers[:len(offers):len(offers)], archiveOffers...), "*/*"), ", "))
+			}
+			res.Header().Add("Accept-Put", strings.Join(append(append(offers[:len(offers):len(offers)], carFormat), archiveOffers...), ", "))
+		}
+	case *types.Assertion:
+		if writable {
+			res.Header().Add("Accept-Put", strings.Join(offers, ", "))
+		}
+	case *types.File:
+		if writable {
+			res.Header().Add("Accept-Put", "*/*")
+		}
+	}
+
+	res.Header().Add("Allow", strings.Join(methods, ", "))
+	res.WriteHeader(204)
+}
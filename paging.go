@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+	ui "github.com/underlay/pkgs/ui"
+)
+
+// Packages can be listed a page of members at a time (LDP Paging). Clients ask
+// for the first page with Prefer: return=representation; max-member-count="N",
+// and follow the first, prev, next, and last links from there; the links carry
+// the page in the query, as ?page=2&size=N&sort=title. Members are sorted across
+// all three member types by title (the default), created, modified, or extent,
+// and a sort beginning with - is descending. Pages are serialized from the catalog
+// instead of being the stored package document, so they have weak ETags.
+// The HTML UI always pages, defaultPageSize members at a time.
+
+var defaultPageSize = 100
+var maxPageSize = 10000
+
+var sortKeys = map[string]bool{"title": true, "created": true, "modified": true, "extent": true}
+
+// ErrInvalidPaging is returned for page requests with invalid page, size, or sort parameters
+var ErrInvalidPaging = errors.New("Invalid paging: expected a positive page and size, and a sort of title, created, modified, or extent")
+
+type paging struct {
+	page       int
+	size       int
+	sort       string
+	descending bool
+}
+
+// parsePaging returns the page that req asks for, or nil for the whole package
+func parsePaging(req *http.Request, format string) (*paging, error) {
+	query := req.URL.Query()
+	p := &paging{page: 1, sort: "title"}
+	paged := false
+
+	if size := parsePrefer(req)["max-member-count"]; size != "" {
+		paged = true
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidPaging
+		}
+		p.size = n
+	}
+
+	if page := query.Get("page"); page != "" {
+		paged = true
+		n, err := strconv.Atoi(page)
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidPaging
+		}
+		p.page = n
+	}
+
+	if size := query.Get("size"); size != "" {
+		paged = true
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidPaging
+		}
+		p.size = n
+	}
+
+	if s := query.Get("sort"); s != "" {
+		paged = true
+		p.sort, p.descending = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		if !sortKeys[p.sort] {
+			return nil, ErrInvalidPaging
+		}
+	}
+
+	if !paged && format != "text/html" {
+		return nil, nil
+	} else if p.size == 0 && format == "text/html" {
+		p.size = defaultPageSize
+	} else if p.size == 0 {
+		p.size = maxPageSize
+	}
+
+	if p.size > maxPageSize {
+		p.size = maxPageSize
+	}
+
+	return p, nil
+}
+
+func (p *paging) query(page int) string {
+	s := p.sort
+	if p.descending {
+		s = "-" + s
+	}
+	return fmt.Sprintf("?page=%d&size=%d&sort=%s", page, p.size, url.QueryEscape(s))
+}
+
+// A pageMember is a member of a package with the values it can be sorted by
+type pageMember struct {
+	name     string
+	created  string
+	modified string
+	extent   int
+	r        interface{}
+}
+
+func (p *paging) less(a, b *pageMember) bool {
+	switch p.sort {
+	case "created":
+		if a.created != b.created {
+			return a.created < b.created
+		}
+	case "modified":
+		if a.modified != b.modified {
+			return a.modified < b.modified
+		}
+	case "extent":
+		if a.extent != b.extent {
+			return a.extent < b.extent
+		}
+	}
+	return a.name < b.name
+}
+
+// members returns the members of the package at key in the order of p. Sorting subpackages
+// by anything but their title needs their catalog entries; subpackages beneath mounts
+// don't have any, so they sort as if they were empty.
+func (p *paging) members(key []string, pkg *types.Package, txn *badger.Txn) ([]*pageMember, error) {
+	members := make([]*pageMember, 0, len(pkg.Members.Packages)+len(pkg.Members.Assertions)+len(pkg.Members.Files))
+	for _, r := range pkg.Members.Packages {
+		m := &pageMember{name: r.Title, r: r}
+		if p.sort != "title" {
+			child, err := getPackage(append(key[:len(key):len(key)], r.Title), txn)
+			if err == nil {
+				m.created, m.modified, m.extent = child.Created, child.Modified, child.Value.Extent
+			} else if err != badger.ErrKeyNotFound {
+				return nil, err
+			}
+		}
+		members = append(members, m)
+	}
+	for _, a := range pkg.Members.Assertions {
+		members = append(members, &pageMember{name: a.Name(), created: a.Created, modified: a.Modified, r: a})
+	}
+	for _, f := range pkg.Members.Files {
+		members = append(members, &pageMember{name: f.Name(), created: f.Created, modified: f.Modified, extent: f.Extent, r: f})
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		if p.descending {
+			return p.less(members[j], members[i])
+		}
+		return p.less(members[i], members[j])
+	})
+
+	return members, nil
+}
+
+// pageLinks are the links between pages of a package, for the HTML UI
+type pageLinks struct {
+	Page, Pages             int
+	First, Prev, Next, Last string
+}
+
+// getPage writes a page of the members of the package at key, with the parts that view selects.
+// applied is the Preference-Applied header for view.
+func (server *Server) getPage(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string, pkg *types.Package, p *paging, view types.PackageView, applied, format string, txn *badger.Txn) {
+	members, err := p.members(key, pkg, txn)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	pages := (len(members) + p.size - 1) / p.size
+	if pages == 0 {
+		pages = 1
+	}
+
+	if p.page > pages {
+		res.WriteHeader(404)
+		return
+	}
+
+	start, end := (p.page-1)*p.size, p.page*p.size
+	if end > len(members) {
+		end = len(members)
+	}
+
+	page := *pkg
+	page.Members.Packages, page.Members.Assertions, page.Members.Files = nil, nil, nil
+	for _, m := range members[start:end] {
+		switch r := m.r.(type) {
+		case *types.Reference:
+			page.Members.Packages = append(page.Members.Packages, r)
+		case *types.Assertion:
+			page.Members.Assertions = append(page.Members.Assertions, r)
+		case *types.File:
+			page.Members.Files = append(page.Members.Files, r)
+		}
+	}
+
+	nav := &pageLinks{Page: p.page, Pages: pages, First: req.URL.Path + p.query(1), Last: req.URL.Path + p.query(pages)}
+	res.Header().Add("Link", types.MakeLinkType(types.LDPPage))
+	res.Header().Add("Link", fmt.Sprintf(`<%s>; rel="first"`, nav.First))
+	res.Header().Add("Link", fmt.Sprintf(`<%s>; rel="last"`, nav.Last))
+	if p.page > 1 {
+		nav.Prev = req.URL.Path + p.query(p.page-1)
+		res.Header().Add("Link", fmt.Sprintf(`<%s>; rel="prev"`, nav.Prev))
+	}
+	if p.page < pages {
+		nav.Next = req.URL.Path + p.query(p.page+1)
+		res.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, nav.Next))
+	}
+
+	res.Header().Set("ETag", fmt.Sprintf(`W/"%s-%s"`, strings.Trim(pkg.ETag(), `"`), strings.TrimPrefix(p.query(p.page), "?")))
+	if size, has := parsePrefer(req)["max-member-count"]; has {
+		if applied == "" {
+			applied = "return=representation"
+		}
+		applied += fmt.Sprintf(`; max-member-count="%s"`, size)
+	}
+	if applied != "" {
+		res.Header().Add("Preference-Applied", applied)
+	}
+
+	server.writeView(res, key, &page, view, format, nav)
+}
+
+// writeView writes the parts of pkg that view selects in format. The HTML UI always shows every member.
+func (server *Server) writeView(res http.ResponseWriter, key []string, pkg *types.Package, view types.PackageView, format string, nav *pageLinks) {
+	switch format {
+	case offers[0]:
+		res.WriteHeader(200)
+		res.Write(pkg.NQuadsView(view))
+	case offers[1]:
+		doc, err := pkg.JsonLdView(links["package.jsonld"], view)
+		if err != nil {
+			res.WriteHeader(500)
+			return
+		}
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(doc)
+	case offers[2]:
+		res.WriteHeader(200)
+		writeQuads(res, bytes.NewReader(pkg.NQuadsView(view)))
+	case "text/html":
+		res.WriteHeader(200)
+		ui.PageTemplate.Execute(res, &struct {
+			Pkg    *types.Package
+			Key    []string
+			Paging *pageLinks
+		}{pkg, key, nav})
+	}
+}
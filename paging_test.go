@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+var linkPattern = regexp.MustCompile(`^<([^>]*)>; rel="(first|last|prev|next)"$`)
+
+// getPageLinks returns the first, last, prev, and next links of a response
+func getPageLinks(res http.Header) map[string]string {
+	links := map[string]string{}
+	for _, link := range res["Link"] {
+		if match := linkPattern.FindStringSubmatch(link); match != nil {
+			links[match[2]] = match[1]
+		}
+	}
+	return links
+}
+
+// TestPaging pages through a package larger than one page with each sort key,
+// ascending and descending, following the next links like ul ls does
+func TestPaging(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res, _ := postBatch(t, server, []map[string]string{{"op": "mkcol", "path": "/p"}, putOp("/p/z.txt", "zzzzzzzz\n")})
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST /_batch: %d %s", res.Code, res.Body.String())
+	}
+
+	// Give the rest of the members later timestamps than z.txt
+	time.Sleep(1100 * time.Millisecond)
+
+	res, _ = postBatch(t, server, []map[string]string{
+		putOp("/p/a.txt", "a\n"),
+		putOp("/p/b.txt", "bbbbbbbbbbbbbbbb\n"),
+		putOp("/p/c.txt", "ccc\n"),
+		{"op": "put", "path": "/p/d", "type": "assertion", "format": "application/n-quads", "content": `<http://example.com/a> <http://example.com/b> "d" .` + "\n"},
+		{"op": "mkcol", "path": "/p/e"},
+		putOp("/p/e/x.txt", "xxxxx\n"),
+		{"op": "mkcol", "path": "/p/f"},
+	})
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST /_batch: %d %s", res.Code, res.Body.String())
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	pkg, err := getPackage([]string{"p"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type member struct {
+		name, created, modified string
+		extent                  int
+	}
+
+	all := []*member{}
+	for _, r := range pkg.Members.Packages {
+		child, err := getPackage([]string{"p", r.Title}, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, &member{r.Title, child.Created, child.Modified, child.Value.Extent})
+	}
+	for _, a := range pkg.Members.Assertions {
+		all = append(all, &member{a.Name(), a.Created, a.Modified, 0})
+	}
+	for _, f := range pkg.Members.Files {
+		all = append(all, &member{f.Name(), f.Created, f.Modified, f.Extent})
+	}
+
+	size := 3
+	pages := (len(all) + size - 1) / size
+	for _, key := range []string{"title", "created", "modified", "extent"} {
+		for _, descending := range []bool{false, true} {
+			s := key
+			if descending {
+				s = "-" + key
+			}
+
+			expected := make([]*member, len(all))
+			copy(expected, all)
+			sort.Slice(expected, func(i, j int) bool {
+				a, b := expected[i], expected[j]
+				if descending {
+					a, b = b, a
+				}
+				switch {
+				case key == "created" && a.created != b.created:
+					return a.created < b.created
+				case key == "modified" && a.modified != b.modified:
+					return a.modified < b.modified
+				case key == "extent" && a.extent != b.extent:
+					return a.extent < b.extent
+				}
+				return a.name < b.name
+			})
+
+			query := func(page int) string {
+				return fmt.Sprintf("/p?page=%d&size=%d&sort=%s", page, size, url.QueryEscape(s))
+			}
+
+			target := "/p?sort=" + url.QueryEscape(s)
+			for page := 1; target != ""; page++ {
+				header := map[string]string{"Accept": "application/ld+json", "Prefer": fmt.Sprintf(`return=representation; max-member-count="%d"`, size)}
+				res := do(server, "GET", target, "", header)
+				if res.Code != http.StatusOK {
+					t.Fatalf("GET %s: %d %s", target, res.Code, res.Body.String())
+				}
+
+				links := getPageLinks(res.Header())
+				if links["first"] != query(1) || links["last"] != query(pages) {
+					t.Errorf("GET %s: first %q and last %q", target, links["first"], links["last"])
+				}
+				if prev := links["prev"]; page == 1 && prev != "" || page > 1 && prev != query(page-1) {
+					t.Errorf("GET %s: prev %q", target, prev)
+				}
+				if next := links["next"]; page == pages && next != "" || page < pages && next != query(page+1) {
+					t.Errorf("GET %s: next %q", target, next)
+				}
+
+				p := &types.Package{}
+				err := json.Unmarshal(res.Body.Bytes(), p)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				names := []string{}
+				for _, r := range p.Members.Packages {
+					names = append(names, r.Title)
+				}
+				for _, a := range p.Members.Assertions {
+					names = append(names, a.Name())
+				}
+				for _, f := range p.Members.Files {
+					names = append(names, f.Name())
+				}
+				sort.Strings(names)
+
+				end := page * size
+				if end > len(expected) {
+					end = len(expected)
+				}
+
+				want := []string{}
+				for _, m := range expected[(page-1)*size : end] {
+					want = append(want, m.name)
+				}
+				sort.Strings(want)
+
+				if strings.Join(names, ",") != strings.Join(want, ",") {
+					t.Errorf("sort %s page %d: expected %v, got %v", s, page, want, names)
+				}
+
+				target = links["next"]
+				if page > pages {
+					t.Fatalf("sort %s: more than %d pages", s, pages)
+				}
+			}
+		}
+	}
+}
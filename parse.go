@@ -1,24 +1,20 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"os"
 
 	files "github.com/ipfs/go-ipfs-files"
-	ld "github.com/piprate/json-gold/ld"
 	rdf "github.com/underlay/go-rdfjs"
 
 	types "github.com/underlay/pkgs/types"
 )
 
 // ErrParsePackage means a remote package failed parsing
-var ErrParsePackage = errors.New("Error parsing package")
+var ErrParsePackage = types.ErrParsePackage
 
-var rdfType = rdf.NewNamedNode("http://www.w3.org/1999/02/22-rdf-syntax-ns#")
+var rdfType = rdf.NewNamedNode("http://www.w3.org/1999/02/22-rdf-syntax-ns#type")
 var ldpDirectContainer = rdf.NewNamedNode("http://www.w3.org/ns/ldp#DirectContainer")
 var ldpRDFSource = rdf.NewNamedNode("http://www.w3.org/ns/ldp#RDFSource")
 var ldpNonRDFSource = rdf.NewNamedNode("http://www.w3.org/ns/ldp#NonRDFSource")
@@ -26,8 +22,12 @@ var ldpMembershipResource = rdf.NewNamedNode("http://www.w3.org/ns/ldp#membershi
 
 var provHadMember = rdf.NewNamedNode("http://www.w3.org/ns/prov#hadMember")
 var provValue = rdf.NewNamedNode("http://www.w3.org/ns/prov#value")
+var provCollection = rdf.NewNamedNode("http://www.w3.org/ns/prov#Collection")
+var provWasRevisionOf = rdf.NewNamedNode("http://www.w3.org/ns/prov#wasRevisionOf")
 
 var dctermsTitle = rdf.NewNamedNode("http://purl.org/dc/terms/title")
+var dctermsDescription = rdf.NewNamedNode("http://purl.org/dc/terms/description")
+var dctermsSubject = rdf.NewNamedNode("http://purl.org/dc/terms/subject")
 var dctermsCreated = rdf.NewNamedNode("http://purl.org/dc/terms/created")
 var dctermsModified = rdf.NewNamedNode("http://purl.org/dc/terms/modified")
 var dctermsFormat = rdf.NewNamedNode("http://purl.org/dc/terms/format")
@@ -58,37 +58,16 @@ func (server *Server) parse(ctx context.Context, r *types.Reference) (*types.Pac
 		return nil, err
 	}
 
-	file := files.ToFile(node)
-	opts := ld.NewJsonLdOptions(r.Resource)
-	input, err := ld.NewJsonLdProcessor().FromRDF(file, opts)
+	quads, err := rdf.ReadQuads(files.ToFile(node))
 	if err != nil {
 		return nil, err
 	}
 
-	pkg, err := server.framePackage(r.Resource, input)
-	pkg.ID = r.ID
-	return pkg, err
-}
-
-func (server *Server) framePackage(base string, input interface{}) (*types.Package, error) {
-	opts := ld.NewJsonLdOptions(base)
-	opts.DocumentLoader = server.documentLoader
-	framed, err := ld.NewJsonLdProcessor().Frame(input, links["package.jsonld"], opts)
-
-	p := &types.Package{}
-
-	// This is a little crazy but whatever
-	buffer := bytes.NewBuffer(nil)
-	err = json.NewEncoder(buffer).Encode(framed)
+	pkg, err := types.ReadPackage(quads)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.NewDecoder(buffer).Decode(p)
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: sort the member resources!
-	return p, nil
+	pkg.ID = r.ID
+	return pkg, nil
 }
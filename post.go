@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	badger "github.com/dgraph-io/badger/v2"
 	files "github.com/ipfs/go-ipfs-files"
 	ld "github.com/piprate/json-gold/ld"
 	rdf "github.com/underlay/go-rdfjs"
@@ -16,6 +17,15 @@ import (
 func (server *Server) Post(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	self, t := types.ParseLinks(req.Header["Link"])
 	parentKey := types.ParsePath(req.URL.Path)
+	if isInbox(parentKey) {
+		server.Notify(ctx, res, req, parentKey[:len(parentKey)-1])
+		return
+	}
+
+	if isArchive(req.Header.Get("Content-Type")) {
+		server.putArchive(ctx, res, req, parentKey, true)
+		return
+	}
 
 	parentResource := types.GetURI(server.resource, parentKey)
 
@@ -98,10 +108,18 @@ func (server *Server) Post(ctx context.Context, res http.ResponseWriter, req *ht
 			f.Extent = stat.CumulativeSize
 			r = f
 		} else if format != "" {
+			body, err := server.newUploadBody(parentKey, req.Header, req.ContentLength, req.Body)
+			if err != nil {
+				res.WriteHeader(uploadStatus(err))
+				res.Write([]byte(err.Error()))
+				return
+			}
+
 			f := &types.File{Created: timestamp, Format: format}
-			err := server.setFile(ctx, f, files.NewReaderFile(req.Body))
+			err = server.addFile(ctx, f, body)
 			if err != nil {
-				res.WriteHeader(502)
+				res.WriteHeader(uploadStatus(err))
+				res.Write([]byte(err.Error()))
 				return
 			}
 			r = f
@@ -114,26 +132,33 @@ func (server *Server) Post(ctx context.Context, res http.ResponseWriter, req *ht
 		return
 	}
 
-	txn := server.db.NewTransaction(true)
-	defer txn.Discard()
-
 	key := append(parentKey, r.Name())
-	err = server.set(ctx, key, r, txn)
-	if err != nil {
-		res.WriteHeader(500)
+	err = server.write(key, func(txn *badger.Txn) error {
+		err := checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		err = server.set(ctx, key, r, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, r, txn)
+	})
+
+	if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = server.commit(ctx, timestamp, key, r, txn)
-	if err != nil {
-		res.WriteHeader(500)
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = txn.Commit()
-	if err != nil {
+	} else if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
 		return
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Package GETs honor the LDP preferences for which parts of a container to return,
+// as in Prefer: return=representation; include="http://www.w3.org/ns/ldp#PreferMinimalContainer".
+// Including PreferMinimalContainer or omitting PreferMembership leaves out the members
+// (their prov:hadMember triples and descriptions), leaving just the package's own
+// properties. The package document doesn't have ldp:contains triples, so containment
+// triples are only returned if PreferContainment is included. Responses that applied
+// any of these have a Preference-Applied header and are serialized from the catalog.
+
+// parsePrefer returns the preferences and their parameters in the Prefer headers of req
+func parsePrefer(req *http.Request) map[string]string {
+	prefer := map[string]string{}
+	for _, header := range req.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			for _, param := range strings.Split(preference, ";") {
+				name, value := strings.TrimSpace(param), ""
+				if i := strings.IndexByte(name, '='); i != -1 {
+					name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+				}
+				if name != "" {
+					prefer[strings.ToLower(name)] = value
+				}
+			}
+		}
+	}
+	return prefer
+}
+
+// parseView returns the view of a package that req prefers, and the Preference-Applied
+// header for it, which is empty if req doesn't prefer anything but the whole document
+func parseView(req *http.Request) (types.PackageView, string) {
+	prefer := parsePrefer(req)
+	if prefer["return"] != "representation" {
+		return types.FullView, ""
+	}
+
+	var minimal, membership, containment, omitMembership, omitContainment bool
+	var included, omitted []string
+	for _, uri := range strings.Fields(prefer["include"]) {
+		switch uri {
+		case types.LDPPreferMinimalContainer:
+			minimal = true
+		case types.LDPPreferMembership:
+			membership = true
+		case types.LDPPreferContainment:
+			containment = true
+		default:
+			continue
+		}
+		included = append(included, uri)
+	}
+
+	for _, uri := range strings.Fields(prefer["omit"]) {
+		switch uri {
+		case types.LDPPreferMembership:
+			omitMembership = true
+		case types.LDPPreferContainment:
+			omitContainment = true
+		default:
+			continue
+		}
+		omitted = append(omitted, uri)
+	}
+
+	if included == nil && omitted == nil {
+		return types.FullView, ""
+	}
+
+	view := types.PackageView{
+		Membership:  membership || !minimal && !omitMembership,
+		Containment: containment && !omitContainment,
+	}
+
+	applied := "return=representation"
+	if included != nil {
+		applied += `; include="` + strings.Join(included, " ") + `"`
+	}
+	if omitted != nil {
+		applied += `; omit="` + strings.Join(omitted, " ") + `"`
+	}
+
+	return view, applied
+}
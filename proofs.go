@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v2"
+	cid "github.com/ipfs/go-cid"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Proof documents aren't linked from any value directory (a proof signs the package
+// document, which has the value directory in it), so the server keeps a directory of
+// its own with a link to the proof of every package that has one, named by the
+// package's path. It's pinned alongside the root package, and its CID is stored under
+// _proofs. Like events, the changes are collected for each transaction as catalog
+// entries are written, and applied once it commits.
+
+const proofsKey = "_proofs"
+
+// A proofChange sets the proof of the package at a path, or removes it if proof is nil
+type proofChange struct {
+	name  string
+	proof path.Resolved
+}
+
+type proofs struct {
+	mutex   sync.Mutex
+	pending map[*badger.Txn][]*proofChange
+	update  sync.Mutex
+	dir     path.Resolved
+}
+
+func newProofs(db *badger.DB) (*proofs, error) {
+	p := &proofs{pending: map[*badger.Txn][]*proofChange{}, dir: EmptyDirectoryPath}
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(proofsKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			c, err := cid.Cast(val)
+			p.dir = path.IpfsPath(c)
+			return err
+		})
+	})
+	return p, err
+}
+
+// proofName is the name of the link to the proof of the package at key
+func proofName(key []string) string { return url.PathEscape(string(getKey(key))) }
+
+// collectProof collects the change to the proof directory for writing r at key in txn
+func (server *Server) collectProof(txn *badger.Txn, key []string, r types.Resource) {
+	change := &proofChange{name: proofName(key)}
+	if pkg, is := r.(*types.Package); is && pkg.Proof != "" {
+		change.proof = (&types.Assertion{ID: pkg.Proof}).Path()
+	}
+
+	server.proofs.mutex.Lock()
+	defer server.proofs.mutex.Unlock()
+	server.proofs.pending[txn] = append(server.proofs.pending[txn], change)
+}
+
+// discard forgets the changes collected for txn
+func (p *proofs) discard(txn *badger.Txn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.pending, txn)
+}
+
+// applyProofs applies the changes collected for txn, which has committed, to the proof
+// directory. The catalog is already written, so failing isn't an error for the caller.
+func (server *Server) applyProofs(ctx context.Context, txn *badger.Txn) {
+	server.proofs.mutex.Lock()
+	changes := server.proofs.pending[txn]
+	delete(server.proofs.pending, txn)
+	server.proofs.mutex.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+
+	server.proofs.update.Lock()
+	defer server.proofs.update.Unlock()
+	err := server.updateProofs(ctx, changes)
+	if err != nil {
+		log.Println("Error updating the proof directory:", err)
+	}
+}
+
+func (server *Server) updateProofs(ctx context.Context, changes []*proofChange) error {
+	dir, err := server.getDirectory(ctx, server.proofs.dir)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, change := range changes {
+		if change.proof != nil {
+			err = server.setLink(ctx, dir, change.name, change.proof)
+			if err != nil {
+				return err
+			}
+			changed = true
+		} else if dir.RemoveNodeLink(change.name) == nil {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	next, err := server.putDirectory(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	err = server.api.Pin().Update(ctx, server.proofs.dir, next)
+	if err != nil {
+		return err
+	}
+
+	server.proofs.dir = next
+	return server.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(proofsKey), next.Cid().Bytes())
+	})
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// PROPFIND describes resources as WebDAV properties, so that packages can be
+// mounted as network drives: packages are collections, and their members are
+// listed at Depth 1. Depth infinity (which is also what a missing Depth header
+// means) is refused with the propfind-finite-depth precondition of RFC 4918, since
+// a whole catalog is too much for one response. The properties are all derived
+// from the catalog, so there are no dead properties; PROPPATCH can only change a
+// package's dcterms:description. Titles are the last segment of the path, so they're
+// changed with MOVE instead, and setting dcterms:title fails with a description saying so.
+
+const dctermsNamespace = "http://purl.org/dc/terms/"
+
+// ErrInvalidPropfind is returned for PROPFIND requests with an invalid body or Depth header
+var ErrInvalidPropfind = errors.New("Invalid PROPFIND request: expected a propfind element with allprop, propname, or prop, and a Depth of 0 or 1")
+
+// titleDescription is the responsedescription for PROPPATCHes of dcterms:title
+const titleDescription = "Titles are the last segment of the path; use MOVE to change one"
+
+// ErrInvalidProppatch is returned for PROPPATCH requests with an invalid body
+var ErrInvalidProppatch = errors.New("Invalid PROPPATCH request: expected a propertyupdate element")
+
+var (
+	davDisplayName        = xml.Name{Space: "DAV:", Local: "displayname"}
+	davResourceType       = xml.Name{Space: "DAV:", Local: "resourcetype"}
+	davGetETag            = xml.Name{Space: "DAV:", Local: "getetag"}
+	davGetContentLength   = xml.Name{Space: "DAV:", Local: "getcontentlength"}
+	davGetContentType     = xml.Name{Space: "DAV:", Local: "getcontenttype"}
+	davCreationDate       = xml.Name{Space: "DAV:", Local: "creationdate"}
+	davGetLastModified    = xml.Name{Space: "DAV:", Local: "getlastmodified"}
+	davSupportedLock      = xml.Name{Space: "DAV:", Local: "supportedlock"}
+	davLockDiscovery      = xml.Name{Space: "DAV:", Local: "lockdiscovery"}
+	dctermsDescriptionTag = xml.Name{Space: dctermsNamespace, Local: "description"}
+	dctermsTitleTag       = xml.Name{Space: dctermsNamespace, Local: "title"}
+)
+
+const supportedLock = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+	"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+
+// A davProperty is a property name and its value as XML
+type davProperty struct {
+	name  xml.Name
+	value string
+}
+
+// A propResult is the status of one property change in a PROPPATCH
+type propResult struct {
+	name        xml.Name
+	status      int
+	description string
+}
+
+type propfind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type propertyUpdate struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Updates []struct {
+		XMLName xml.Name
+		Prop    struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"DAV: prop"`
+	} `xml:",any"`
+}
+
+func escapeXML(s string) string {
+	buf := bytes.NewBuffer(nil)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// davHTTPDate converts an RFC 3339 timestamp into the HTTP date format that getlastmodified uses
+func davHTTPDate(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// davPath returns the escaped path of key, with a trailing slash for packages
+func davPath(key []string, r types.Resource) string {
+	segments := make([]string, len(key))
+	for i, name := range key {
+		segments[i] = url.PathEscape(name)
+	}
+
+	p := "/" + strings.Join(segments, "/")
+	if _, is := r.(*types.Package); is && len(key) > 0 {
+		p += "/"
+	}
+	return p
+}
+
+// properties returns the properties of the resource r at key
+func (server *Server) properties(key []string, r types.Resource, locks []*davLock) []*davProperty {
+	var discovery string
+	for _, lock := range locks {
+		if lock.covers(key) {
+			data, _ := xml.Marshal(lock.active())
+			discovery += string(data)
+		}
+	}
+
+	name := getName(server.resource)
+	if len(key) > 0 {
+		name = key[len(key)-1]
+	}
+
+	props := []*davProperty{
+		{davDisplayName, escapeXML(name)},
+		{davResourceType, ""},
+		{davGetETag, escapeXML(r.ETag())},
+	}
+
+	var created, modified string
+	switch r := r.(type) {
+	case *types.Package:
+		props[1].value = "<D:collection/>"
+		created, modified = r.Created, r.Modified
+		if r.Description != "" {
+			props = append(props, &davProperty{dctermsDescriptionTag, escapeXML(r.Description)})
+		}
+	case *types.Assertion:
+		created, modified = r.Created, r.Modified
+		props = append(props, &davProperty{davGetContentType, offers[0]})
+	case *types.File:
+		created, modified = r.Created, r.Modified
+		props = append(props,
+			&davProperty{davGetContentType, escapeXML(r.Format)},
+			&davProperty{davGetContentLength, strconv.Itoa(r.Extent)},
+		)
+	}
+
+	if created != "" {
+		props = append(props, &davProperty{davCreationDate, escapeXML(created)})
+	}
+	if date := davHTTPDate(modified); date != "" {
+		props = append(props, &davProperty{davGetLastModified, date})
+	}
+
+	return append(props,
+		&davProperty{davSupportedLock, supportedLock},
+		&davProperty{davLockDiscovery, discovery},
+	)
+}
+
+func writeProperty(buf *bytes.Buffer, name xml.Name, value string) {
+	tag := "D:" + name.Local
+	if name.Space != "DAV:" {
+		fmt.Fprintf(buf, `<%s xmlns="%s">`, name.Local, escapeXML(name.Space))
+		tag = name.Local
+	} else {
+		fmt.Fprintf(buf, "<%s>", tag)
+	}
+	buf.WriteString(value)
+	fmt.Fprintf(buf, "</%s>", tag)
+}
+
+func writePropstat(buf *bytes.Buffer, props []*davProperty, status int, description string) {
+	if len(props) == 0 {
+		return
+	}
+
+	buf.WriteString("<D:propstat><D:prop>")
+	for _, prop := range props {
+		writeProperty(buf, prop.name, prop.value)
+	}
+	fmt.Fprintf(buf, "</D:prop><D:status>HTTP/1.1 %d %s</D:status>", status, http.StatusText(status))
+	if description != "" {
+		fmt.Fprintf(buf, "<D:responsedescription>%s</D:responsedescription>", escapeXML(description))
+	}
+	buf.WriteString("</D:propstat>")
+}
+
+// writeResponse writes the response element for the resource r at key. names is the
+// list of requested properties, or nil for all of them; if values is false, only
+// the names of the properties are written.
+func (server *Server) writeResponse(buf *bytes.Buffer, key []string, r types.Resource, locks []*davLock, names []xml.Name, values bool) {
+	props := server.properties(key, r, locks)
+	found, missing := props, []*davProperty{}
+	if names != nil {
+		found = []*davProperty{}
+		for _, name := range names {
+			var prop *davProperty
+			for _, p := range props {
+				if p.name == name {
+					prop = p
+					break
+				}
+			}
+
+			if prop != nil {
+				found = append(found, prop)
+			} else {
+				missing = append(missing, &davProperty{name: name})
+			}
+		}
+	}
+
+	if !values {
+		for i, prop := range found {
+			found[i] = &davProperty{name: prop.name}
+		}
+	}
+
+	fmt.Fprintf(buf, "<D:response><D:href>%s</D:href>", escapeXML(davPath(key, r)))
+	writePropstat(buf, found, 200, "")
+	writePropstat(buf, missing, 404, "")
+	buf.WriteString("</D:response>")
+}
+
+// resolve returns the resource at key from the catalog or from beneath a mount
+func (server *Server) resolve(ctx context.Context, key []string, txn *badger.Txn) (types.Resource, error) {
+	r, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		return server.getMounted(ctx, key, txn)
+	}
+	return r, err
+}
+
+// walk calls write for the members of pkg, and for their members down to depth
+func (server *Server) walk(ctx context.Context, key []string, pkg *types.Package, depth int, txn *badger.Txn, write func([]string, types.Resource)) error {
+	if depth == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(pkg.Members.Packages)+len(pkg.Members.Assertions)+len(pkg.Members.Files))
+	for _, p := range pkg.Members.Packages {
+		names = append(names, p.Name())
+	}
+	for _, a := range pkg.Members.Assertions {
+		names = append(names, a.Name())
+	}
+	for _, f := range pkg.Members.Files {
+		names = append(names, f.Name())
+	}
+
+	for _, name := range names {
+		childKey := append(key[:len(key):len(key)], name)
+		r, err := server.resolve(ctx, childKey, txn)
+		if err != nil {
+			return err
+		}
+
+		write(childKey, r)
+		if child, is := r.(*types.Package); is {
+			err = server.walk(ctx, childKey, child, depth-1, txn, write)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Propfind handles WebDAV PROPFIND requests
+func (server *Server) Propfind(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	key := types.ParsePath(req.URL.Path)
+
+	var depth int
+	switch req.Header.Get("Depth") {
+	case "0":
+		depth = 0
+	case "1":
+		depth = 1
+	case "", "infinity", "Infinity":
+		res.Header().Add("Content-Type", `application/xml; charset="utf-8"`)
+		res.WriteHeader(403)
+		res.Write([]byte(xml.Header + `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+		return
+	default:
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidPropfind.Error()))
+		return
+	}
+
+	body := &propfind{}
+	err := xml.NewDecoder(req.Body).Decode(body)
+	if err == io.EOF {
+		body.AllProp = &struct{}{}
+	} else if err != nil || body.AllProp == nil && body.PropName == nil && body.Prop == nil {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidPropfind.Error()))
+		return
+	}
+
+	var names []xml.Name
+	if body.Prop != nil {
+		names = make([]xml.Name, len(body.Prop.Names))
+		for i, name := range body.Prop.Names {
+			names[i] = name.XMLName
+		}
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	r, err := server.resolve(ctx, key, txn)
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	locks, _, err := getLocks(txn)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	write := func(key []string, r types.Resource) {
+		server.writeResponse(buf, key, r, locks, names, body.PropName == nil)
+	}
+
+	write(key, r)
+	if pkg, is := r.(*types.Package); is {
+		err = server.walk(ctx, key, pkg, depth, txn, write)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	buf.WriteString("</D:multistatus>")
+
+	res.Header().Add("Content-Type", `application/xml; charset="utf-8"`)
+	res.WriteHeader(207)
+	res.Write(buf.Bytes())
+}
+
+// Proppatch handles WebDAV PROPPATCH requests. Either every change is applied or none are.
+func (server *Server) Proppatch(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	key := types.ParsePath(req.URL.Path)
+	body := &propertyUpdate{}
+	err := xml.NewDecoder(req.Body).Decode(body)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidProppatch.Error()))
+		return
+	}
+
+	timestamp := time.Now().Format(time.RFC3339)
+	var r types.Resource
+	var results []*propResult
+	var failed bool
+	err = server.write(key, func(txn *badger.Txn) (err error) {
+		r, err = getResource(key, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		pkg, _ := r.(*types.Package)
+		description := ""
+		if pkg != nil {
+			description = pkg.Description
+		}
+
+		results, failed = nil, false
+		for _, update := range body.Updates {
+			if update.XMLName.Space != "DAV:" || update.XMLName.Local != "set" && update.XMLName.Local != "remove" {
+				return ErrInvalidProppatch
+			}
+
+			for _, prop := range update.Prop.Values {
+				result := &propResult{name: prop.XMLName, status: 200}
+				if prop.XMLName == dctermsTitleTag {
+					result.status, result.description, failed = 403, titleDescription, true
+				} else if pkg == nil || prop.XMLName != dctermsDescriptionTag {
+					result.status, failed = 403, true
+				} else if update.XMLName.Local == "set" {
+					description = prop.Value
+				} else {
+					description = ""
+				}
+				results = append(results, result)
+			}
+		}
+
+		if failed || pkg == nil || description == pkg.Description {
+			return nil
+		}
+
+		pkg.Description = description
+		pkg.Modified = timestamp
+		pkg.Parent = pkg.ID
+		_, err = server.normalize(ctx, pkg)
+		if err != nil {
+			return err
+		}
+
+		err = server.setEntry(key, pkg, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, pkg, txn)
+	})
+
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf || err == ErrInvalidProppatch {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	// If any change fails, the others fail with 424 Failed Dependency.
+	// Titles get their own propstat, to say how to change them.
+	statuses := map[int][]*davProperty{}
+	titles := []*davProperty{}
+	for _, result := range results {
+		status := result.status
+		if status == 200 && failed {
+			status = 424
+		}
+
+		prop := &davProperty{name: result.name}
+		if result.description == titleDescription {
+			titles = append(titles, prop)
+		} else {
+			statuses[status] = append(statuses[status], prop)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(buf, `<D:multistatus xmlns:D="DAV:"><D:response><D:href>%s</D:href>`, escapeXML(davPath(key, r)))
+	for _, status := range []int{200, 403, 424} {
+		writePropstat(buf, statuses[status], status, "")
+	}
+	writePropstat(buf, titles, 403, titleDescription)
+	buf.WriteString("</D:response></D:multistatus>")
+
+	if !failed {
+		res.Header().Add("ETag", r.ETag())
+	}
+	res.Header().Add("Content-Type", `application/xml; charset="utf-8"`)
+	res.WriteHeader(207)
+	res.Write(buf.Bytes())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestPropfindDepth checks that PROPFIND refuses Depth infinity, and a missing
+// Depth header, with the propfind-finite-depth precondition
+func TestPropfindDepth(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res := do(server, "MKCOL", "/sub", "", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", res.Code, res.Body.String())
+	}
+
+	for _, header := range []map[string]string{nil, {"Depth": "infinity"}} {
+		res = do(server, "PROPFIND", "/", "", header)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("PROPFIND with %v: expected 403, got %d %s", header, res.Code, res.Body.String())
+		} else if !strings.Contains(res.Body.String(), "<D:propfind-finite-depth/>") {
+			t.Errorf("PROPFIND with %v: no propfind-finite-depth element in %s", header, res.Body.String())
+		}
+	}
+
+	res = do(server, "PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	if res.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND with Depth 1: %d %s", res.Code, res.Body.String())
+	} else if !strings.Contains(res.Body.String(), "<D:href>/sub/</D:href>") {
+		t.Errorf("PROPFIND with Depth 1 didn't list /sub: %s", res.Body.String())
+	}
+}
+
+// TestProppatchTitle checks that PROPPATCH refuses to set dcterms:title and says to use MOVE
+func TestProppatchTitle(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res := do(server, "MKCOL", "/sub", "", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", res.Code, res.Body.String())
+	}
+
+	body := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:dc="http://purl.org/dc/terms/">` +
+		`<D:set><D:prop><dc:title>renamed</dc:title><dc:description>new</dc:description></D:prop></D:set></D:propertyupdate>`
+	res = do(server, "PROPPATCH", "/sub", body, map[string]string{"Content-Type": "application/xml"})
+	if res.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPPATCH: %d %s", res.Code, res.Body.String())
+	}
+
+	s := res.Body.String()
+	if !strings.Contains(s, "403 Forbidden</D:status><D:responsedescription>"+titleDescription) {
+		t.Errorf("PROPPATCH of the title didn't fail with a description: %s", s)
+	} else if !strings.Contains(s, "424 Failed Dependency") {
+		t.Errorf("PROPPATCH of the description didn't fail with 424: %s", s)
+	}
+
+	res = do(server, "GET", "/sub", "", map[string]string{"Accept": "application/ld+json"})
+	if strings.Contains(res.Body.String(), "renamed") || strings.Contains(res.Body.String(), `"new"`) {
+		t.Errorf("PROPPATCH changed the package: %s", res.Body.String())
+	}
+}
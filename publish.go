@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// When the server's resource is the IPNS name of the node's own key, every new
+// root package is published under that name so that the resource actually resolves.
+// Commits usually come in bursts, so publishing waits until the root has been
+// quiet for ipnsDelay and then publishes only the latest revision. Under steady
+// writes the root is never quiet, so it's also published once the oldest
+// unpublished change is ipnsMaxDelay old.
+
+// Publish either the root package's value directory or its package document
+const (
+	publishValue   = "value"
+	publishPackage = "package"
+)
+
+var ipnsDelay = 10 * time.Second
+var ipnsMaxDelay = time.Minute
+var ipnsTimeout = 5 * time.Minute
+
+type publisher struct {
+	server   *Server
+	target   string
+	lifetime time.Duration
+	ttl      time.Duration
+	trigger  chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// publishIPNS starts publishing the root package (target is publishValue or
+// publishPackage) under the node's own key, with the given record lifetime and TTL.
+func (server *Server) publishIPNS(target string, lifetime, ttl time.Duration) {
+	p := &publisher{
+		server:   server,
+		target:   target,
+		lifetime: lifetime,
+		ttl:      ttl,
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	server.pins.Lock()
+	server.ipns = p
+	server.pins.Unlock()
+
+	p.wg.Add(1)
+	go p.run()
+	p.Trigger()
+}
+
+// Trigger schedules a publish of the current root
+func (p *publisher) Trigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops publishing. A publish that was still waiting is dropped;
+// the root is published again the next time the server starts.
+func (p *publisher) Close() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *publisher) run() {
+	defer p.wg.Done()
+	timer := time.NewTimer(ipnsDelay)
+	timer.Stop()
+
+	// pending is when the oldest change that hasn't been published was triggered
+	var pending time.Time
+	for {
+		select {
+		case <-p.done:
+			timer.Stop()
+			return
+		case <-p.trigger:
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+
+			if pending.IsZero() {
+				pending = time.Now()
+			}
+
+			delay := ipnsDelay
+			if left := ipnsMaxDelay - time.Since(pending); left < delay {
+				delay = left
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			pending = time.Time{}
+			err := p.publish()
+			if err != nil {
+				log.Println("Error publishing root package to IPNS:", err)
+			}
+		}
+	}
+}
+
+func (p *publisher) publish() error {
+	p.server.pins.Lock()
+	var target path.Path = p.server.value
+	if p.target == publishPackage {
+		target = p.server.id
+	}
+	p.server.pins.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipnsTimeout)
+	defer cancel()
+
+	entry, err := p.server.api.Name().Publish(
+		ctx,
+		target,
+		options.Name.ValidTime(p.lifetime),
+		options.Name.TTL(p.ttl),
+		options.Name.AllowOffline(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published %s to /ipns/%s\n", entry.Value().String(), entry.Name())
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPublishMaxDelay checks that the root is published at least every ipnsMaxDelay
+// while writes keep coming in faster than ipnsDelay
+func TestPublishMaxDelay(t *testing.T) {
+	delay, maxDelay := ipnsDelay, ipnsMaxDelay
+	ipnsDelay, ipnsMaxDelay = 100*time.Millisecond, 300*time.Millisecond
+	t.Cleanup(func() { ipnsDelay, ipnsMaxDelay = delay, maxDelay })
+
+	server, api := newTestServer(t)
+	server.publishIPNS(publishValue, time.Hour, time.Minute)
+
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(20 * time.Millisecond) {
+		server.ipns.Trigger()
+	}
+
+	api.mutex.Lock()
+	published := len(api.published)
+	api.mutex.Unlock()
+	if published < 2 {
+		t.Errorf("published %d times in a second of steady writes, expected at least 2", published)
+	}
+
+	// Once the writes stop, the last one is published after ipnsDelay
+	time.Sleep(2 * ipnsDelay)
+	api.mutex.Lock()
+	if len(api.published) == published {
+		t.Error("the last write wasn't published")
+	}
+	api.mutex.Unlock()
+}
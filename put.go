@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"time"
 
+	badger "github.com/dgraph-io/badger/v2"
 	files "github.com/ipfs/go-ipfs-files"
 	ld "github.com/piprate/json-gold/ld"
 	rdf "github.com/underlay/go-rdfjs"
@@ -19,9 +21,15 @@ import (
 func (server *Server) Put(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	self, t := types.ParseLinks(req.Header["Link"])
 	key := types.ParsePath(req.URL.Path)
+	if isArchive(req.Header.Get("Content-Type")) {
+		server.putArchive(ctx, res, req, key, false)
+		return
+	}
+
 	var name string
+	parentKey := key
 	if len(key) > 0 {
-		name = key[len(key)-1]
+		name, parentKey = key[len(key)-1], key[:len(key)-1]
 	}
 
 	resource := types.GetURI(server.resource, key)
@@ -41,15 +49,50 @@ func (server *Server) Put(ctx context.Context, res http.ResponseWriter, req *htt
 				return
 			}
 			break
+		} else if format == carFormat && self != "" && types.PackageURIPattern.MatchString(self) {
+			reference := &types.Reference{ID: self, Resource: resource, Title: name}
+			imported, err := server.importCAR(ctx, req.Body)
+			if errors.Is(err, ErrInvalidCAR) || err == ErrIncompleteCAR {
+				res.WriteHeader(400)
+				res.Write([]byte(err.Error()))
+				return
+			} else if err != nil {
+				res.WriteHeader(502)
+				res.Write([]byte(err.Error()))
+				return
+			} else if !imported[reference.Path().Cid()] {
+				res.WriteHeader(400)
+				res.Write([]byte(ErrIncompleteCAR.Error()))
+				return
+			}
+
+			pkg, err := server.parse(ctx, reference)
+			if err != nil {
+				res.WriteHeader(400)
+				res.Write([]byte(err.Error()))
+				return
+			} else if value := pkg.ValuePath(); value == nil || !imported[value.Cid()] {
+				res.WriteHeader(400)
+				res.Write([]byte(ErrIncompleteCAR.Error()))
+				return
+			}
+
+			err = server.checkSizes(ctx, key, pkg)
+			if err != nil {
+				res.WriteHeader(uploadStatus(err))
+				res.Write([]byte(err.Error()))
+				return
+			}
+			r = pkg
 		} else if format == offers[0] || format == offers[1] || format == offers[2] {
-			doc, err := parseDocument(format, resource, req.Body)
+			dataset, err := parseDataset(format, resource, req.Body)
 			if err != nil {
 				res.WriteHeader(400)
 				res.Write([]byte(err.Error()))
 				return
 			}
 
-			pkg, err := server.framePackage(resource, doc)
+			pkg, err := readDataset(dataset)
 			if err != nil {
 				res.WriteHeader(400)
 				res.Write([]byte(err.Error()))
@@ -137,10 +180,18 @@ func (server *Server) Put(ctx context.Context, res http.ResponseWriter, req *htt
 			f.Extent = stat.CumulativeSize
 			r = f
 		} else if format != "" {
+			body, err := server.newUploadBody(parentKey, req.Header, req.ContentLength, req.Body)
+			if err != nil {
+				res.WriteHeader(uploadStatus(err))
+				res.Write([]byte(err.Error()))
+				return
+			}
+
 			f := &types.File{Resource: resource, Title: name, Created: timestamp, Modified: timestamp, Format: format}
-			err := server.setFile(ctx, f, files.NewReaderFile(req.Body))
+			err = server.addFile(ctx, f, body)
 			if err != nil {
-				res.WriteHeader(502)
+				res.WriteHeader(uploadStatus(err))
+				res.Write([]byte(err.Error()))
 				return
 			}
 			r = f
@@ -153,25 +204,37 @@ func (server *Server) Put(ctx context.Context, res http.ResponseWriter, req *htt
 		return
 	}
 
-	txn := server.db.NewTransaction(true)
-	defer txn.Discard()
+	err = server.write(key, func(txn *badger.Txn) error {
+		err := checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkPreconditions(req, key, txn)
+		if err != nil {
+			return err
+		}
 
-	err = server.set(ctx, key, r, txn)
-	if err != nil {
-		res.WriteHeader(500)
+		err = server.set(ctx, key, r, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, r, txn)
+	})
+
+	if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = server.commit(ctx, timestamp, key, r, txn)
-	if err != nil {
-		res.WriteHeader(500)
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
 		res.Write([]byte(err.Error()))
 		return
-	}
-
-	err = txn.Commit()
-	if err != nil {
+	} else if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
 		return
@@ -182,33 +245,6 @@ func (server *Server) Put(ctx context.Context, res http.ResponseWriter, req *htt
 	res.WriteHeader(204)
 }
 
-func parseDocument(format string, base string, body io.Reader) (doc interface{}, err error) {
-	if format == offers[0] {
-		opts := ld.NewJsonLdOptions(base)
-		opts.Format = format
-		doc, err = ld.NewJsonLdProcessor().FromRDF(body, opts)
-	} else if format == offers[1] {
-		err = json.NewDecoder(body).Decode(&doc)
-		if err != nil {
-			return
-		}
-	} else if format == offers[2] {
-		var quads []*rdf.Quad
-		err = json.NewDecoder(body).Decode(&quads)
-		if err != nil {
-			return
-		}
-		dataset := styx.ToRDFDataset(quads)
-		opts := ld.NewJsonLdOptions(base)
-		doc, err = ld.NewJsonLdApi().FromRDF(dataset, opts)
-		if err != nil {
-			return
-		}
-	}
-
-	return
-}
-
 func parseDataset(format string, base string, body io.Reader) (dataset *ld.RDFDataset, err error) {
 	if format == offers[0] {
 		dataset, err = ld.ParseNQuadsFrom(body)
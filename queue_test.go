@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	rpc "github.com/underlay/pkgs/rpc"
+)
+
+// waitQueue waits for the test index's queue to be empty and returns its status
+func waitQueue(t *testing.T, server *Server) *rpc.IndexStatus {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		statuses, err := server.queue.Status(true)
+		if err != nil {
+			t.Fatal(err)
+		} else if statuses[0].Lag == 0 {
+			return statuses[0]
+		}
+	}
+	t.Fatal("timed out waiting for the queue")
+	return nil
+}
+
+// TestQueueRetry checks that a failing operation is retried with exponential backoff,
+// that it's applied if it starts working, and that it's dead-lettered after
+// MaxAttempts without holding up the operations behind it
+func TestQueueRetry(t *testing.T) {
+	attempts, backoff := rpc.MaxAttempts, rpc.MinBackoff
+	rpc.MaxAttempts, rpc.MinBackoff = 3, 20*time.Millisecond
+	defer func() { rpc.MaxAttempts, rpc.MinBackoff = attempts, backoff }()
+
+	index := newTestIndex()
+	server, _ := newTestServerWithIndices(t, index)
+
+	put := func(p string) {
+		t.Helper()
+		res := putFile(server, p, "hello\n", nil)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	index.mutex.Lock()
+	index.fail = "/a.txt"
+	index.mutex.Unlock()
+	put("/a.txt")
+
+	// Let the first attempt fail, and the retry succeed
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		index.mutex.Lock()
+		failed := len(index.failures) > 0
+		if failed {
+			index.fail = ""
+		}
+		index.mutex.Unlock()
+		if failed {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the first attempt")
+		}
+	}
+
+	index.wait(t, true, "/a.txt")
+	if status := waitQueue(t, server); status.Dead != 0 {
+		t.Errorf("expected no dead-lettered operations, got %d", status.Dead)
+	}
+
+	index.mutex.Lock()
+	index.fail, index.failures = "/b.txt", nil
+	index.mutex.Unlock()
+	put("/b.txt")
+	put("/c.txt")
+
+	index.wait(t, true, "/c.txt")
+	status := waitQueue(t, server)
+	if status.Dead != 1 {
+		t.Fatalf("expected 1 dead-lettered operation, got %d", status.Dead)
+	}
+
+	op := status.Failures[0]
+	if strings.Join(op.Key, "/") != "b.txt" || op.Attempts != 3 || !strings.Contains(op.Error, "can't set /b.txt") {
+		t.Errorf("unexpected dead-lettered operation %+v", op)
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if _, has := index.resources["/b.txt"]; has {
+		t.Error("the failing operation was applied")
+	}
+
+	if len(index.failures) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(index.failures))
+	}
+	for i := 1; i < len(index.failures); i++ {
+		gap, min := index.failures[i].Sub(index.failures[i-1]), rpc.MinBackoff<<uint(i-1)
+		if gap < min {
+			t.Errorf("attempt %d was %s after the one before, expected at least %s", i+1, gap, min)
+		}
+	}
+}
+
+// TestQueueRestart checks that operations that are still queued when the queue is
+// closed are applied when it starts again
+func TestQueueRestart(t *testing.T) {
+	backoff := rpc.MinBackoff
+	rpc.MinBackoff = time.Hour
+	defer func() { rpc.MinBackoff = backoff }()
+
+	index := newTestIndex()
+	index.fail = "/a.txt"
+	server, _ := newTestServerWithIndices(t, index)
+
+	for _, p := range []string{"/a.txt", "/b.txt"} {
+		res := putFile(server, p, "hello\n", nil)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	// The worker backs off for an hour after the first attempt, so closing
+	// the queue leaves both operations in it
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		index.mutex.Lock()
+		failed := len(index.failures) > 0
+		index.mutex.Unlock()
+		if failed {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the first attempt")
+		}
+	}
+
+	server.queue.Close()
+
+	statuses, err := server.queue.Status(false)
+	if err != nil {
+		t.Fatal(err)
+	} else if statuses[0].Lag != 2 {
+		t.Fatalf("expected 2 queued operations, got %d", statuses[0].Lag)
+	}
+
+	index.mutex.Lock()
+	index.fail = ""
+	index.mutex.Unlock()
+
+	server.queue, err = rpc.NewQueue(server.db, server.api)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.wait(t, true, "/a.txt", "/b.txt")
+	if status := waitQueue(t, server); status.Dead != 0 {
+		t.Errorf("expected no dead-lettered operations, got %d", status.Dead)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// readDataset reads a package from a parsed request body
+func readDataset(dataset *ld.RDFDataset) (*types.Package, error) {
+	opts := ld.NewJsonLdOptions("")
+	opts.Format = "application/n-quads"
+	normalized, err := ld.NewNormalisationAlgorithm("URDNA2015").Main(dataset, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	quads, err := rdf.ReadQuads(strings.NewReader(normalized.(string)))
+	if err != nil {
+		return nil, err
+	}
+
+	return types.ReadPackage(quads)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestReadPackage checks that reading a package document back from IPFS
+// gives the package that was written
+func TestReadPackage(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res := do(server, "MKCOL", "/sub", "", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", res.Code, res.Body.String())
+	}
+
+	for _, p := range []string{"/sub/b.txt", "/sub/a.txt"} {
+		res = putFile(server, p, p+"\n", nil)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	for _, key := range [][]string{nil, {"sub"}} {
+		expected, err := getPackage(key, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref := &types.Reference{ID: expected.ID, Resource: expected.Resource}
+		actual, err := server.parse(context.Background(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Parent == "" || actual.Value.ID == "" {
+			t.Errorf("%v: the parent or value is missing: %+v", key, actual)
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%v: read %+v, expected %+v", key, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	indices "github.com/underlay/pkgs/indices"
+	rpc "github.com/underlay/pkgs/rpc"
+	types "github.com/underlay/pkgs/types"
+)
+
+// ErrReindexing is returned when a reindex is requested while another one is running
+var ErrReindexing = errors.New("A reindex is already running")
+
+// ErrUnknownIndex is returned when a reindex is requested for an index that doesn't exist
+var ErrUnknownIndex = errors.New("Unknown index")
+
+// reindexStatus reports the progress of a reindex.
+// Index is empty if every index is being rebuilt.
+type reindexStatus struct {
+	Index    string `json:"index,omitempty"`
+	Running  bool   `json:"running"`
+	Total    int    `json:"total"`
+	Done     int    `json:"done"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+	Started  string `json:"started"`
+	Finished string `json:"finished,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+const reindexLogInterval = 1000
+
+// reindex starts replaying Index.Set for every resource in the catalog, either into
+// the index with the given name or into every index if name is empty. It returns
+// immediately; the returned channel is closed when the reindex is done.
+//
+// Indices that implement indices.Clearer are cleared first, so that resources that
+// are no longer in the catalog don't survive the reindex; indices.Rebuilders keep
+// answering queries from their old copy until the replay is done. Dead-lettered operations
+// are only discarded if every resource was reindexed.
+//
+// Reindexing reads from a snapshot and doesn't take the server mutex, so writes
+// aren't blocked. Resources that change after the snapshot was taken are skipped,
+// since the write that changed them also queued operations for the indices.
+func (server *Server) reindex(ctx context.Context, name string) (<-chan struct{}, error) {
+	targets := rpc.INDICES
+	if name != "" {
+		index := rpc.GetIndex(name)
+		if index == nil {
+			return nil, ErrUnknownIndex
+		}
+		targets = []indices.Index{index}
+	}
+
+	server.reindexMutex.Lock()
+	defer server.reindexMutex.Unlock()
+	if server.reindexing != nil && server.reindexing.Running {
+		return nil, ErrReindexing
+	}
+
+	started := time.Now().Format(time.RFC3339)
+	server.reindexing = &reindexStatus{Index: name, Running: true, Started: started}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		for _, index := range targets {
+			err = server.queue.Clear(index.Name())
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			err = server.replay(ctx, targets)
+		}
+
+		// Indices that rebuild into a new copy swap it in now, or discard it
+		for _, index := range targets {
+			rebuiltErr := server.queue.Rebuilt(index.Name(), err == nil)
+			if err == nil {
+				err = rebuiltErr
+			}
+		}
+
+		server.reindexMutex.Lock()
+		failed := server.reindexing.Failed
+		server.reindexMutex.Unlock()
+
+		if err == nil && failed == 0 {
+			// Operations that failed before the reindex are superseded by it,
+			// but only if every resource was reindexed
+			for _, index := range targets {
+				err = server.queue.ClearDead(index.Name())
+				if err != nil {
+					break
+				}
+			}
+		}
+
+		server.reindexMutex.Lock()
+		defer server.reindexMutex.Unlock()
+		status := server.reindexing
+		status.Running = false
+		status.Finished = time.Now().Format(time.RFC3339)
+		if err != nil {
+			status.Error = err.Error()
+			log.Println("Reindex failed:", err)
+		} else {
+			log.Printf("Reindex done: %d resources, %d skipped, %d failed\n", status.Done, status.Skipped, status.Failed)
+		}
+	}()
+
+	return done, nil
+}
+
+// progress updates the reindex status under the lock
+func (server *Server) progress(f func(status *reindexStatus)) {
+	server.reindexMutex.Lock()
+	defer server.reindexMutex.Unlock()
+	f(server.reindexing)
+}
+
+func (server *Server) replay(ctx context.Context, targets []indices.Index) error {
+	snapshot := server.db.NewTransaction(false)
+	defer snapshot.Discard()
+
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = []byte("/")
+
+	total := 0
+	iterOpts.PrefetchValues = false
+	iter := snapshot.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		total++
+	}
+	iter.Close()
+
+	server.progress(func(status *reindexStatus) { status.Total = total })
+	log.Printf("Reindexing %d resources\n", total)
+
+	iterOpts.PrefetchValues = true
+	iter = snapshot.NewIterator(iterOpts)
+	defer iter.Close()
+
+	n := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		key := types.ParsePath(string(item.Key()))
+
+		var skip bool
+		r, err := readResource(item)
+		if err == nil {
+			skip, err = server.replayItem(item, func() error {
+				return rpc.Reindex(key, r, server.api, targets...)
+			}, targets)
+		}
+		if err == nil && !skip {
+			skip, err = server.reindexMounted(ctx, key, item, r, snapshot, targets)
+		}
+		if err != nil {
+			log.Printf("Error reindexing /%s: %s\n", string(item.Key()[1:]), err.Error())
+		}
+
+		server.progress(func(status *reindexStatus) {
+			status.Done++
+			if skip {
+				status.Skipped++
+			} else if err != nil {
+				status.Failed++
+			}
+		})
+
+		if n++; n%reindexLogInterval == 0 {
+			log.Printf("Reindexed %d of %d resources\n", n, total)
+		}
+	}
+
+	return nil
+}
+
+// reindexMounted replays Index.Set for the members beneath r if it's a mount,
+// since they aren't in the catalog. item is r's catalog entry; it reports whether
+// the mount changed before its members were replayed.
+func (server *Server) reindexMounted(ctx context.Context, key []string, item *badger.Item, r types.Resource, snapshot *badger.Txn, targets []indices.Index) (bool, error) {
+	pkg, is := r.(*types.Package)
+	if !is {
+		return false, nil
+	}
+
+	mounted, err := isMounted(key, snapshot)
+	if err != nil || !mounted {
+		return false, err
+	}
+
+	var skip bool
+	err = server.walkMounted(ctx, key, pkg, func(key []string, r types.Resource) (err error) {
+		if !skip {
+			skip, err = server.replayItem(item, func() error {
+				return rpc.Reindex(key, r, server.api, targets...)
+			}, targets)
+		}
+		return
+	})
+	return skip, err
+}
+
+// replayItem calls f, which writes to the target indices, unless the catalog entry
+// item has been written or deleted since the snapshot, and reports whether it was
+// skipped. The check and f run while the queue isn't applying operations to the
+// targets, so an operation queued by a newer write is always applied after f.
+func (server *Server) replayItem(item *badger.Item, f func() error, targets []indices.Index) (skip bool, err error) {
+	err = server.queue.Exclusive(targets, func() error {
+		skip, err = server.changed(item)
+		if err != nil || skip {
+			return err
+		}
+		return f()
+	})
+	return
+}
+
+// changed reports whether the item has been written or deleted since the snapshot
+func (server *Server) changed(item *badger.Item) (bool, error) {
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+	current, err := txn.Get(item.Key())
+	if err == badger.ErrKeyNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return current.Version() != item.Version(), nil
+}
+
+// Reindex handles requests to /_admin/reindex. GET returns the status of the current
+// (or last) reindex, and POST starts a new one, optionally for the index named by the
+// "index" query parameter.
+func (server *Server) Reindex(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		_, err := server.reindex(context.Background(), req.URL.Query().Get("index"))
+		if err == ErrUnknownIndex {
+			res.WriteHeader(404)
+			res.Write([]byte(err.Error()))
+			return
+		} else if err == ErrReindexing {
+			res.WriteHeader(409)
+			res.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	} else if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+
+	server.reindexMutex.Lock()
+	var status reindexStatus
+	if server.reindexing != nil {
+		status = *server.reindexing
+	}
+	server.reindexMutex.Unlock()
+
+	if req.Method == "GET" && status.Started == "" {
+		res.WriteHeader(404)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if req.Method == "POST" {
+		res.WriteHeader(202)
+	}
+	json.NewEncoder(res).Encode(status)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	rpc "github.com/underlay/pkgs/rpc"
+)
+
+// TestReindexClears checks that a reindex removes resources that aren't in the
+// catalog anymore, and only discards dead-lettered operations if it succeeds
+func TestReindexClears(t *testing.T) {
+	attempts, backoff := rpc.MaxAttempts, rpc.MinBackoff
+	rpc.MaxAttempts, rpc.MinBackoff = 1, time.Millisecond
+	defer func() { rpc.MaxAttempts, rpc.MinBackoff = attempts, backoff }()
+
+	index := newTestIndex()
+	index.fail = "/b.txt"
+	server, _ := newTestServerWithIndices(t, index)
+
+	for _, p := range []string{"/a.txt", "/b.txt"} {
+		res := putFile(server, p, "hello\n", nil)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+	index.wait(t, true, "/a.txt")
+
+	dead := func() int {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			statuses, err := server.queue.Status(false)
+			if err != nil {
+				t.Fatal(err)
+			} else if statuses[0].Lag == 0 {
+				return statuses[0].Dead
+			}
+		}
+		t.Fatal("timed out waiting for the queue")
+		return 0
+	}
+
+	if n := dead(); n != 1 {
+		t.Fatalf("expected 1 dead-lettered operation, got %d", n)
+	}
+
+	index.mutex.Lock()
+	index.resources["/stale.txt"] = "stale"
+	index.mutex.Unlock()
+
+	reindex := func() {
+		t.Helper()
+		done, err := server.reindex(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+
+	reindex()
+	index.wait(t, false, "/stale.txt")
+	index.wait(t, true, "/", "/a.txt")
+	if server.reindexing.Failed != 1 {
+		t.Errorf("expected 1 failure, got %d", server.reindexing.Failed)
+	}
+	if n := dead(); n != 1 {
+		t.Errorf("a reindex with failures discarded the dead-lettered operations; %d left", n)
+	}
+
+	index.mutex.Lock()
+	index.fail = ""
+	index.mutex.Unlock()
+
+	reindex()
+	index.wait(t, true, "/", "/a.txt", "/b.txt")
+	if n := dead(); n != 0 {
+		t.Errorf("expected no dead-lettered operations after a reindex, got %d", n)
+	}
+}
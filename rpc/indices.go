@@ -1,8 +1,8 @@
 package rpc
 
 import (
+	"fmt"
 	"log"
-	"sync"
 
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	rdf "github.com/underlay/go-rdfjs"
@@ -24,95 +24,81 @@ var INDICES = []indices.Index{
 // RULES is the built-in set of generators
 var RULES = []indices.Rule{}
 
-// Delete a resource from all indices
-func Delete(key []string, resource types.Resource, api iface.CoreAPI) {
-	var dataset []*rdf.Quad
-	var store *styx.Store
-	switch resource := resource.(type) {
-	case *types.Assertion:
-		dataset = resource.GetDataset(api)
-
-		var err error
-		store, err = styx.NewMemoryStore(nil)
-		if err != nil {
-			log.Println("Error creating memory store:", err)
-			log.Println("Closing store:", store.Close())
-			return
-		}
-
-		err = store.Set(rdf.Default, dataset)
-		if err != nil {
-			log.Println("Error setting assertion in memory store:", err)
-			log.Println("Closing store:", store.Close())
-			return
+// GetIndex returns the index with the given name, or nil if there isn't one
+func GetIndex(name string) indices.Index {
+	for _, index := range INDICES {
+		if index.Name() == name {
+			return index
 		}
 	}
+	return nil
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(INDICES))
-	for _, index := range INDICES {
-		go setIndex(false, key, resource, index, dataset, store, &wg)
+// Reindex sets a resource in the given indices (or all of them, if there are none given)
+// immediately, bypassing the queue, and returns the first error.
+func Reindex(key []string, resource types.Resource, api iface.CoreAPI, targets ...indices.Index) error {
+	if len(targets) == 0 {
+		targets = INDICES
 	}
 
-	wg.Wait()
-	if store != nil {
-		store.Close()
+	dataset, store, err := prepare(resource, api)
+	if err != nil {
+		return err
+	} else if store != nil {
+		defer store.Close()
 	}
-}
 
-// Set a resource in all the indices
-func Set(key []string, resource types.Resource, api iface.CoreAPI) {
-	var store *styx.Store
-	var dataset []*rdf.Quad
-	switch resource := resource.(type) {
-	case *types.Assertion:
-		dataset = resource.GetDataset(api)
-
-		var err error
-		store, err = styx.NewMemoryStore(nil)
+	for _, index := range targets {
+		err = index.Set(key, resource, dataset, store)
 		if err != nil {
-			log.Println("Error creating memory store:", err)
-			log.Println("Closing store:", store.Close())
-			return
+			return fmt.Errorf("%s: %s", index.Name(), err.Error())
 		}
+	}
 
-		err = store.Set(rdf.Default, dataset)
-		if err != nil {
-			log.Println("Error setting assertion in memory store:", err)
-			log.Println("Closing store:", store.Close())
-			return
-		}
+	return nil
+}
+
+// prepare loads the dataset of an assertion into a memory store for the indices
+func prepare(resource types.Resource, api iface.CoreAPI) ([]*rdf.Quad, *styx.Store, error) {
+	a, is := resource.(*types.Assertion)
+	if !is {
+		return nil, nil, nil
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(INDICES))
-	for _, index := range INDICES {
-		go setIndex(true, key, resource, index, dataset, store, &wg)
+	dataset := a.GetDataset(api)
+	store, err := styx.NewMemoryStore(nil)
+	if err != nil {
+		log.Println("Error creating memory store:", err)
+		return nil, nil, err
 	}
 
-	wg.Wait()
-	if store != nil {
-		store.Close()
+	err = store.Set(rdf.Default, dataset)
+	if err != nil {
+		log.Println("Error setting assertion in memory store:", err)
+		log.Println("Closing store:", store.Close())
+		return nil, nil, err
 	}
+
+	return dataset, store, nil
 }
 
-func setIndex(
-	set bool,
-	key []string, resource types.Resource,
-	index indices.Index,
-	dataset []*rdf.Quad, store *styx.Store,
-	wg *sync.WaitGroup,
-) {
-	defer wg.Done()
-	var err error
-	if set {
-		err = index.Set(key, resource, dataset, store)
-	} else {
-		err = index.Delete(key, resource, dataset, store)
+// Check a resource against every index that implements indices.Checker,
+// returning the discrepancies by index name
+func Check(key []string, resource types.Resource, api iface.CoreAPI) map[string]error {
+	var dataset []*rdf.Quad
+	if a, is := resource.(*types.Assertion); is {
+		dataset = a.GetDataset(api)
 	}
 
-	if err != nil {
-		log.Printf("Error setting index %s: %s\n", index.Name(), err.Error())
-		return
+	errs := map[string]error{}
+	for _, index := range INDICES {
+		if checker, is := index.(indices.Checker); is {
+			err := checker.Check(key, resource, dataset)
+			if err != nil {
+				errs[index.Name()] = err
+			}
+		}
 	}
+
+	return errs
 }
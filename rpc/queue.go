@@ -0,0 +1,436 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+
+	indices "github.com/underlay/pkgs/indices"
+	types "github.com/underlay/pkgs/types"
+)
+
+// Index operations are queued in badger under _queue/{index}/{seq}, in the same
+// transaction as the catalog change that causes them, so they're never lost and never
+// applied for changes that weren't committed. Each index has its own worker that applies
+// its operations in order and deletes them. An operation that keeps failing is moved to
+// _dead/{index}/{seq} so that the rest of the queue can make progress.
+
+const (
+	queuePrefix = "_queue/"
+	deadPrefix  = "_dead/"
+	sequenceKey = "_seq/queue"
+)
+
+// MaxAttempts is the number of times an operation is tried before it's dead-lettered
+var MaxAttempts = 8
+
+// MinBackoff and MaxBackoff bound the delay between attempts
+var MinBackoff, MaxBackoff = time.Second, time.Minute
+
+// PollInterval is how often workers check their queues if nobody wakes them up
+var PollInterval = 5 * time.Second
+
+// An Operation is a queued Set or Delete of a resource in an index
+type Operation struct {
+	Delete   bool               `json:"delete,omitempty"`
+	Key      []string           `json:"key"`
+	Type     types.ResourceType `json:"type"`
+	Resource json.RawMessage    `json:"resource"`
+	Queued   string             `json:"queued"`
+	Attempts int                `json:"attempts,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// IndexStatus reports the state of one index's queue
+type IndexStatus struct {
+	Name      string       `json:"name"`
+	Lag       int          `json:"lag"`
+	Oldest    string       `json:"oldest,omitempty"`
+	Processed int          `json:"processed"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"lastError,omitempty"`
+	Dead      int          `json:"dead"`
+	Failures  []*Operation `json:"failures,omitempty"`
+}
+
+// A Queue applies index operations in the background
+type Queue struct {
+	db       *badger.DB
+	api      iface.CoreAPI
+	sequence *badger.Sequence
+	workers  []*worker
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type worker struct {
+	index     indices.Index
+	wake      chan struct{}
+	applying  sync.Mutex
+	mutex     sync.Mutex
+	processed int
+	attempts  int
+	lastError string
+}
+
+// NewQueue starts a worker for every index in INDICES
+func NewQueue(db *badger.DB, api iface.CoreAPI) (*Queue, error) {
+	sequence, err := db.GetSequence([]byte(sequenceKey), 100)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{db: db, api: api, sequence: sequence, done: make(chan struct{})}
+	for _, index := range INDICES {
+		w := &worker{index: index, wake: make(chan struct{}, 1)}
+		q.workers = append(q.workers, w)
+		q.wg.Add(1)
+		go q.run(w)
+	}
+
+	return q, nil
+}
+
+// Close stops the workers. Operations still in the queue are applied after the next start.
+func (q *Queue) Close() {
+	close(q.done)
+	q.wg.Wait()
+	q.sequence.Release()
+}
+
+// Wake tells every worker to check its queue. Call it after committing a transaction
+// that enqueued operations.
+func (q *Queue) Wake() {
+	for _, w := range q.workers {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Set queues a Set of the resource at key in every index
+func (q *Queue) Set(key []string, resource types.Resource, txn *badger.Txn) error {
+	return q.enqueue(false, key, resource, txn)
+}
+
+// Delete queues a Delete of the resource at key from every index
+func (q *Queue) Delete(key []string, resource types.Resource, txn *badger.Txn) error {
+	return q.enqueue(true, key, resource, txn)
+}
+
+func (q *Queue) enqueue(delete bool, key []string, resource types.Resource, txn *badger.Txn) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+
+	op := &Operation{
+		Delete:   delete,
+		Key:      key,
+		Type:     resource.T(),
+		Resource: data,
+		Queued:   time.Now().Format(time.RFC3339),
+	}
+
+	value, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	seq, err := q.sequence.Next()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range q.workers {
+		err = txn.Set(operationKey(queuePrefix, w.index.Name(), seq), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// operationKey appends the big-endian sequence number, so that operations sort in queue order
+func operationKey(prefix, name string, seq uint64) []byte {
+	key := make([]byte, len(prefix)+len(name)+1+8)
+	n := copy(key, prefix+name+"/")
+	binary.BigEndian.PutUint64(key[n:], seq)
+	return key
+}
+
+func (q *Queue) run(w *worker) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		for q.next(w) {
+		}
+
+		select {
+		case <-q.done:
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// next tries to apply the operation at the head of the worker's queue.
+// It returns false if the queue is empty or the queue is closing.
+func (q *Queue) next(w *worker) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	key, op, err := q.head(queuePrefix + w.index.Name() + "/")
+	if err != nil {
+		log.Printf("Error reading %s index queue: %s\n", w.index.Name(), err.Error())
+		return false
+	} else if op == nil {
+		return false
+	}
+
+	w.applying.Lock()
+	err = q.apply(w.index, op)
+	w.applying.Unlock()
+	if err == nil {
+		err = q.db.Update(func(txn *badger.Txn) error { return txn.Delete(key) })
+		if err != nil {
+			log.Printf("Error updating %s index queue: %s\n", w.index.Name(), err.Error())
+			return false
+		}
+
+		w.mutex.Lock()
+		w.processed++
+		w.attempts = 0
+		w.mutex.Unlock()
+		return true
+	}
+
+	log.Printf("Error applying %s index operation for /%s: %s\n", w.index.Name(), strings.Join(op.Key, "/"), err.Error())
+
+	w.mutex.Lock()
+	w.attempts++
+	w.lastError = err.Error()
+	attempts := w.attempts
+	w.mutex.Unlock()
+
+	if attempts < MaxAttempts {
+		backoff := MinBackoff << uint(attempts-1)
+		if backoff > MaxBackoff || backoff <= 0 {
+			backoff = MaxBackoff
+		}
+
+		select {
+		case <-q.done:
+			return false
+		case <-time.After(backoff):
+			return true
+		}
+	}
+
+	op.Attempts, op.Error = attempts, err.Error()
+	value, err := json.Marshal(op)
+	if err != nil {
+		return false
+	}
+
+	dead := append([]byte(deadPrefix), key[len(queuePrefix):]...)
+	err = q.db.Update(func(txn *badger.Txn) error {
+		err := txn.Set(dead, value)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	if err != nil {
+		log.Printf("Error updating %s index queue: %s\n", w.index.Name(), err.Error())
+		return false
+	}
+
+	w.mutex.Lock()
+	w.attempts = 0
+	w.mutex.Unlock()
+	return true
+}
+
+// head returns the first operation with the given prefix, or nil if there isn't one
+func (q *Queue) head(prefix string) (key []byte, op *Operation, err error) {
+	err = q.db.View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iterOpts.Prefix = []byte(prefix)
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		iter.Rewind()
+		if !iter.Valid() {
+			return nil
+		}
+
+		item := iter.Item()
+		key = item.KeyCopy(nil)
+		op = &Operation{}
+		return item.Value(func(val []byte) error { return json.Unmarshal(val, op) })
+	})
+	return
+}
+
+func (q *Queue) apply(index indices.Index, op *Operation) error {
+	resource := types.NewResource(op.Type)
+	if resource == nil {
+		return fmt.Errorf("invalid resource type %d", op.Type)
+	}
+
+	err := json.Unmarshal(op.Resource, resource)
+	if err != nil {
+		return err
+	}
+
+	dataset, store, err := prepare(resource, q.api)
+	if err != nil {
+		return err
+	} else if store != nil {
+		defer store.Close()
+	}
+
+	if op.Delete {
+		return index.Delete(op.Key, resource, dataset, store)
+	}
+	return index.Set(op.Key, resource, dataset, store)
+}
+
+// Status reports the lag and failures of every index. If failures is true,
+// it includes the dead-lettered operations themselves.
+func (q *Queue) Status(failures bool) ([]*IndexStatus, error) {
+	statuses := make([]*IndexStatus, len(q.workers))
+	err := q.db.View(func(txn *badger.Txn) error {
+		for i, w := range q.workers {
+			w.mutex.Lock()
+			status := &IndexStatus{
+				Name:      w.index.Name(),
+				Processed: w.processed,
+				Attempts:  w.attempts,
+				LastError: w.lastError,
+			}
+			w.mutex.Unlock()
+
+			err := scan(txn, queuePrefix+status.Name+"/", func(op *Operation) {
+				if status.Lag == 0 {
+					status.Oldest = op.Queued
+				}
+				status.Lag++
+			})
+			if err != nil {
+				return err
+			}
+
+			err = scan(txn, deadPrefix+status.Name+"/", func(op *Operation) {
+				status.Dead++
+				if failures {
+					status.Failures = append(status.Failures, op)
+				}
+			})
+			if err != nil {
+				return err
+			}
+
+			statuses[i] = status
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// ClearDead deletes the dead-lettered operations of an index,
+// e.g. after it has been rebuilt with a reindex.
+func (q *Queue) ClearDead(name string) error {
+	return q.db.DropPrefix([]byte(deadPrefix + name + "/"))
+}
+
+// Clear removes everything from an index that implements indices.Clearer, e.g. before
+// it's rebuilt with a reindex. It waits for the index's worker to finish the operation
+// it's applying, if any. Indices that can't be cleared are left alone.
+func (q *Queue) Clear(name string) error {
+	for _, w := range q.workers {
+		if w.index.Name() != name {
+			continue
+		}
+
+		clearer, is := w.index.(indices.Clearer)
+		if !is {
+			return nil
+		}
+
+		w.applying.Lock()
+		defer w.applying.Unlock()
+		return clearer.Clear()
+	}
+	return nil
+}
+
+// Rebuilt finishes rebuilding an index that implements indices.Rebuilder after a
+// reindex, swapping in the rebuilt copy if ok. It waits for the index's worker to
+// finish the operation it's applying, if any.
+func (q *Queue) Rebuilt(name string, ok bool) error {
+	for _, w := range q.workers {
+		if w.index.Name() != name {
+			continue
+		}
+
+		rebuilder, is := w.index.(indices.Rebuilder)
+		if !is {
+			return nil
+		}
+
+		w.applying.Lock()
+		defer w.applying.Unlock()
+		return rebuilder.Rebuilt(ok)
+	}
+	return nil
+}
+
+// Exclusive runs f while the workers of the given indices aren't applying operations,
+// so that f can check the catalog and write to the indices without a queued operation
+// for a newer write being applied in between. Operations queued meanwhile are applied
+// after f returns.
+func (q *Queue) Exclusive(targets []indices.Index, f func() error) error {
+	for _, w := range q.workers {
+		for _, index := range targets {
+			if w.index.Name() == index.Name() {
+				w.applying.Lock()
+				defer w.applying.Unlock()
+				break
+			}
+		}
+	}
+	return f()
+}
+
+func scan(txn *badger.Txn, prefix string, f func(op *Operation)) error {
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = []byte(prefix)
+	iter := txn.NewIterator(iterOpts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		op := &Operation{}
+		err := iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, op) })
+		if err != nil {
+			return err
+		}
+		f(op)
+	}
+	return nil
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"log"
 	"regexp"
-	"strings"
 	"sync"
 
 	badger "github.com/dgraph-io/badger/v2"
 	files "github.com/ipfs/go-ipfs-files"
+	merkledag "github.com/ipfs/go-merkledag"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
 	path "github.com/ipfs/interface-go-ipfs-core/path"
 	multibase "github.com/multiformats/go-multibase"
 	ld "github.com/piprate/json-gold/ld"
@@ -25,20 +27,77 @@ type Server struct {
 	db             *badger.DB
 	resource       string
 	documentLoader ld.DocumentLoader
-	mutex          sync.Mutex
+	mutex          sync.RWMutex
+	locks          *pathLocks
+	writes         *pathLocks
+	writing        sync.RWMutex
+	values         *valueCache
+	pins           sync.Mutex
 	id             path.Resolved
 	value          path.Resolved
+	key            ed25519.PrivateKey
+	queue          *rpc.Queue
+	events         *eventLog
+	proofs         *proofs
+	webhooks       *webhooks
+	ipns           *publisher
+	mirror         *mirror
+	reindexMutex   sync.Mutex
+	reindexing     *reindexStatus
+	uploadPath     string
+	maxUploadSize  int64
 }
 
-// Close the underlying badger database
-func (server *Server) Close() { server.db.Close() }
+// Close the mirror, the IPNS publisher, the index queue, the webhook dispatcher, the event log, and the underlying badger database
+func (server *Server) Close() {
+	if server.mirror != nil {
+		server.mirror.Close()
+	}
+	if server.ipns != nil {
+		server.ipns.Close()
+	}
+	server.queue.Close()
+	server.webhooks.Close()
+	server.events.Close()
+	server.db.Close()
+}
 
 var links = map[string]string{}
 
-// NewServer opens the Badger database and writes an empty root package if none exists
-func NewServer(ctx context.Context, resource string, db *badger.DB, api iface.CoreAPI) (*Server, error) {
+// NewServer opens the Badger database and writes an empty root package if none exists.
+// If key is not nil, every package revision that the server creates is signed with it.
+func NewServer(ctx context.Context, resource string, db *badger.DB, api iface.CoreAPI, key ed25519.PrivateKey) (*Server, error) {
 	documentLoader := loader.NewDwebDocumentLoader(api)
-	server := &Server{api, db, resource, documentLoader, sync.Mutex{}, nil, nil}
+	queue, err := rpc.NewQueue(db, api)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := newEventLog(db)
+	if err != nil {
+		return nil, err
+	}
+
+	proofs, err := newProofs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		api:            api,
+		db:             db,
+		resource:       resource,
+		documentLoader: documentLoader,
+		locks:          newPathLocks(),
+		writes:         newPathLocks(),
+		values:         newValueCache(),
+		key:            key,
+		queue:          queue,
+		events:         events,
+		proofs:         proofs,
+	}
+
+	server.webhooks = newWebhooks(server)
 
 	contents := make([]*types.File, len(initialFiles))
 	for i, init := range initialFiles {
@@ -62,7 +121,7 @@ func NewServer(ctx context.Context, resource string, db *badger.DB, api iface.Co
 	}
 
 	txn := db.NewTransaction(true)
-	defer txn.Discard()
+	defer server.discard(txn)
 	pkg, err := getPackage(nil, txn)
 	if err == badger.ErrKeyNotFound {
 		log.Println("No root package found; creating new initial package")
@@ -70,7 +129,7 @@ func NewServer(ctx context.Context, resource string, db *badger.DB, api iface.Co
 		if err != nil {
 			return nil, err
 		}
-		err = txn.Commit()
+		err = server.commitTxn(txn)
 		if err != nil {
 			return nil, err
 		}
@@ -90,6 +149,11 @@ func NewServer(ctx context.Context, resource string, db *badger.DB, api iface.Co
 		return nil, err
 	}
 
+	err = server.api.Pin().Add(ctx, server.proofs.dir)
+	if err != nil {
+		return nil, err
+	}
+
 	return server, nil
 }
 
@@ -101,24 +165,32 @@ func (server *Server) createInitialPackage(
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 	pkg := types.NewPackage(server.resource, getName(server.resource))
-	value = EmptyDirectoryPath
+	dir, err := server.getDirectory(ctx, EmptyDirectoryPath)
+	if err != nil {
+		return
+	}
+
 	pkg.Members.Files = files
 	for _, f := range files {
 		f.Created = pkg.Created
 		f.Modified = pkg.Modified
 		key := []string{f.Title}
-		rpc.Set(key, f, server.api)
-		err = setResource(key, f, txn)
+		err = server.setEntry(key, f, txn)
 		if err != nil {
 			return
 		}
 
-		value, err = server.api.Object().AddLink(ctx, value, f.Title, f.Path())
+		err = server.setLink(ctx, dir, f.Title, f.Path())
 		if err != nil {
 			return
 		}
 	}
 
+	value, err = server.putDirectory(ctx, dir)
+	if err != nil {
+		return
+	}
+
 	err = server.setValue(ctx, pkg, value)
 	if err != nil {
 		return
@@ -130,46 +202,75 @@ func (server *Server) createInitialPackage(
 	}
 
 	id = pkg.Path()
-	rpc.Set(nil, pkg, server.api)
-	err = setResource(nil, pkg, txn)
+	err = server.setEntry(nil, pkg, txn)
 	return
 }
 
-func (server *Server) update(ctx context.Context, id, value path.Resolved) (err error) {
-	err = server.api.Pin().Update(ctx, server.id, id)
+// update moves the pins from the previous root package to the new one,
+// and schedules publishing it to IPNS if that's enabled
+func (server *Server) update(ctx context.Context, id, value path.Resolved) error {
+	server.pins.Lock()
+	defer server.pins.Unlock()
+
+	err := server.api.Pin().Update(ctx, server.id, id)
 	if err != nil {
 		return err
 	}
+	server.id = id
 
 	err = server.api.Pin().Update(ctx, server.value, value)
 	if err != nil {
 		return err
 	}
+	server.value = value
+
+	if server.ipns != nil {
+		server.ipns.Trigger()
+	}
 
 	return nil
 }
 
-// commit is called *after* the resource at key has been written.
+// commit is called *after* the resource at key has been written to txn.
+// It writes new revisions of every ancestor of key, and then commits txn.
+// Nothing outside of badger changes until the commit succeeds: the index
+// operations are queued inside txn, and the pins are only updated afterwards.
 // r is either a *Assertion, *File, or *Package - i.e. NOT just a *Reference.
-// Pass a *Reference with ID == "" if you want to delete a package
+// Pass nil if you want to delete the resource at key.
+//
+// Each ancestor is locked and read fresh, not through txn (see locks.go).
 func (server *Server) commit(ctx context.Context, timestamp string, key []string, r types.Resource, txn *badger.Txn) (err error) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
 
-	var value path.Resolved
+	unlocks := []func(){server.locks.lock(key)}
+	defer func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}()
+
+	var id, value path.Resolved
 	if p, is := r.(*types.Package); is && p != nil {
 		r = p.CopyResource()
-		value = p.ValuePath()
-
-		if len(key) == 0 {
-			return server.update(ctx, p.Path(), value)
-		}
+		id, value = p.Path(), p.ValuePath()
 	}
 
-	var id path.Resolved
 	for i := len(key) - 1; i >= 0; i-- {
 		parentKey, name := key[:i], key[i]
-		parent, err := getPackage(parentKey, txn)
+		unlocks = append(unlocks, server.locks.lock(parentKey))
+
+		var parent *types.Package
+		err = server.db.View(func(view *badger.Txn) (err error) {
+			parent, err = getPackage(parentKey, view)
+			return
+		})
+		if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+			// The parent is either new in txn (like a new inbox), or it was
+			// deleted or replaced since txn started. Reading it through txn
+			// covers the first case, and makes badger catch the second.
+			parent, err = getPackage(parentKey, txn)
+		}
 		if err != nil {
 			return err
 		}
@@ -179,7 +280,7 @@ func (server *Server) commit(ctx context.Context, timestamp string, key []string
 			return err
 		}
 
-		err = setResource(parentKey, parent, txn)
+		err = server.setResource(parentKey, parent, txn)
 		if err != nil {
 			return err
 		}
@@ -187,16 +288,55 @@ func (server *Server) commit(ctx context.Context, timestamp string, key []string
 		r = parent.CopyResource()
 	}
 
-	// now parent is the root package.
-	err = server.api.Pin().Update(ctx, server.id, id)
+	if id == nil {
+		return ErrNotPackage
+	}
+
+	err = server.commitTxn(txn)
 	if err != nil {
 		return err
 	}
 
-	server.id = id
+	// The write is durable now, so failing to move the pins isn't an error for the caller
+	err = server.update(ctx, id, value)
+	if err != nil {
+		log.Println("Error updating pins:", err)
+	}
+
 	return nil
 }
 
+// commitTxn commits txn along with the events collected for it, and then
+// updates the proof directory, wakes the index queue, publishes the events,
+// and wakes the webhook dispatcher.
+func (server *Server) commitTxn(txn *badger.Txn) error {
+	events, err := server.events.record(txn)
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+
+	server.applyProofs(context.Background(), txn)
+	server.queue.Wake()
+	server.events.publish(events)
+	if len(events) > 0 {
+		server.webhooks.Wake()
+	}
+	return nil
+}
+
+// discard discards txn and any events and proof changes collected for it. Write transactions
+// should always defer this (it's harmless after a successful commit).
+func (server *Server) discard(txn *badger.Txn) {
+	server.events.discard(txn)
+	server.proofs.discard(txn)
+	txn.Discard()
+}
+
 var cidPattern = regexp.MustCompile(`^[a-z2-7]{59}$`)
 
 func (server *Server) prclt(
@@ -208,102 +348,131 @@ func (server *Server) prclt(
 	r types.Resource,
 	value path.Resolved,
 ) (id, nextValue path.Resolved, err error) {
-	object := server.api.Object()
-	nextValue = pkg.ValuePath()
+	nextValue, err = server.setMember(ctx, pkg, pkg.ValuePath(), name, r, value)
+	if err != nil {
+		return
+	}
+
+	pkg.Modified = timestamp
+	pkg.Parent = pkg.ID
+	err = server.setValue(ctx, pkg, nextValue)
+	if err != nil {
+		return
+	}
+
+	id, err = server.normalize(ctx, pkg)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// setMember replaces the member name of pkg with r, or deletes it if r is nil,
+// and returns the new value directory. pkgValue is the value directory of pkg,
+// and value is the value directory of r if it's a *Reference. It doesn't
+// normalize pkg.
+func (server *Server) setMember(
+	ctx context.Context,
+	pkg *types.Package,
+	pkgValue path.Resolved,
+	name string,
+	r types.Resource,
+	value path.Resolved,
+) (nextValue path.Resolved, err error) {
+	dir, err := server.getDirectory(ctx, pkgValue)
+	if err != nil {
+		return
+	}
 
 	isCid := cidPattern.MatchString(name)
 	t := deletePackageMember(pkg, name, isCid)
 	switch t {
 	case types.PackageType:
-		nextValue, err = object.RmLink(ctx, nextValue, name)
+		err = dir.RemoveNodeLink(name)
 		if err != nil {
 			return
 		}
-		nextValue, err = object.RmLink(ctx, nextValue, name+types.NQuadsFileExtension)
+		err = dir.RemoveNodeLink(name + types.NQuadsFileExtension)
 		if err != nil {
 			return
 		}
 	case types.AssertionType:
-		nextValue, err = object.RmLink(ctx, nextValue, name+types.NQuadsFileExtension)
+		err = dir.RemoveNodeLink(name + types.NQuadsFileExtension)
 		if err != nil {
 			return
 		}
 	case types.FileType:
-		nextValue, err = object.RmLink(ctx, nextValue, name)
+		err = dir.RemoveNodeLink(name)
 		if err != nil {
 			return
 		}
 	}
 
 	if r != nil {
-		id = r.Path()
-
-		switch r := r.(type) {
-		case *types.Reference:
-			i, old := pkg.SearchPackages(name, isCid)
-			if old == nil {
-				pkg.Members.Packages = append(pkg.Members.Packages, nil)
-				copy(pkg.Members.Packages[i+1:], pkg.Members.Packages[i:])
-			}
-			pkg.Members.Packages[i] = r
-
-			nextValue, err = object.AddLink(ctx, nextValue, name, value)
-			if err != nil {
-				return
-			}
-
-			nextValue, err = object.AddLink(ctx, nextValue, name+types.NQuadsFileExtension, id)
-			if err != nil {
-				return
-			}
-		case *types.Assertion:
-			i, old := pkg.SearchAssertions(name, isCid)
-			if old == nil {
-				pkg.Members.Assertions = append(pkg.Members.Assertions, nil)
-				copy(pkg.Members.Assertions[i+1:], pkg.Members.Assertions[i:])
-			}
-			pkg.Members.Assertions[i] = r
-
-			nextValue, err = object.AddLink(ctx, nextValue, name+types.NQuadsFileExtension, id)
-			if err != nil {
-				return
-			}
-		case *types.File:
-			i, old := pkg.SearchFiles(name, isCid)
-			if old == nil {
-				pkg.Members.Files = append(pkg.Members.Files, nil)
-				copy(pkg.Members.Files[i+1:], pkg.Members.Files[i:])
-			}
-			pkg.Members.Files[i] = r
-
-			nextValue, err = object.AddLink(ctx, nextValue, name, id)
-			if err != nil {
-				return
-			}
+		err = server.setMemberLinks(ctx, pkg, dir, name, isCid, r, value)
+		if err != nil {
+			return
 		}
 	}
 
-	pkg.Modified = timestamp
-	pkg.Parent = pkg.ID
-	err = server.setValue(ctx, pkg, nextValue)
-	if err != nil {
-		return
-	}
+	return server.putDirectory(ctx, dir)
+}
 
-	id, err = server.normalize(ctx, pkg)
-	if err != nil {
-		return
+// setMemberLinks adds r to pkg as the member name, and links it from dir
+func (server *Server) setMemberLinks(
+	ctx context.Context,
+	pkg *types.Package,
+	dir *merkledag.ProtoNode,
+	name string,
+	isCid bool,
+	r types.Resource,
+	value path.Resolved,
+) error {
+	id := r.Path()
+	switch r := r.(type) {
+	case *types.Reference:
+		i, old := pkg.SearchPackages(name, isCid)
+		if old == nil {
+			pkg.Members.Packages = append(pkg.Members.Packages, nil)
+			copy(pkg.Members.Packages[i+1:], pkg.Members.Packages[i:])
+		}
+		pkg.Members.Packages[i] = r
+
+		err := server.setLink(ctx, dir, name, value)
+		if err != nil {
+			return err
+		}
+
+		return server.setLink(ctx, dir, name+types.NQuadsFileExtension, id)
+	case *types.Assertion:
+		i, old := pkg.SearchAssertions(name, isCid)
+		if old == nil {
+			pkg.Members.Assertions = append(pkg.Members.Assertions, nil)
+			copy(pkg.Members.Assertions[i+1:], pkg.Members.Assertions[i:])
+		}
+		pkg.Members.Assertions[i] = r
+
+		return server.setLink(ctx, dir, name+types.NQuadsFileExtension, id)
+	case *types.File:
+		i, old := pkg.SearchFiles(name, isCid)
+		if old == nil {
+			pkg.Members.Files = append(pkg.Members.Files, nil)
+			copy(pkg.Members.Files[i+1:], pkg.Members.Files[i:])
+		}
+		pkg.Members.Files[i] = r
+
+		return server.setLink(ctx, dir, name, id)
 	}
-	return
+	return nil
 }
 
 func (server *Server) setValue(ctx context.Context, pkg *types.Package, value path.Resolved) error {
-	stat, err := server.api.Object().Stat(ctx, value)
+	size, err := server.nodeSize(ctx, value)
 	if err != nil {
 		return err
 	}
-	pkg.Value.Extent = stat.CumulativeSize
-	s, err := stat.Cid.StringOfBase(multibase.Base32)
+	pkg.Value.Extent = int(size)
+	s, err := value.Cid().StringOfBase(multibase.Base32)
 	if err != nil {
 		return err
 	}
@@ -329,13 +498,17 @@ func (server *Server) setFile(ctx context.Context, f *types.File, node files.Fil
 
 	f.ID = "dweb:/ipfs/" + s
 	f.Extent = stat.CumulativeSize
+	server.values.sizes.Add(stat.Cid, uint64(stat.CumulativeSize))
 	return nil
 }
 
 func (server *Server) setAssertion(ctx context.Context, a *types.Assertion, node files.File) error {
+	size, sizeErr := node.Size()
 	id, err := server.api.Unixfs().Add(ctx, node, addOpts...)
 	if err != nil {
 		return err
+	} else if sizeErr == nil {
+		server.addedSize(id, int(size))
 	}
 	s, err := id.Cid().StringOfBase(multibase.Base32)
 	if err != nil {
@@ -345,54 +518,45 @@ func (server *Server) setAssertion(ctx context.Context, a *types.Assertion, node
 	return nil
 }
 
-// normalize adds the normalized n-quads string to IPFS and it sets pkg.ID; nothing else.
+// normalize adds the normalized n-quads string to IPFS and it sets pkg.ID
+// (and pkg.Proof, if the server has a signing key); nothing else.
 func (server *Server) normalize(ctx context.Context, pkg *types.Package) (path.Resolved, error) {
-	pkg.ID = ""
-
-	doc, err := pkg.JsonLd(links["package.jsonld"])
+	pkg.Proof = ""
+	id, data, err := server.hashPackage(ctx, pkg, addOpts...)
 	if err != nil {
 		return nil, err
 	}
 
-	proc := ld.NewJsonLdProcessor()
-	opts := ld.NewJsonLdOptions(server.resource)
-	opts.DocumentLoader = server.documentLoader
-	dataset, err := proc.ToRDF(doc, opts)
+	err = server.sign(ctx, pkg, data)
 	if err != nil {
 		return nil, err
 	}
 
-	opts.Format = "application/n-quads"
-	na := ld.NewNormalisationAlgorithm("URDNA2015")
-	normalized, err := na.Main(dataset.(*ld.RDFDataset), opts)
-	if err != nil {
-		return nil, err
-	}
+	return id, nil
+}
 
-	data := []byte(normalized.(string))
-	id, err := server.api.Unixfs().Add(ctx, files.NewBytesFile(data), addOpts...)
+// hashPackage adds the normalized n-quads string to IPFS using the given options
+// and sets pkg.ID. It returns the path and contents of the package document.
+// The package document is serialized directly by pkg.NQuads, which gives the
+// same result as expanding pkg.JsonLd and normalizing it with json-gold.
+func (server *Server) hashPackage(
+	ctx context.Context,
+	pkg *types.Package,
+	addOptions ...options.UnixfsAddOption,
+) (path.Resolved, []byte, error) {
+	data := pkg.NQuads()
+	id, err := server.api.Unixfs().Add(ctx, files.NewBytesFile(data), addOptions...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	value := ld.NewIRI(pkg.Value.ID)
-
-	var fragment string
-
-	for _, quad := range na.Quads() {
-		if ld.IsBlankNode(quad.Subject) &&
-			quad.Predicate.GetValue() == provValue.Value() &&
-			quad.Object.Equal(value) {
-			fragment = strings.TrimPrefix(quad.Subject.GetValue(), "_:")
-			break
-		}
-	}
+	server.addedSize(id, len(data))
 
 	s, err := id.Cid().StringOfBase(multibase.Base32)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	pkg.ID = "ul:" + s + "#" + fragment
-	return id, nil
+	pkg.ID = "ul:" + s + "#" + types.PackageNode
+	return id, data, nil
 }
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	blocks "github.com/ipfs/go-block-format"
+	blockservice "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	merkledag "github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	balanced "github.com/ipfs/go-unixfs/importer/balanced"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+	multihash "github.com/multiformats/go-multihash"
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+	styx "github.com/underlay/styx"
+
+	indices "github.com/underlay/pkgs/indices"
+	rpc "github.com/underlay/pkgs/rpc"
+	types "github.com/underlay/pkgs/types"
+)
+
+// testAPI is an offline, in-memory stand-in for the IPFS HTTP API. It implements
+// the parts of iface.CoreAPI that the server uses, and panics on the rest.
+type testAPI struct {
+	iface.CoreAPI
+	dag       ipld.DAGService
+	mutex     sync.Mutex
+	pins      map[cid.Cid]int
+	published []path.Path
+	err       error // returned by Unixfs().Add, if it's set
+}
+
+func newTestAPI() *testAPI {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	// The empty directory has to exist, since every value directory starts from it
+	empty := unixfs.EmptyDirNode()
+	empty.SetCidBuilder(cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256})
+	dag.Add(context.Background(), empty)
+
+	return &testAPI{dag: dag, pins: map[cid.Cid]int{}}
+}
+
+func (api *testAPI) Unixfs() iface.UnixfsAPI { return &testUnixfs{api: api} }
+func (api *testAPI) Object() iface.ObjectAPI { return &testObject{api: api} }
+func (api *testAPI) Pin() iface.PinAPI       { return &testPin{api: api} }
+func (api *testAPI) Block() iface.BlockAPI   { return &testBlock{api: api} }
+func (api *testAPI) Name() iface.NameAPI     { return &testName{api: api} }
+
+func (api *testAPI) ResolvePath(ctx context.Context, p path.Path) (path.Resolved, error) {
+	if resolved, is := p.(path.Resolved); is && resolved.Remainder() == "" {
+		return resolved, nil
+	}
+
+	terms := strings.Split(strings.Trim(p.String(), "/"), "/")
+	if len(terms) < 2 || terms[0] != "ipfs" {
+		return nil, errors.New("unsupported path " + p.String())
+	}
+
+	c, err := cid.Decode(terms[1])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range terms[2:] {
+		node, err := api.dag.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		link, _, err := node.ResolveLink([]string{name})
+		if err != nil {
+			return nil, err
+		}
+		c = link.Cid
+	}
+
+	return path.IpfsPath(c), nil
+}
+
+func (api *testAPI) ResolveNode(ctx context.Context, p path.Path) (ipld.Node, error) {
+	resolved, err := api.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return api.dag.Get(ctx, resolved.Cid())
+}
+
+// pinned reports whether p is pinned
+func (api *testAPI) pinned(p path.Resolved) bool {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.pins[p.Cid()] > 0
+}
+
+type testUnixfs struct {
+	iface.UnixfsAPI
+	api *testAPI
+}
+
+func (u *testUnixfs) Add(ctx context.Context, node files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error) {
+	file, is := node.(files.File)
+	if !is {
+		return nil, errors.New("only files can be added")
+	} else if u.api.err != nil {
+		return nil, u.api.err
+	}
+
+	params := ihelper.DagBuilderParams{
+		Dagserv:    u.api.dag,
+		RawLeaves:  true,
+		Maxlinks:   ihelper.DefaultLinksPerBlock,
+		CidBuilder: cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256},
+	}
+
+	db, err := params.New(chunker.DefaultSplitter(file))
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := balanced.Layout(db)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, _, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return nil, err
+	} else if settings.Pin {
+		u.api.Pin().Add(ctx, path.IpfsPath(root.Cid()))
+	}
+
+	return path.IpfsPath(root.Cid()), nil
+}
+
+func (u *testUnixfs) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	node, err := u.api.ResolveNode(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return unixfile.NewUnixfsFile(ctx, u.api.dag, node)
+}
+
+type testObject struct {
+	iface.ObjectAPI
+	api *testAPI
+}
+
+func (o *testObject) Stat(ctx context.Context, p path.Path) (*iface.ObjectStat, error) {
+	node, err := o.api.ResolveNode(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := node.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &iface.ObjectStat{
+		Cid:            node.Cid(),
+		NumLinks:       stat.NumLinks,
+		BlockSize:      stat.BlockSize,
+		LinksSize:      stat.LinksSize,
+		DataSize:       stat.DataSize,
+		CumulativeSize: stat.CumulativeSize,
+	}, nil
+}
+
+func (o *testObject) Links(ctx context.Context, p path.Path) ([]*ipld.Link, error) {
+	node, err := o.api.ResolveNode(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return node.Links(), nil
+}
+
+type testBlock struct {
+	iface.BlockAPI
+	api *testAPI
+}
+
+type testBlockStat struct {
+	size int
+	path path.Resolved
+}
+
+func (s *testBlockStat) Size() int           { return s.size }
+func (s *testBlockStat) Path() path.Resolved { return s.path }
+
+func (b *testBlock) Get(ctx context.Context, p path.Path) (io.Reader, error) {
+	node, err := b.api.ResolveNode(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(node.RawData()), nil
+}
+
+func (b *testBlock) Put(ctx context.Context, r io.Reader, opts ...options.BlockPutOption) (iface.BlockStat, error) {
+	_, prefix, err := options.BlockPutOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := prefix.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := ipld.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testBlockStat{size: len(data), path: path.IpfsPath(c)}, b.api.dag.Add(ctx, node)
+}
+
+type testPin struct {
+	iface.PinAPI
+	api *testAPI
+}
+
+func (p *testPin) Add(ctx context.Context, pin path.Path, opts ...options.PinAddOption) error {
+	resolved, err := p.api.ResolvePath(ctx, pin)
+	if err != nil {
+		return err
+	}
+
+	p.api.mutex.Lock()
+	defer p.api.mutex.Unlock()
+	p.api.pins[resolved.Cid()]++
+	return nil
+}
+
+func (p *testPin) Rm(ctx context.Context, pin path.Path, opts ...options.PinRmOption) error {
+	resolved, err := p.api.ResolvePath(ctx, pin)
+	if err != nil {
+		return err
+	}
+
+	p.api.mutex.Lock()
+	defer p.api.mutex.Unlock()
+	if p.api.pins[resolved.Cid()] == 0 {
+		return errors.New("not pinned")
+	}
+	p.api.pins[resolved.Cid()]--
+	return nil
+}
+
+func (p *testPin) Update(ctx context.Context, from, to path.Path, opts ...options.PinUpdateOption) error {
+	err := p.Add(ctx, to)
+	if err != nil {
+		return err
+	}
+	return p.Rm(ctx, from)
+}
+
+// testName records what it publishes instead of publishing it
+type testName struct {
+	iface.NameAPI
+	api *testAPI
+}
+
+type testIpnsEntry struct{ value path.Path }
+
+func (e *testIpnsEntry) Name() string     { return "self" }
+func (e *testIpnsEntry) Value() path.Path { return e.value }
+
+func (n *testName) Publish(ctx context.Context, p path.Path, opts ...options.NamePublishOption) (iface.IpnsEntry, error) {
+	n.api.mutex.Lock()
+	defer n.api.mutex.Unlock()
+	n.api.published = append(n.api.published, p)
+	return &testIpnsEntry{value: p}, nil
+}
+
+// newTestServer returns a server with an in-memory badger database, the
+// testAPI, and no indices. It's closed when the test finishes.
+func newTestServer(t testing.TB) (*Server, *testAPI) {
+	return newTestServerWithIndices(t)
+}
+
+// newTestServerWithIndices returns a test server that maintains the given indices
+func newTestServerWithIndices(t testing.TB, targets ...indices.Index) (*Server, *testAPI) {
+	rpc.INDICES = targets
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := newTestAPI()
+	server, err := NewServer(context.Background(), "http://localhost:8086", db, api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.uploadPath, err = ioutil.TempDir("", "pkgs-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(server.uploadPath)
+		rpc.INDICES = nil
+	})
+
+	return server, api
+}
+
+// testIndex is an index that records the URI of every resource that it has by path.
+// Setting the resource at the path fail returns an error, and records when in failures.
+type testIndex struct {
+	mutex     sync.Mutex
+	resources map[string]string
+	fail      string
+	failures  []time.Time
+}
+
+func newTestIndex() *testIndex { return &testIndex{resources: map[string]string{}} }
+
+func (index *testIndex) Name() string                                                     { return "test" }
+func (index *testIndex) Init(resource string, api iface.CoreAPI, db *badger.DB, p string) {}
+func (index *testIndex) Close()                                                           {}
+
+func (index *testIndex) Set(key []string, r types.Resource, dataset []*rdf.Quad, store *styx.Store) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	p := string(getKey(key))
+	if p == index.fail {
+		index.failures = append(index.failures, time.Now())
+		return fmt.Errorf("can't set %s", p)
+	}
+	index.resources[p] = r.URI()
+	return nil
+}
+
+func (index *testIndex) Delete(key []string, r types.Resource, dataset []*rdf.Quad, store *styx.Store) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	delete(index.resources, string(getKey(key)))
+	return nil
+}
+
+func (index *testIndex) Clear() error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.resources = map[string]string{}
+	return nil
+}
+
+// wait waits for the index to have (or not have) a resource at every path
+func (index *testIndex) wait(t *testing.T, has bool, paths ...string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		index.mutex.Lock()
+		done := true
+		for _, p := range paths {
+			if _, in := index.resources[p]; in != has {
+				done = false
+			}
+		}
+		index.mutex.Unlock()
+		if done {
+			return
+		}
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	t.Fatalf("timed out waiting for the index to have %v = %t; it has %v", paths, has, index.resources)
+}
+
+// do sends a request to server and returns the response
+func do(server *Server, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	return res
+}
+
+// putFile puts a text/plain file at target
+func putFile(server *Server, target, content string, header map[string]string) *httptest.ResponseRecorder {
+	h := map[string]string{"Content-Type": "text/plain", "Link": `<http://www.w3.org/ns/ldp#NonRDFSource>; rel="type"`}
+	for name, value := range header {
+		h[name] = value
+	}
+	return do(server, "PUT", target, content, h)
+}
+
+// tarBody returns a tar archive of entries
+func tarBody(t *testing.T, entries map[string]string) string {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, content := range entries {
+		err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		if err == nil {
+			_, err = w.Write([]byte(content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestPutFile(t *testing.T) {
+	server, _ := newTestServer(t)
+	res := putFile(server, "/hello.txt", "Hello World!\n", nil)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "GET", "/hello.txt", "", nil)
+	if res.Code != http.StatusOK || res.Body.String() != "Hello World!\n" {
+		t.Fatalf("GET: %d %q", res.Code, res.Body.String())
+	}
+}
+
+// benchmarkDepth and benchmarkMembers are the shape of the tree in the benchmarks:
+// a chain of benchmarkDepth packages below the root, the deepest of which has
+// benchmarkMembers files.
+const benchmarkDepth = 10
+const benchmarkMembers = 10000
+
+// seedTree creates the benchmark tree and returns the path of the deepest package.
+// The files are merged into it in tar archives small enough for one badger transaction.
+func seedTree(b *testing.B, server *Server) string {
+	p := ""
+	for i := 0; i < benchmarkDepth; i++ {
+		p += fmt.Sprintf("/level-%d", i)
+		res := do(server, "MKCOL", p, "", nil)
+		if res.Code != http.StatusCreated {
+			b.Fatalf("MKCOL %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	for i := 0; i < benchmarkMembers; {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for j := 0; i < benchmarkMembers && j < 1000; i, j = i+1, j+1 {
+			data := []byte(fmt.Sprintf("file %d\n", i))
+			w.WriteHeader(&tar.Header{Name: fmt.Sprintf("file-%d.txt", i), Mode: 0644, Size: int64(len(data))})
+			w.Write(data)
+		}
+		w.Close()
+
+		res := do(server, "POST", p, buf.String(), map[string]string{"Content-Type": "application/x-tar"})
+		if res.Code != http.StatusCreated && res.Code != http.StatusOK && res.Code != http.StatusNoContent {
+			b.Fatalf("POST %s: %d %s", p, res.Code, res.Body.String())
+		}
+	}
+
+	return p
+}
+
+// BenchmarkCommit measures replacing a file in a package with benchmarkMembers
+// members, benchmarkDepth packages below the root
+func BenchmarkCommit(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	server, _ := newTestServer(b)
+	p := seedTree(b, server)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := putFile(server, p+"/file-0.txt", fmt.Sprintf("revision %d\n", i), nil)
+		if res.Code != http.StatusNoContent {
+			b.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+		}
+	}
+}
+
+// normalizeJsonLd is how package documents were serialized before Package.NQuads:
+// expanding the JSON-LD document and normalizing it with URDNA2015.
+func normalizeJsonLd(server *Server, pkg *types.Package) ([]byte, error) {
+	p := *pkg
+	p.ID = ""
+	doc, err := p.JsonLd(links["package.jsonld"])
+	if err != nil {
+		return nil, err
+	}
+
+	proc := ld.NewJsonLdProcessor()
+	opts := ld.NewJsonLdOptions(server.resource)
+	opts.DocumentLoader = server.documentLoader
+	dataset, err := proc.ToRDF(doc, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Format = "application/n-quads"
+	na := ld.NewNormalisationAlgorithm("URDNA2015")
+	normalized, err := na.Main(dataset.(*ld.RDFDataset), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(normalized.(string)), nil
+}
+
+func TestNQuads(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	nquads := map[string]string{"Content-Type": "application/n-quads", "Link": `<http://www.w3.org/ns/ldp#RDFSource>; rel="type"`}
+	for target, res := range map[string]*httptest.ResponseRecorder{
+		"/a.txt":         putFile(server, "/a.txt", "Hello World!\n", nil),
+		"/copy-of-a.txt": putFile(server, "/copy-of-a.txt", "Hello World!\n", nil),
+		"/assertion":     do(server, "PUT", "/assertion", "<http://example.com/a> <http://example.com/b> \"c\" .\n", nquads),
+		"/sub":           do(server, "MKCOL", "/sub", "", nil),
+		"/sub/b.txt":     putFile(server, "/sub/b.txt", "b\n", nil),
+	} {
+		if res.Code >= 300 {
+			t.Fatalf("%s: %d %s", target, res.Code, res.Body.String())
+		}
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	root, err := getPackage(nil, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := getPackage([]string{"sub"}, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	escaped := *root
+	escaped.Description = "A \"quoted\" \\ description\nover two lines,\twith a tab and a ☃"
+	escaped.Keywords = []string{"b", "a", "b", "\r\n"}
+	escaped.Members.Files[0].Title = "\"a\".txt"
+
+	empty := types.NewPackage(server.resource+"/empty", "empty")
+
+	for name, pkg := range map[string]*types.Package{"root": root, "sub": sub, "escaped": &escaped, "empty": empty} {
+		expected, err := normalizeJsonLd(server, pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := pkg.NQuads(); !bytes.Equal(actual, expected) {
+			t.Errorf("%s: NQuads doesn't match json-gold:\n%s\nexpected:\n%s", name, actual, expected)
+		}
+	}
+}
+
+// TestValueDirectory checks that value directories match their packages' members and extents
+func TestValueDirectory(t *testing.T) {
+	server, api := newTestServer(t)
+	for _, res := range []*httptest.ResponseRecorder{
+		putFile(server, "/a.txt", "a\n", nil),
+		do(server, "MKCOL", "/sub", "", nil),
+		putFile(server, "/sub/b.txt", "b\n", nil),
+		putFile(server, "/sub/c.txt", "c\n", nil),
+		putFile(server, "/sub/b.txt", "b, again\n", nil),
+		do(server, "DELETE", "/sub/c.txt", "", nil),
+	} {
+		if res.Code >= 300 {
+			t.Fatalf("%d %s", res.Code, res.Body.String())
+		}
+	}
+
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	for _, key := range [][]string{nil, {"sub"}} {
+		pkg, err := getPackage(key, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := api.Object().Stat(context.Background(), pkg.ValuePath())
+		if err != nil {
+			t.Fatal(err)
+		} else if stat.CumulativeSize != pkg.Value.Extent {
+			t.Errorf("%v: value directory has size %d, but the package says %d", key, stat.CumulativeSize, pkg.Value.Extent)
+		}
+
+		links, err := api.Object().Links(context.Background(), pkg.ValuePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := map[string]string{}
+		for _, link := range links {
+			names[link.Name] = link.Cid.String()
+		}
+
+		expected := map[string]string{}
+		for _, p := range pkg.Members.Packages {
+			child, err := getPackage(append(key, p.Title), txn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[p.Title] = child.ValuePath().Cid().String()
+			expected[p.Title+types.NQuadsFileExtension] = p.Path().Cid().String()
+		}
+		for _, a := range pkg.Members.Assertions {
+			expected[a.Title+types.NQuadsFileExtension] = a.Path().Cid().String()
+		}
+		for _, f := range pkg.Members.Files {
+			expected[f.Title] = f.Path().Cid().String()
+		}
+
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%v: value directory has links %v, expected %v", key, names, expected)
+		}
+	}
+}
@@ -6,21 +6,49 @@ import (
 
 	badger "github.com/dgraph-io/badger/v2"
 
-	rpc "github.com/underlay/pkgs/rpc"
 	types "github.com/underlay/pkgs/types"
 )
 
 // ErrParentNotPackage indicates that the parent of the given path either does not exist, or is not a package
 var ErrParentNotPackage = errors.New("Invalid path: parent is not a package")
 
+// checkParent checks that the parent of key is a package. Every write to a sibling
+// of key writes a new revision of the parent, so like commit, it reads the parent
+// fresh instead of through txn, unless it isn't a package there (it might be new
+// in txn, and otherwise reading it through txn makes badger catch the change).
+func (server *Server) checkParent(key []string, txn *badger.Txn) error {
+	parentKey := getKey(key[:len(key)-1])
+	var meta byte
+	err := server.db.View(func(view *badger.Txn) error {
+		item, err := view.Get(parentKey)
+		if err == nil {
+			meta = item.UserMeta()
+		}
+		return err
+	})
+
+	if err == badger.ErrKeyNotFound || err == nil && meta != byte(types.PackageType) {
+		item, err := txn.Get(parentKey)
+		if err != nil {
+			return err
+		}
+		meta = item.UserMeta()
+	} else if err != nil {
+		return err
+	}
+
+	if meta != byte(types.PackageType) {
+		return ErrParentNotPackage
+	}
+	return nil
+}
+
 // r is a *Package, *Assertion, or *File --- NOT a *Reference
 func (server *Server) set(ctx context.Context, key []string, r types.Resource, txn *badger.Txn) error {
 	if len(key) > 0 {
-		parentItem, err := txn.Get(getKey(key[:len(key)-1]))
+		err := server.checkParent(key, txn)
 		if err != nil {
 			return err
-		} else if parentItem.UserMeta() != byte(types.PackageType) {
-			return ErrParentNotPackage
 		}
 	}
 
@@ -49,21 +77,20 @@ func (server *Server) set(ctx context.Context, key []string, r types.Resource, t
 		if isOldAssertion {
 			r.Created = oldAssertion.Created
 		} else if isOldPackage {
-			err = server.deleteChildren(key, oldPackage, txn)
+			err = server.deleteChildren(ctx, key, oldPackage, txn)
 		}
 	case *types.File:
 		if isOldFile {
 			r.Created = oldFile.Created
 		} else if isOldPackage {
-			err = server.deleteChildren(key, oldPackage, txn)
+			err = server.deleteChildren(ctx, key, oldPackage, txn)
 		}
 	}
 	if err != nil {
 		return err
 	}
 
-	rpc.Set(key, r, server.api)
-	err = setResource(key, r, txn)
+	err = server.setEntry(key, r, txn)
 	if err != nil {
 		return err
 	}
@@ -81,13 +108,13 @@ func (server *Server) setChildren(
 		if err != nil {
 			return err
 		}
-		err = server.setChildren(ctx, append(key, p.Title), child, txn)
+		childKey := append(key, p.Title)
+		err = server.setChildren(ctx, childKey, child, txn)
 		if err != nil {
 			return err
 		}
 
-		rpc.Set(key, child, server.api)
-		err = setResource(key, child, txn)
+		err = server.setEntry(childKey, child, txn)
 		if err != nil {
 			return err
 		}
@@ -95,8 +122,7 @@ func (server *Server) setChildren(
 
 	for _, a := range pkg.Members.Assertions {
 		childKey := append(key, a.Name())
-		rpc.Set(childKey, a, server.api)
-		err := setResource(childKey, a, txn)
+		err := server.setEntry(childKey, a, txn)
 		if err != nil {
 			return err
 		}
@@ -104,8 +130,7 @@ func (server *Server) setChildren(
 
 	for _, f := range pkg.Members.Files {
 		childKey := append(key, f.Name())
-		rpc.Set(childKey, f, server.api)
-		err := setResource(childKey, f, txn)
+		err := server.setEntry(childKey, f, txn)
 		if err != nil {
 			return err
 		}
@@ -120,6 +145,13 @@ func (server *Server) diffChildren(
 	pkg, oldPkg *types.Package,
 	txn *badger.Txn,
 ) error {
+	// A mount that gets overwritten has nothing to diff against
+	if mounted, err := server.removeMount(ctx, key, oldPkg, txn); err != nil {
+		return err
+	} else if mounted {
+		return server.setChildren(ctx, key, pkg, txn)
+	}
+
 	packages, assertions, files := pkg.Members.Packages, pkg.Members.Assertions, pkg.Members.Files
 
 	packageExists := make([]bool, len(packages))
@@ -132,13 +164,12 @@ func (server *Server) diffChildren(
 				return err
 			}
 
-			err = server.deleteChildren(childKey, oldChild, txn)
+			err = server.deleteChildren(ctx, childKey, oldChild, txn)
 			if err != nil {
 				return err
 			}
 
-			rpc.Delete(childKey, oldChild, server.api)
-			err = txn.Delete(getKey(childKey))
+			err = server.deleteEntry(childKey, oldChild, txn)
 			if err != nil {
 				return err
 			}
@@ -159,8 +190,7 @@ func (server *Server) diffChildren(
 					return err
 				}
 
-				rpc.Set(childKey, newChild, server.api)
-				err = setResource(childKey, newChild, txn)
+				err = server.setEntry(childKey, newChild, txn)
 				if err != nil {
 					return err
 				}
@@ -181,8 +211,7 @@ func (server *Server) diffChildren(
 				return err
 			}
 
-			rpc.Set(childKey, newChild, server.api)
-			err = setResource(childKey, newChild, txn)
+			err = server.setEntry(childKey, newChild, txn)
 			if err != nil {
 				return err
 			}
@@ -195,8 +224,7 @@ func (server *Server) diffChildren(
 		i, new := pkg.SearchAssertions(name, old.Resource == "")
 		if new == nil {
 			childKey := append(key, name)
-			rpc.Delete(childKey, old, server.api)
-			err := txn.Delete(getKey(childKey))
+			err := server.deleteEntry(childKey, old, txn)
 			if err != nil {
 				return err
 			}
@@ -212,8 +240,7 @@ func (server *Server) diffChildren(
 	for i, a := range assertions {
 		if !assertionExists[i] {
 			childKey := append(key, a.Name())
-			rpc.Set(childKey, a, server.api)
-			err := setResource(childKey, a, txn)
+			err := server.setEntry(childKey, a, txn)
 			if err != nil {
 				return err
 			}
@@ -226,8 +253,7 @@ func (server *Server) diffChildren(
 		i, new := pkg.SearchFiles(name, old.Resource == "")
 		if new == nil {
 			childKey := append(key, name)
-			rpc.Delete(childKey, old, server.api)
-			err := txn.Delete(getKey(childKey))
+			err := server.deleteEntry(childKey, old, txn)
 			if err != nil {
 				return err
 			}
@@ -239,8 +265,7 @@ func (server *Server) diffChildren(
 	for i, f := range files {
 		if !fileExists[i] {
 			childKey := append(key, f.Name())
-			rpc.Set(childKey, f, server.api)
-			err := setResource(childKey, assertions[i], txn)
+			err := server.setEntry(childKey, f, txn)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	files "github.com/ipfs/go-ipfs-files"
+	ld "github.com/piprate/json-gold/ld"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// sign creates a proof for the package document data (which must be the file that pkg.ID addresses)
+// and sets pkg.Proof. It does nothing if the server doesn't have a key.
+func (server *Server) sign(ctx context.Context, pkg *types.Package, data []byte) error {
+	if server.key == nil {
+		return nil
+	}
+
+	created := time.Now().Format(time.RFC3339)
+	proof, err := types.MakeProof(server.key, pkg.ID, data, created)
+	if err != nil {
+		return err
+	}
+
+	a := &types.Assertion{}
+	err = server.setAssertion(ctx, a, files.NewBytesFile(proof))
+	if err != nil {
+		return err
+	}
+
+	pkg.Proof = a.ID
+	return nil
+}
+
+// Proof handles requests to /_proof/{path}. GET returns the proof document
+// of the package at path, and PUT attaches a client-signed proof to it.
+func (server *Server) Proof(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	if req.Method == "GET" {
+		txn := server.db.NewTransaction(false)
+		defer txn.Discard()
+
+		pkg, err := getPackage(key, txn)
+		if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+			res.WriteHeader(404)
+			return
+		} else if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		} else if pkg.Proof == "" {
+			res.WriteHeader(404)
+			return
+		}
+
+		a := &types.Assertion{ID: pkg.Proof}
+		res.Header().Add("Content-Type", "application/n-quads")
+		res.Header().Add("ETag", a.ETag())
+		res.Header().Add("Link", makeSelfLink(a.ID))
+		server.copyFile(ctx, res, a.Path())
+		return
+	} else if req.Method != "PUT" {
+		res.WriteHeader(405)
+		return
+	}
+
+	if format := req.Header.Get("Content-Type"); format != "application/n-quads" {
+		res.WriteHeader(415)
+		return
+	}
+
+	dataset, err := ld.ParseNQuadsFrom(req.Body)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	opts := ld.NewJsonLdOptions("")
+	opts.Format = "application/n-quads"
+	normalized, err := ld.NewNormalisationAlgorithm("URDNA2015").Main(dataset, opts)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	proof := []byte(normalized.(string))
+
+	txn := server.db.NewTransaction(true)
+	defer server.discard(txn)
+
+	pkg, err := getPackage(key, txn)
+	if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if match := req.Header.Get("If-Match"); match != "" && match != pkg.ETag() {
+		res.WriteHeader(412)
+		return
+	}
+
+	node, err := server.api.Unixfs().Get(ctx, pkg.Path())
+	if err != nil {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	document, err := ioutil.ReadAll(files.ToFile(node))
+	if err != nil {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	_, err = types.VerifyProof(pkg.ID, document, proof)
+	if err != nil {
+		res.WriteHeader(422)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	a := &types.Assertion{}
+	err = server.setAssertion(ctx, a, files.NewBytesFile(proof))
+	if err != nil {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	pkg.Proof = a.ID
+	err = server.setResource(key, pkg, txn)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	err = server.commitTxn(txn)
+	if err == badger.ErrConflict {
+		res.WriteHeader(409)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("Link", types.MakeLinkProof(pkg.Proof))
+	res.WriteHeader(204)
+}
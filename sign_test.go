@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"reflect"
+	"testing"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// TestProofsPinned checks that the proof directory is pinned and links to the
+// proof of every package, and only those
+func TestProofsPinned(t *testing.T) {
+	server, api := newTestServer(t)
+	_, server.key, _ = ed25519.GenerateKey(nil)
+
+	check := func(keys ...[]string) {
+		t.Helper()
+		if !api.pinned(server.proofs.dir) {
+			t.Fatal("the proof directory isn't pinned")
+		}
+
+		links, err := api.Object().Links(context.Background(), server.proofs.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual := map[string]string{}
+		for _, link := range links {
+			actual[link.Name] = link.Cid.String()
+		}
+
+		txn := server.db.NewTransaction(false)
+		defer txn.Discard()
+		expected := map[string]string{}
+		for _, key := range keys {
+			pkg, err := getPackage(key, txn)
+			if err != nil {
+				t.Fatal(err)
+			} else if pkg.Proof == "" {
+				t.Fatalf("%v has no proof", key)
+			}
+			expected[proofName(key)] = (&types.Assertion{ID: pkg.Proof}).Path().Cid().String()
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("the proof directory has %v, expected %v", actual, expected)
+		}
+	}
+
+	res := do(server, "MKCOL", "/sub", "", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", res.Code, res.Body.String())
+	}
+	check(nil, []string{"sub"})
+
+	res = putFile(server, "/sub/a.txt", "a\n", nil)
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+	check(nil, []string{"sub"})
+
+	res = do(server, "DELETE", "/sub", "", nil)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", res.Code, res.Body.String())
+	}
+	check(nil)
+}
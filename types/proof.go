@@ -0,0 +1,254 @@
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	multibase "github.com/multiformats/go-multibase"
+	ld "github.com/piprate/json-gold/ld"
+)
+
+// Package revisions are signed with Ed25519Signature2020 Data Integrity proofs.
+// A proof document is a canonicalized n-quads file that links the package ID
+// to a proof node with sec:proof. The signature covers the SHA-256 hash of the
+// canonicalized proof options (the proof node without its proofValue)
+// followed by the SHA-256 hash of the package document, which is exactly the
+// file that the package ID addresses.
+const (
+	SecProof                  = "https://w3id.org/security#proof"
+	SecProofValue             = "https://w3id.org/security#proofValue"
+	SecProofPurpose           = "https://w3id.org/security#proofPurpose"
+	SecVerificationMethod     = "https://w3id.org/security#verificationMethod"
+	SecAssertionMethod        = "https://w3id.org/security#assertionMethod"
+	SecEd25519Signature2020   = "https://w3id.org/security#Ed25519Signature2020"
+	rdfType                   = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+	dctermsCreated            = "http://purl.org/dc/terms/created"
+	xsdDateTime               = "http://www.w3.org/2001/XMLSchema#dateTime"
+	ed25519PublicKeyMulticode = 0xed
+)
+
+// ErrInvalidProof is returned when a proof document is malformed or its signature does not verify
+var ErrInvalidProof = errors.New("Invalid proof")
+
+// LinkRelProof is the link relation used to attach proof documents to packages
+var LinkRelProof = SecProof
+
+// MakeLinkProof formats a proof link header
+func MakeLinkProof(id string) string { return fmt.Sprintf(`<%s>; rel="%s"`, id, LinkRelProof) }
+
+var linkProofPattern = regexp.MustCompile(`^<([^<>; \t]+)>; rel="` + regexp.QuoteMeta(LinkRelProof) + `"$`)
+
+// ParseProofLink returns the target of the first proof link, if any
+func ParseProofLink(links []string) string {
+	for _, link := range links {
+		match := linkProofPattern.FindStringSubmatch(link)
+		if match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// DidKey returns the did:key identifier for an ed25519 public key
+func DidKey(pub ed25519.PublicKey) string {
+	data := append([]byte{ed25519PublicKeyMulticode, 0x01}, pub...)
+	s, _ := multibase.Encode(multibase.Base58BTC, data)
+	return "did:key:" + s
+}
+
+// ParseDidKey returns the ed25519 public key of a did:key identifier or verification method
+func ParseDidKey(did string) (ed25519.PublicKey, error) {
+	if i := strings.IndexByte(did, '#'); i != -1 {
+		did = did[:i]
+	}
+
+	if !strings.HasPrefix(did, "did:key:") {
+		return nil, ErrInvalidProof
+	}
+
+	_, data, err := multibase.Decode(strings.TrimPrefix(did, "did:key:"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != 2+ed25519.PublicKeySize || data[0] != ed25519PublicKeyMulticode || data[1] != 0x01 {
+		return nil, ErrInvalidProof
+	}
+
+	return ed25519.PublicKey(data[2:]), nil
+}
+
+// VerificationMethod returns the did:key verification method for a public key
+func VerificationMethod(pub ed25519.PublicKey) string {
+	did := DidKey(pub)
+	return did + "#" + strings.TrimPrefix(did, "did:key:")
+}
+
+// ReadKey reads a PEM-encoded ed25519 private key from path.
+// If the file doesn't exist and create is true, a new key is generated and written there.
+func ReadKey(path string, create bool) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		return key, ioutil.WriteFile(path, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, is := key.(ed25519.PrivateKey); is {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+}
+
+// MakeProof signs the package document (the canonicalized n-quads addressed by id)
+// and returns a canonicalized proof document.
+func MakeProof(key ed25519.PrivateKey, id string, document []byte, created string) ([]byte, error) {
+	proof := ld.NewBlankNode("_:b0")
+	method := VerificationMethod(key.Public().(ed25519.PublicKey))
+	options := []*ld.Quad{
+		ld.NewQuad(proof, ld.NewIRI(rdfType), ld.NewIRI(SecEd25519Signature2020), "@default"),
+		ld.NewQuad(proof, ld.NewIRI(dctermsCreated), ld.NewLiteral(created, xsdDateTime, ""), "@default"),
+		ld.NewQuad(proof, ld.NewIRI(SecVerificationMethod), ld.NewIRI(method), "@default"),
+		ld.NewQuad(proof, ld.NewIRI(SecProofPurpose), ld.NewIRI(SecAssertionMethod), "@default"),
+	}
+
+	data, err := hashProof(options, document)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := multibase.Encode(multibase.Base58BTC, ed25519.Sign(key, data))
+	if err != nil {
+		return nil, err
+	}
+
+	quads := append(options,
+		ld.NewQuad(proof, ld.NewIRI(SecProofValue), ld.NewLiteral(value, ld.XSDString, ""), "@default"),
+		ld.NewQuad(ld.NewIRI(id), ld.NewIRI(SecProof), proof, "@default"),
+	)
+
+	normalized, err := canonicalize(quads)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(normalized), nil
+}
+
+// VerifyProof checks that proof is a valid proof document for the package
+// document addressed by id, and returns the verification method that signed it.
+func VerifyProof(id string, document, proof []byte) (string, error) {
+	dataset, err := ld.ParseNQuads(string(proof))
+	if err != nil {
+		return "", err
+	}
+
+	var node ld.Node
+	for _, quad := range dataset.GetQuads("@default") {
+		if quad.Predicate.GetValue() == SecProof && ld.IsBlankNode(quad.Object) {
+			if quad.Subject.GetValue() != id {
+				return "", ErrInvalidProof
+			}
+			node = quad.Object
+			break
+		}
+	}
+
+	if node == nil {
+		return "", ErrInvalidProof
+	}
+
+	var method, value string
+	options := []*ld.Quad{}
+	for _, quad := range dataset.GetQuads("@default") {
+		if !quad.Subject.Equal(node) {
+			continue
+		}
+
+		switch quad.Predicate.GetValue() {
+		case SecProofValue:
+			value = quad.Object.GetValue()
+			continue
+		case SecVerificationMethod:
+			method = quad.Object.GetValue()
+		}
+
+		options = append(options, quad)
+	}
+
+	pub, err := ParseDidKey(method)
+	if err != nil {
+		return "", err
+	}
+
+	_, signature, err := multibase.Decode(value)
+	if err != nil {
+		return "", ErrInvalidProof
+	}
+
+	data, err := hashProof(options, document)
+	if err != nil {
+		return "", err
+	}
+
+	if !ed25519.Verify(pub, data, signature) {
+		return "", ErrInvalidProof
+	}
+
+	return method, nil
+}
+
+func hashProof(options []*ld.Quad, document []byte) ([]byte, error) {
+	normalized, err := canonicalize(options)
+	if err != nil {
+		return nil, err
+	}
+
+	optionsHash := sha256.Sum256([]byte(normalized))
+	documentHash := sha256.Sum256(document)
+	return bytes.Join([][]byte{optionsHash[:], documentHash[:]}, nil), nil
+}
+
+func canonicalize(quads []*ld.Quad) (string, error) {
+	dataset := ld.NewRDFDataset()
+	dataset.Graphs["@default"] = quads
+	opts := ld.NewJsonLdOptions("")
+	opts.Format = "application/n-quads"
+	normalized, err := ld.NewNormalisationAlgorithm("URDNA2015").Main(dataset, opts)
+	if err != nil {
+		return "", err
+	}
+	return normalized.(string), nil
+}
@@ -0,0 +1,139 @@
+package types
+
+import (
+	"errors"
+	"strconv"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// Package documents are read straight from their canonical n-quads instead of being
+// framed with package.jsonld: json-gold's Frame needs the frame as a parsed document,
+// and even then the framed package loses its parent and value, so it doesn't
+// round-trip. The members are sorted the way the Search* helpers expect, which
+// framing didn't do either.
+
+// ErrParsePackage means a package document doesn't describe exactly one package
+var ErrParsePackage = errors.New("Error parsing package")
+
+// ReadPackage reads a package from a dataset that describes exactly one
+// package node: the subject typed ldp:DirectContainer and prov:Collection.
+func ReadPackage(quads []*rdf.Quad) (*Package, error) {
+	subjects := map[string][]*rdf.Quad{}
+	for _, quad := range quads {
+		if quad.Graph().TermType() != rdf.DefaultGraphType {
+			continue
+		}
+		s := quad.Subject().String()
+		subjects[s] = append(subjects[s], quad)
+	}
+
+	var root rdf.Term
+	for _, quad := range quads {
+		if quad.Predicate().Value() == rdfType && quad.Object().Value() == provCollection {
+			if root != nil {
+				return nil, ErrParsePackage
+			}
+			root = quad.Subject()
+		}
+	}
+
+	if root == nil || !hasType(subjects[root.String()], LDPDirectContainer) {
+		return nil, ErrParsePackage
+	}
+
+	pkg := &Package{}
+	for _, quad := range subjects[root.String()] {
+		p, o := quad.Predicate(), quad.Object()
+		switch {
+		case p.Value() == ldpMembershipResource:
+			pkg.Resource = o.Value()
+		case p.Value() == dctermsTitle:
+			pkg.Title = o.Value()
+		case p.Value() == dctermsDescription:
+			pkg.Description = o.Value()
+		case p.Value() == dctermsSubject:
+			pkg.Keywords = append(pkg.Keywords, o.Value())
+		case p.Value() == dctermsCreated:
+			pkg.Created = o.Value()
+		case p.Value() == dctermsModified:
+			pkg.Modified = o.Value()
+		case p.Value() == provWasRevisionOf:
+			pkg.Parent = o.Value()
+		case p.Value() == provValue:
+			pkg.Value.ID = o.Value()
+			pkg.Value.Extent = readExtent(subjects[o.String()])
+		case p.Value() == provHadMember:
+			err := readMember(pkg, o, subjects[o.String()])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if pkg.Resource == "" || pkg.Value.ID == "" {
+		return nil, ErrParsePackage
+	}
+
+	pkg.Sort()
+	return pkg, nil
+}
+
+func readMember(pkg *Package, member rdf.Term, quads []*rdf.Quad) error {
+	if member.TermType() != rdf.NamedNodeType {
+		return ErrParsePackage
+	}
+
+	var resource, title, created, modified, format string
+	for _, quad := range quads {
+		p, o := quad.Predicate(), quad.Object()
+		switch {
+		case p.Value() == ldpMembershipResource:
+			resource = o.Value()
+		case p.Value() == dctermsTitle:
+			title = o.Value()
+		case p.Value() == dctermsCreated:
+			created = o.Value()
+		case p.Value() == dctermsModified:
+			modified = o.Value()
+		case p.Value() == dctermsFormat:
+			format = o.Value()
+		}
+	}
+
+	id := member.Value()
+	if hasType(quads, LDPDirectContainer) {
+		r := &Reference{ID: id, Resource: resource, Title: title}
+		pkg.Members.Packages = append(pkg.Members.Packages, r)
+	} else if hasType(quads, LDPRDFSource) {
+		a := &Assertion{ID: id, Resource: resource, Title: title, Created: created, Modified: modified}
+		pkg.Members.Assertions = append(pkg.Members.Assertions, a)
+	} else if hasType(quads, LDPNonRDFSource) {
+		f := &File{ID: id, Resource: resource, Title: title, Created: created, Modified: modified, Format: format}
+		f.Extent = readExtent(quads)
+		pkg.Members.Files = append(pkg.Members.Files, f)
+	} else {
+		return ErrParsePackage
+	}
+
+	return nil
+}
+
+func hasType(quads []*rdf.Quad, t string) bool {
+	for _, quad := range quads {
+		if quad.Predicate().Value() == rdfType && quad.Object().Value() == t {
+			return true
+		}
+	}
+	return false
+}
+
+func readExtent(quads []*rdf.Quad) int {
+	for _, quad := range quads {
+		if quad.Predicate().Value() == dctermsExtent {
+			extent, _ := strconv.Atoi(quad.Object().Value())
+			return extent
+		}
+	}
+	return 0
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -46,6 +47,19 @@ type Resource interface {
 	Name() string
 }
 
+// NewResource returns an empty *Package, *Assertion, or *File for t, or nil
+func NewResource(t ResourceType) Resource {
+	switch t {
+	case PackageType:
+		return &Package{}
+	case AssertionType:
+		return &Assertion{}
+	case FileType:
+		return &File{}
+	}
+	return nil
+}
+
 type Reference struct {
 	ID       string `json:"id,omitempty"`
 	Resource string `json:"resource,omitempty"`
@@ -195,6 +209,7 @@ type Package struct {
 	Description string   `json:"description,omitempty"`
 	Keywords    []string `json:"keywords,omitempty"`
 	Parent      string   `json:"parent,omitempty"`
+	Proof       string   `json:"proof,omitempty"`
 	Value       struct {
 		ID     string `json:"id"`
 		Extent int    `json:"extent"`
@@ -266,6 +281,27 @@ func (pkg *Package) SearchFiles(name string, isCid bool) (int, *File) {
 	return i, nil
 }
 
+// Sort the package members into the order that SearchPackages, SearchAssertions, and SearchFiles expect:
+// packages by title, and assertions and files with unnamed (CID-identified) members first.
+func (pkg *Package) Sort() {
+	packages, assertions, files := pkg.Members.Packages, pkg.Members.Assertions, pkg.Members.Files
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Title < packages[j].Title })
+	sort.Slice(assertions, func(i, j int) bool {
+		a, b := assertions[i].Resource == "", assertions[j].Resource == ""
+		if a != b {
+			return a
+		}
+		return assertions[i].Name() < assertions[j].Name()
+	})
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i].Resource == "", files[j].Resource == ""
+		if a != b {
+			return a
+		}
+		return files[i].Name() < files[j].Name()
+	})
+}
+
 func (pkg *Package) CopyResource() *Reference {
 	return &Reference{pkg.ID, pkg.Resource, pkg.Title}
 }
@@ -288,7 +324,24 @@ func (pkg *Package) ValuePath() path.Resolved {
 	return nil
 }
 
+// A PackageView selects the parts of a package document that NQuadsView and JsonLdView serialize.
+// The package's own properties are always included.
+type PackageView struct {
+	// Membership includes the prov:hadMember triples and the descriptions of the members
+	Membership bool
+	// Containment includes ldp:contains triples for the members, which the package document doesn't have
+	Containment bool
+}
+
+// FullView is the view of the whole package document
+var FullView = PackageView{Membership: true}
+
 func (pkg *Package) JsonLd(context string) (map[string]interface{}, error) {
+	return pkg.JsonLdView(context, FullView)
+}
+
+// JsonLdView returns the parts of the JSON-LD package document that view selects
+func (pkg *Package) JsonLdView(context string, view PackageView) (map[string]interface{}, error) {
 	buf := bytes.NewBuffer(nil)
 	err := json.NewEncoder(buf).Encode(pkg)
 	if err != nil {
@@ -309,9 +362,171 @@ func (pkg *Package) JsonLd(context string) (map[string]interface{}, error) {
 		delete(doc, "id")
 	}
 
+	// Proofs are attached to the package ID, so they can't be part of the document
+	if _, has := doc["proof"]; has {
+		delete(doc, "proof")
+	}
+
+	if !view.Membership {
+		delete(doc, "members")
+	}
+
+	if view.Containment {
+		contains := []interface{}{}
+		for _, id := range pkg.memberIDs() {
+			contains = append(contains, map[string]interface{}{"@id": id})
+		}
+		doc["ldp:contains"] = contains
+	}
+
 	return doc, nil
 }
 
+const (
+	ldpHasMemberRelation  = "http://www.w3.org/ns/ldp#hasMemberRelation"
+	ldpMembershipResource = "http://www.w3.org/ns/ldp#membershipResource"
+	provCollection        = "http://www.w3.org/ns/prov#Collection"
+	provHadMember         = "http://www.w3.org/ns/prov#hadMember"
+	provValue             = "http://www.w3.org/ns/prov#value"
+	provWasRevisionOf     = "http://www.w3.org/ns/prov#wasRevisionOf"
+	dctermsTitle          = "http://purl.org/dc/terms/title"
+	dctermsDescription    = "http://purl.org/dc/terms/description"
+	dctermsSubject        = "http://purl.org/dc/terms/subject"
+	dctermsModified       = "http://purl.org/dc/terms/modified"
+	dctermsExtent         = "http://purl.org/dc/terms/extent"
+	dctermsFormat         = "http://purl.org/dc/terms/format"
+	xsdInteger            = "http://www.w3.org/2001/XMLSchema#integer"
+	ldpContains           = "http://www.w3.org/ns/ldp#contains"
+)
+
+// PackageNode is the blank node label of the package node in a normalized package document
+const PackageNode = "c14n0"
+
+var literalEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+
+func iri(s string) string { return "<" + literalEscaper.Replace(s) + ">" }
+
+func literal(s, datatype string) string {
+	if datatype == "" {
+		return "\"" + literalEscaper.Replace(s) + "\""
+	}
+	return "\"" + literalEscaper.Replace(s) + "\"^^" + iri(datatype)
+}
+
+// memberIDs returns the IDs of every member of the package
+func (pkg *Package) memberIDs() []string {
+	ids := make([]string, 0, len(pkg.Members.Packages)+len(pkg.Members.Assertions)+len(pkg.Members.Files))
+	for _, p := range pkg.Members.Packages {
+		ids = append(ids, p.ID)
+	}
+	for _, a := range pkg.Members.Assertions {
+		ids = append(ids, a.ID)
+	}
+	for _, f := range pkg.Members.Files {
+		ids = append(ids, f.ID)
+	}
+	return ids
+}
+
+// NQuads serializes the package document in URDNA2015 canonical form directly.
+// The package node is the document's only blank node, so it's always labelled
+// _:c14n0, and canonicalization only has to sort the statements; the result is
+// the same as expanding JsonLd with the package context and normalizing it.
+func (pkg *Package) NQuads() []byte { return pkg.NQuadsView(FullView) }
+
+// NQuadsView serializes the parts of the package document that view selects, in the same form as NQuads
+func (pkg *Package) NQuadsView(view PackageView) []byte {
+	lines := make(map[string]bool, 8+6*(len(pkg.Members.Packages)+len(pkg.Members.Assertions)+len(pkg.Members.Files)))
+	add := func(s, p, o string) { lines[s+" "+iri(p)+" "+o+" .\n"] = true }
+	node := "_:" + PackageNode
+
+	add(node, rdfType, iri(LDPDirectContainer))
+	add(node, rdfType, iri(provCollection))
+	add(node, ldpHasMemberRelation, iri(provHadMember))
+
+	if pkg.Resource != "" {
+		add(node, ldpMembershipResource, iri(pkg.Resource))
+	}
+	if pkg.Title != "" {
+		add(node, dctermsTitle, literal(pkg.Title, ""))
+	}
+	if pkg.Description != "" {
+		add(node, dctermsDescription, literal(pkg.Description, ""))
+	}
+	for _, keyword := range pkg.Keywords {
+		add(node, dctermsSubject, literal(keyword, ""))
+	}
+	if pkg.Created != "" {
+		add(node, dctermsCreated, literal(pkg.Created, xsdDateTime))
+	}
+	if pkg.Modified != "" {
+		add(node, dctermsModified, literal(pkg.Modified, xsdDateTime))
+	}
+	if pkg.Parent != "" {
+		add(node, provWasRevisionOf, iri(pkg.Parent))
+	}
+
+	value := iri(pkg.Value.ID)
+	add(node, provValue, value)
+	add(value, dctermsExtent, literal(strconv.Itoa(pkg.Value.Extent), xsdInteger))
+
+	member := func(id, t, resource, title, created, modified string) string {
+		m := iri(id)
+		add(node, provHadMember, m)
+		add(m, rdfType, iri(t))
+		if resource != "" {
+			add(m, ldpMembershipResource, iri(resource))
+		}
+		if title != "" {
+			add(m, dctermsTitle, literal(title, ""))
+		}
+		if created != "" {
+			add(m, dctermsCreated, literal(created, xsdDateTime))
+		}
+		if modified != "" {
+			add(m, dctermsModified, literal(modified, xsdDateTime))
+		}
+		return m
+	}
+
+	if view.Membership {
+		for _, p := range pkg.Members.Packages {
+			member(p.ID, LDPDirectContainer, p.Resource, p.Title, "", "")
+		}
+		for _, a := range pkg.Members.Assertions {
+			member(a.ID, LDPRDFSource, a.Resource, a.Title, a.Created, a.Modified)
+		}
+		for _, f := range pkg.Members.Files {
+			m := member(f.ID, LDPNonRDFSource, f.Resource, f.Title, f.Created, f.Modified)
+			add(m, dctermsExtent, literal(strconv.Itoa(f.Extent), xsdInteger))
+			add(m, dctermsFormat, literal(f.Format, ""))
+		}
+	}
+
+	if view.Containment {
+		for _, id := range pkg.memberIDs() {
+			add(node, ldpContains, iri(id))
+		}
+	}
+
+	sorted := make([]string, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Strings(sorted)
+
+	size := 0
+	for _, line := range sorted {
+		size += len(line)
+	}
+
+	data := make([]byte, 0, size)
+	for _, line := range sorted {
+		data = append(data, line...)
+	}
+	return data
+}
+
 func MakeLinkType(t string) string { return fmt.Sprintf(`<%s>; rel="type"`, t) }
 
 const (
@@ -319,8 +534,30 @@ const (
 	LDPDirectContainer = "http://www.w3.org/ns/ldp#DirectContainer"
 	LDPRDFSource       = "http://www.w3.org/ns/ldp#RDFSource"
 	LDPNonRDFSource    = "http://www.w3.org/ns/ldp#NonRDFSource"
+	LDPPage            = "http://www.w3.org/ns/ldp#Page"
 )
 
+// The LDP preferences for which parts of a container to return
+const (
+	LDPPreferMinimalContainer = "http://www.w3.org/ns/ldp#PreferMinimalContainer"
+	LDPPreferMembership       = "http://www.w3.org/ns/ldp#PreferMembership"
+	LDPPreferContainment      = "http://www.w3.org/ns/ldp#PreferContainment"
+)
+
+// LDPInbox is the link relation that advertises a Linked Data Notifications inbox
+const LDPInbox = "http://www.w3.org/ns/ldp#inbox"
+
+// MakeLinkInbox formats an inbox link header
+func MakeLinkInbox(id string) string { return fmt.Sprintf(`<%s>; rel="%s"`, id, LDPInbox) }
+
+// LDPConstrainedBy is the link relation that points to the constraints on a resource
+const LDPConstrainedBy = "http://www.w3.org/ns/ldp#constrainedBy"
+
+// MakeLinkConstrainedBy formats a constrainedBy link header
+func MakeLinkConstrainedBy(id string) string {
+	return fmt.Sprintf(`<%s>; rel="%s"`, id, LDPConstrainedBy)
+}
+
 var LinkTypeResource = MakeLinkType(LDPResource)
 var LinkTypeDirectContainer = MakeLinkType(LDPDirectContainer)
 var LinkTypeRDFSource = MakeLinkType(LDPRDFSource)
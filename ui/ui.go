@@ -47,6 +47,7 @@ var pageTemplate = `<!DOCTYPE html>
 			<tr><td><span class="label">Resource</span></td><td>{{ .Pkg.Resource }}</td></tr>
 			<tr><td><span class="label">ID</span></td><td>{{ .Pkg.ID }}</td></tr>
 			<tr><td><span class="label">Parent</span></td><td>{{ .Pkg.Parent }}</td></tr>
+			{{ if ne .Pkg.Proof "" }}<tr><td><span class="label">Proof</span></td><td>{{ .Pkg.Proof }}</td></tr>{{ end }}
 			<tr><td><span class="label">Description</span></td><td>{{ .Pkg.Description }}</td></tr>
 			<tr><td rowspan="2"><span class="label">Contents</span></td><td>{{ .Pkg.Value.ID }}</td></tr>
 			<tr><td>{{ .Pkg.Value.Extent }} bytes</td></tr>
@@ -126,6 +127,15 @@ var pageTemplate = `<!DOCTYPE html>
 		No files
 		{{ end }}
 		</section>
+		{{ if gt .Paging.Pages 1 }}
+		<nav>
+			<a href="{{ .Paging.First }}">first</a>
+			{{ if ne .Paging.Prev "" }}<a href="{{ .Paging.Prev }}">previous</a>{{ end }}
+			page {{ .Paging.Page }} of {{ .Paging.Pages }}
+			{{ if ne .Paging.Next "" }}<a href="{{ .Paging.Next }}">next</a>{{ end }}
+			<a href="{{ .Paging.Last }}">last</a>
+		</nav>
+		{{ end }}
 	</body>
 </html>`
 
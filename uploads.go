@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	types "github.com/underlay/pkgs/types"
+)
+
+// Large files can be uploaded in pieces with the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload), version 1.0.0 with the creation,
+// expiration, checksum, and termination extensions. POST /_uploads starts an
+// upload with an Upload-Length header and a "path" (and "format", or "filetype")
+// in Upload-Metadata, and returns its URL, /_uploads/{id}. Each PATCH appends to
+// the upload at the offset in its Upload-Offset header, and HEAD returns the
+// offset that a client should resume from after a failed PATCH. The PATCH that
+// completes the upload adds the file to IPFS and writes it to the path like a PUT,
+// checking it against the digest headers of the POST and the lock tokens and
+// preconditions of the PATCH. If the write fails, the upload is kept, and an empty
+// PATCH tries again.
+//
+// The received bytes are kept in server.uploadPath/{id} and each upload's state
+// in badger under _uploads/{id}. Uploads expire uploadExpiration after their
+// last PATCH.
+
+const uploadPrefix = "_uploads/"
+
+const tusVersion = "1.0.0"
+
+var uploadExpiration = 24 * time.Hour
+
+// tusChecksums are the algorithms of the Upload-Checksum header
+var tusChecksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// ErrInvalidUpload is returned for upload requests without a valid length, path, or checksum
+var ErrInvalidUpload = errors.New("Invalid upload: expected an Upload-Length, a path and format in Upload-Metadata, and an Upload-Checksum of md5, sha1, sha256, or sha512")
+
+// An upload is the state of a resumable upload
+type upload struct {
+	ID      string      `json:"id"`
+	Path    string      `json:"path"`
+	Format  string      `json:"format"`
+	Length  int64       `json:"length"`
+	Offset  int64       `json:"offset"`
+	Digests http.Header `json:"digests,omitempty"`
+	Expires string      `json:"expires"`
+}
+
+func uploadKey(id string) []byte { return []byte(uploadPrefix + id) }
+
+// uploadLock is the path that PATCH and DELETE lock in server.locks, which can't be a resource's path
+func uploadLock(id string) []string { return []string{"_uploads", id} }
+
+func (server *Server) uploadFile(id string) string { return server.uploadPath + "/" + id }
+
+func (u *upload) expired(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, u.Expires)
+	return err != nil || now.After(expires)
+}
+
+func getUpload(id string, txn *badger.Txn) (*upload, error) {
+	item, err := txn.Get(uploadKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{}
+	return u, item.Value(func(val []byte) error { return json.Unmarshal(val, u) })
+}
+
+func setUpload(u *upload, txn *badger.Txn) error {
+	val, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return txn.Set(uploadKey(u.ID), val)
+}
+
+// parseUploadMetadata parses an Upload-Metadata header: comma-separated keys
+// and base64-encoded values, separated by a space
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		terms := strings.SplitN(pair, " ", 2)
+		if len(terms) == 1 {
+			metadata[terms[0]] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(terms[1])
+		if err != nil {
+			return nil, ErrInvalidUpload
+		}
+		metadata[terms[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+// Uploads handles requests to /_uploads and /_uploads/{id}
+func (server *Server) Uploads(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	res.Header().Add("Tus-Resumable", tusVersion)
+	if req.Method == "OPTIONS" {
+		res.Header().Add("Tus-Version", tusVersion)
+		res.Header().Add("Tus-Extension", "creation,expiration,checksum,termination")
+		res.Header().Add("Tus-Checksum-Algorithm", "md5,sha1,sha256,sha512")
+		if server.maxUploadSize > 0 {
+			res.Header().Add("Tus-Max-Size", strconv.FormatInt(server.maxUploadSize, 10))
+		}
+		res.WriteHeader(204)
+		return
+	} else if req.Header.Get("Tus-Resumable") != tusVersion {
+		res.Header().Add("Tus-Version", tusVersion)
+		res.WriteHeader(412)
+		return
+	} else if server.mirror != nil {
+		res.WriteHeader(405)
+		res.Write([]byte(ErrMirror.Error()))
+		return
+	} else if len(key) > 1 {
+		res.WriteHeader(404)
+		return
+	}
+
+	if len(key) == 0 {
+		if req.Method != "POST" {
+			res.WriteHeader(405)
+			return
+		}
+		server.createUpload(ctx, res, req)
+		return
+	}
+
+	switch req.Method {
+	case "HEAD":
+		server.headUpload(res, key[0])
+	case "PATCH":
+		server.patchUpload(ctx, res, req, key[0])
+	case "DELETE":
+		server.deleteUpload(res, key[0])
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+func (server *Server) createUpload(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		res.WriteHeader(400)
+		res.Write([]byte(ErrInvalidUpload.Error()))
+		return
+	}
+
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	key := types.ParsePath(metadata["path"])
+	format := metadata["format"]
+	if format == "" {
+		format = metadata["filetype"]
+	}
+
+	if len(key) == 0 || isReserved(key) {
+		res.WriteHeader(403)
+		return
+	} else if format == "" {
+		res.WriteHeader(415)
+		return
+	}
+
+	// Check the size and the digest headers now, so the client doesn't upload anything in vain
+	_, err = server.newUploadBody(key[:len(key)-1], req.Header, length, nil)
+	if err != nil {
+		res.WriteHeader(uploadStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	now := time.Now()
+	u := &upload{
+		ID:      fmt.Sprintf("%x", b),
+		Path:    string(getKey(key)),
+		Format:  format,
+		Length:  length,
+		Expires: now.Add(uploadExpiration).Format(time.RFC3339),
+	}
+
+	for _, name := range digestHeaders {
+		if values := req.Header[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			if u.Digests == nil {
+				u.Digests = http.Header{}
+			}
+			u.Digests[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	file, err := os.Create(server.uploadFile(u.ID))
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	var expired []string
+	err = server.db.Update(func(txn *badger.Txn) error {
+		_, err := getPackage(key[:len(key)-1], txn)
+		if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+			return ErrParentNotPackage
+		} else if err != nil {
+			return err
+		}
+
+		err = checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		expired, err = pruneUploads(now, txn)
+		if err != nil {
+			return err
+		}
+
+		return setUpload(u, txn)
+	})
+
+	if err != nil {
+		os.Remove(server.uploadFile(u.ID))
+		res.WriteHeader(batchStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	for _, id := range expired {
+		os.Remove(server.uploadFile(id))
+	}
+
+	res.Header().Add("Location", "/"+uploadPrefix+u.ID)
+	res.Header().Add("Upload-Expires", now.Add(uploadExpiration).UTC().Format(http.TimeFormat))
+	res.WriteHeader(201)
+}
+
+// pruneUploads deletes the uploads that expired before now, and returns their IDs
+func pruneUploads(now time.Time, txn *badger.Txn) ([]string, error) {
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = []byte(uploadPrefix)
+	iter := txn.NewIterator(iterOpts)
+	defer iter.Close()
+
+	expired := []string{}
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		u := &upload{}
+		err := iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, u) })
+		if err != nil {
+			return nil, err
+		} else if u.expired(now) {
+			expired = append(expired, u.ID)
+		}
+	}
+
+	for _, id := range expired {
+		err := txn.Delete(uploadKey(id))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// readUpload returns the upload with the given id, and deletes it if it has expired
+func (server *Server) readUpload(id string) (u *upload, err error) {
+	err = server.db.View(func(txn *badger.Txn) (err error) {
+		u, err = getUpload(id, txn)
+		return
+	})
+
+	if err == nil && u.expired(time.Now()) {
+		server.removeUpload(id)
+		return nil, badger.ErrKeyNotFound
+	}
+	return
+}
+
+// removeUpload deletes the upload with the given id and its bytes
+func (server *Server) removeUpload(id string) error {
+	err := server.db.Update(func(txn *badger.Txn) error { return txn.Delete(uploadKey(id)) })
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(server.uploadFile(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (server *Server) headUpload(res http.ResponseWriter, id string) {
+	u, err := server.readUpload(id)
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+
+	expires, _ := time.Parse(time.RFC3339, u.Expires)
+	res.Header().Add("Cache-Control", "no-store")
+	res.Header().Add("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	res.Header().Add("Upload-Length", strconv.FormatInt(u.Length, 10))
+	res.Header().Add("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	res.WriteHeader(200)
+}
+
+func (server *Server) deleteUpload(res http.ResponseWriter, id string) {
+	defer server.locks.lock(uploadLock(id))()
+
+	_, err := server.readUpload(id)
+	if err == nil {
+		err = server.removeUpload(id)
+	}
+
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(204)
+}
+
+// parseChecksum parses an Upload-Checksum header
+func parseChecksum(header string) (*digest, error) {
+	terms := strings.SplitN(header, " ", 2)
+	h, has := tusChecksums[terms[0]]
+	if len(terms) != 2 || !has {
+		return nil, ErrInvalidUpload
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(terms[1])
+	if err != nil {
+		return nil, ErrInvalidUpload
+	}
+
+	return &digest{hash: h(), expected: expected}, nil
+}
+
+func (server *Server) patchUpload(ctx context.Context, res http.ResponseWriter, req *http.Request, id string) {
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		res.WriteHeader(415)
+		return
+	}
+
+	var checksum *digest
+	if header := req.Header.Get("Upload-Checksum"); header != "" {
+		var err error
+		checksum, err = parseChecksum(header)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	// Only one PATCH can append to an upload at a time
+	defer server.locks.lock(uploadLock(id))()
+
+	u, err := server.readUpload(id)
+	if err == badger.ErrKeyNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		res.WriteHeader(409)
+		return
+	}
+
+	file, err := os.OpenFile(server.uploadFile(id), os.O_WRONLY, 0)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	defer file.Close()
+
+	// Anything past the offset is left over from a PATCH that failed before it was recorded
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	var w io.Writer = file
+	if checksum != nil {
+		w = io.MultiWriter(file, checksum.hash)
+	}
+
+	// Read one byte more than the rest of the upload to tell if the body is too long
+	n, readErr := io.Copy(w, io.LimitReader(req.Body, u.Length-u.Offset+1))
+	if n > u.Length-u.Offset {
+		file.Truncate(offset)
+		res.WriteHeader(413)
+		return
+	} else if checksum != nil && (readErr != nil || !bytes.Equal(checksum.hash.Sum(nil), checksum.expected)) {
+		// Without the whole chunk, the checksum can't be checked, so none of it is kept
+		file.Truncate(offset)
+		res.WriteHeader(460)
+		return
+	}
+
+	// Keep what was received, even if the body was cut off, so the client can resume from there
+	err = file.Sync()
+	if err == nil {
+		u.Offset += n
+		u.Expires = time.Now().Add(uploadExpiration).Format(time.RFC3339)
+		err = server.db.Update(func(txn *badger.Txn) error { return setUpload(u, txn) })
+	}
+
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	} else if readErr != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(readErr.Error()))
+		return
+	}
+
+	expires, _ := time.Parse(time.RFC3339, u.Expires)
+	res.Header().Add("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	res.Header().Add("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	if u.Offset < u.Length {
+		res.WriteHeader(204)
+		return
+	}
+
+	f, err := server.finishUpload(ctx, req, u)
+	if err == ErrInvalidDigest || err == ErrDigestMismatch || err == ErrTooLarge {
+		res.WriteHeader(uploadStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		res.WriteHeader(batchStatus(err))
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.Header().Add("ETag", f.ETag())
+	res.Header().Add("Link", makeSelfLink(f.URI()))
+	res.WriteHeader(204)
+}
+
+// finishUpload adds a complete upload to IPFS and writes it to its path. The upload
+// is deleted unless the write failed in a way that the client can retry.
+func (server *Server) finishUpload(ctx context.Context, req *http.Request, u *upload) (*types.File, error) {
+	key := types.ParsePath(u.Path)
+	file, err := os.Open(server.uploadFile(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	body, err := server.newUploadBody(key[:len(key)-1], u.Digests, u.Length, file)
+	if err != nil {
+		server.removeUpload(u.ID)
+		return nil, err
+	}
+
+	timestamp := time.Now().Format(time.RFC3339)
+	f := &types.File{Format: u.Format, Created: timestamp, Modified: timestamp}
+	f.Resource, f.Title = types.GetURI(server.resource, key), key[len(key)-1]
+	err = server.addFile(ctx, f, body)
+	if err == ErrDigestMismatch || err == ErrTooLarge {
+		server.removeUpload(u.ID)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = server.write(key, func(txn *badger.Txn) error {
+		err := checkLocks(req, key, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkPreconditions(req, key, txn)
+		if err != nil {
+			return err
+		}
+
+		err = server.set(ctx, key, f, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, key, f, txn)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.removeUpload(u.ID)
+	if err != nil {
+		log.Println("Error removing upload", u.ID+":", err)
+	}
+	return f, nil
+}
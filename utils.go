@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"net/http"
 	"strings"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -15,6 +16,9 @@ import (
 	types "github.com/underlay/pkgs/types"
 )
 
+// ErrPrecondition is returned when the If-Match or If-None-Match header of a request doesn't hold
+var ErrPrecondition = errors.New("Precondition failed")
+
 // ErrNotPackage is returned when a resource unmarhsalls into a non-package unexpectedly
 var ErrNotPackage = errors.New("Unexpected non-package resource")
 
@@ -63,7 +67,9 @@ func deletePackageMember(pkg *types.Package, name string, isCid bool) types.Reso
 	return 0
 }
 
-func setResource(key []string, r types.Resource, txn *badger.Txn) error {
+// setResource writes the resource at key to the catalog, and collects the change to
+// the proof directory for it (see proofs.go)
+func (server *Server) setResource(key []string, r types.Resource, txn *badger.Txn) error {
 	k := getKey(key)
 	v, err := json.Marshal(r)
 	if err != nil {
@@ -82,25 +88,53 @@ func setResource(key []string, r types.Resource, txn *badger.Txn) error {
 		log.Fatalln("Attempted to set *resource in setResource")
 	}
 
+	server.collectProof(txn, key, r)
 	return txn.SetEntry(e)
 }
 
+// setEntry writes the resource at key to the catalog, queues it for the indices,
+// and collects an event for it
+func (server *Server) setEntry(key []string, r types.Resource, txn *badger.Txn) error {
+	old, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+
+	err = server.queue.Set(key, r, txn)
+	if err != nil {
+		return err
+	}
+
+	server.collect(txn, key, old, r)
+	return server.setResource(key, r, txn)
+}
+
+// deleteEntry deletes the resource at key from the catalog, queues its removal
+// from the indices, and collects an event for it
+func (server *Server) deleteEntry(key []string, r types.Resource, txn *badger.Txn) error {
+	err := server.queue.Delete(key, r, txn)
+	if err != nil {
+		return err
+	}
+
+	server.collect(txn, key, r, nil)
+	server.collectProof(txn, key, nil)
+	return txn.Delete(getKey(key))
+}
+
 func getResource(key []string, txn *badger.Txn) (types.Resource, error) {
 	item, err := txn.Get(getKey(key))
 	if err != nil {
 		return nil, err
 	}
 
-	var r types.Resource
-	switch types.ResourceType(item.UserMeta()) {
-	case types.PackageType:
-		r = &types.Package{}
-	case types.AssertionType:
-		r = &types.Assertion{}
-	case types.FileType:
-		r = &types.File{}
-	}
+	return readResource(item)
+}
 
+func readResource(item *badger.Item) (types.Resource, error) {
+	r := types.NewResource(types.ResourceType(item.UserMeta()))
 	return r, item.Value(func(val []byte) error { return json.Unmarshal(val, r) })
 }
 
@@ -122,3 +156,47 @@ func getPackage(key []string, txn *badger.Txn) (*types.Package, error) {
 
 	return p, nil
 }
+
+// getExistingPackage returns the package at key, or nil if there isn't one
+func getExistingPackage(key []string, txn *badger.Txn) (*types.Package, error) {
+	pkg, err := getPackage(key, txn)
+	if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+		return nil, nil
+	}
+	return pkg, err
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a request against
+// the resource at key. Reading it in txn means that the commit fails if it changes.
+func checkPreconditions(req *http.Request, key []string, txn *badger.Txn) error {
+	match, noneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	if match == "" && noneMatch == "" {
+		return nil
+	}
+
+	r, err := getResource(key, txn)
+	if err == badger.ErrKeyNotFound {
+		r = nil
+	} else if err != nil {
+		return err
+	}
+
+	if match != "" && (r == nil || !matchETag(match, r.ETag())) {
+		return ErrPrecondition
+	} else if noneMatch != "" && r != nil && matchETag(noneMatch, r.ETag()) {
+		return ErrPrecondition
+	}
+
+	return nil
+}
+
+// matchETag returns true if the list of entity tags in a conditional header contains etag (or is *)
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	merkledag "github.com/ipfs/go-merkledag"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Value directories are edited locally instead of with an IPFS object patch for
+// every link: setMember decodes the directory, changes its links, and writes it
+// back as a single block. The directories and the cumulative sizes of the nodes
+// that the server writes are cached, so a write to a deep package doesn't read
+// or stat anything on its way up to the root.
+
+var valueCacheSize = 1024
+
+type valueCache struct {
+	dirs  *lru.Cache // cid.Cid -> *merkledag.ProtoNode, never modified once cached
+	sizes *lru.Cache // cid.Cid -> uint64
+}
+
+func newValueCache() *valueCache {
+	dirs, _ := lru.New(valueCacheSize)
+	sizes, _ := lru.New(16 * valueCacheSize)
+	return &valueCache{dirs: dirs, sizes: sizes}
+}
+
+// getDirectory returns a copy of the directory at p that's safe to modify
+func (server *Server) getDirectory(ctx context.Context, p path.Resolved) (*merkledag.ProtoNode, error) {
+	c := p.Cid()
+	if dir, has := server.values.dirs.Get(c); has {
+		return dir.(*merkledag.ProtoNode).Copy().(*merkledag.ProtoNode), nil
+	}
+
+	r, err := server.api.Block().Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := merkledag.DecodeProtobufBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := node.(*merkledag.ProtoNode)
+	server.values.dirs.Add(c, dir)
+	return dir.Copy().(*merkledag.ProtoNode), nil
+}
+
+// putDirectory writes dir to IPFS and caches it; dir must not be modified afterwards
+func (server *Server) putDirectory(ctx context.Context, dir *merkledag.ProtoNode) (path.Resolved, error) {
+	data := dir.RawData()
+	stat, err := server.api.Block().Put(ctx, bytes.NewReader(data),
+		options.Block.Format(cid.CodecToStr[cid.DagProtobuf]),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	c := dir.Cid()
+	if !stat.Path().Cid().Equals(c) {
+		return nil, fmt.Errorf("directory %s was stored as %s", c.String(), stat.Path().Cid().String())
+	}
+
+	size, err := dir.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	server.values.dirs.Add(c, dir)
+	server.values.sizes.Add(c, size)
+	return stat.Path(), nil
+}
+
+// setLink replaces the link name in dir with a link to p, like `ipfs object patch add-link`
+func (server *Server) setLink(ctx context.Context, dir *merkledag.ProtoNode, name string, p path.Resolved) error {
+	size, err := server.nodeSize(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	dir.RemoveNodeLink(name)
+	return dir.AddRawLink(name, &ipld.Link{Name: name, Size: size, Cid: p.Cid()})
+}
+
+// nodeSize returns the cumulative size of the node at p
+func (server *Server) nodeSize(ctx context.Context, p path.Resolved) (uint64, error) {
+	if size, has := server.values.sizes.Get(p.Cid()); has {
+		return size.(uint64), nil
+	}
+
+	stat, err := server.api.Object().Stat(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(stat.CumulativeSize)
+	server.values.sizes.Add(p.Cid(), size)
+	return size, nil
+}
+
+// addedSize records the size of a file that was just added with addOpts.
+// Small files are a single raw leaf, which is exactly as big as its contents;
+// anything else is left to nodeSize to stat.
+func (server *Server) addedSize(p path.Resolved, length int) {
+	if p.Cid().Type() == cid.Raw {
+		server.values.sizes.Add(p.Cid(), uint64(length))
+	}
+}
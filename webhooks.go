@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	files "github.com/ipfs/go-ipfs-files"
+
+	types "github.com/underlay/pkgs/types"
+)
+
+// Webhook subscriptions for a package subtree are stored in a JSON file member of
+// the package named .webhooks, so they version with the package like everything else.
+// The file is public, so the secrets that sign the deliveries are kept out of it,
+// in badger under _secrets/webhooks/{id}, along with the URL that they were
+// registered for: deliveries are only signed for that URL, so pointing a
+// subscription somewhere else by editing the file doesn't take its secret with it.
+//
+// A dispatcher follows the event log (from a cursor stored at _webhooks/cursor) and
+// queues a delivery under _deliveries/{seq}/{id} for every subscription that matches
+// each event. Deliveries are POSTed with retries and exponential backoff, and never
+// to loopback, link-local, or private addresses (unless they're in webhookAllow),
+// which are checked when the connection is dialed so that every name and redirect
+// is covered.
+
+const webhooksName = ".webhooks"
+const webhookCursorKey = "_webhooks/cursor"
+const webhookSecretPrefix = "_secrets/webhooks/"
+const deliveryPrefix = "_deliveries/"
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with the subscription's secret
+const WebhookSignatureHeader = "X-Pkgs-Signature"
+
+var webhookMaxAttempts = 10
+var webhookMinBackoff, webhookMaxBackoff = 5 * time.Second, time.Hour
+var webhookPollInterval = 5 * time.Second
+var webhookTimeout = 30 * time.Second
+
+var webhookEvents = map[string]bool{"set": true, "delete": true}
+
+// webhookAllow lists networks that webhooks can be delivered to even though
+// they're loopback, link-local, or private addresses
+var webhookAllow []*net.IPNet
+
+// webhookPrivate lists the private networks that webhooks can't be delivered to:
+// RFC 1918, carrier-grade NAT (RFC 6598), and IPv6 unique local addresses.
+// net.IP.IsPrivate is only in go 1.17.
+var webhookPrivate = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// ErrInvalidWebhook is returned for webhook registrations without an absolute http(s) URL or with unknown events
+var ErrInvalidWebhook = errors.New("Invalid webhook: expected an absolute http or https URL and events \"set\" or \"delete\"")
+
+// ErrWebhookTarget is returned for webhooks addressed to loopback, link-local, or private hosts
+var ErrWebhookTarget = errors.New("Invalid webhook: loopback, link-local, and private addresses are not allowed")
+
+// A webhook is one subscription in a .webhooks file.
+// Events is the list of event names it wants; empty means all of them.
+type webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+func (hook *webhook) wants(event *Event) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, name := range hook.Events {
+		if name == event.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// A webhookSecret is the secret of a subscription and the URL it was registered for
+type webhookSecret struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func allowWebhookIP(ip net.IP) bool {
+	for _, network := range webhookAllow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range webhookPrivate {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// checkWebhookHost rejects URLs for IP addresses (and localhost) that webhooks can't be
+// delivered to. Other names are resolved and checked by dialWebhook on every delivery.
+func checkWebhookHost(u *url.URL) error {
+	ip := net.ParseIP(u.Hostname())
+	if u.Hostname() == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && !allowWebhookIP(ip) {
+		return ErrWebhookTarget
+	}
+	return nil
+}
+
+// dialWebhook is the net.Dialer Control function for deliveries,
+// which refuses to connect to addresses that allowWebhookIP doesn't allow
+func dialWebhook(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !allowWebhookIP(ip) {
+		return ErrWebhookTarget
+	}
+	return nil
+}
+
+// A delivery is a queued POST of one event to one webhook
+type delivery struct {
+	Webhook  string `json:"webhook"`
+	URL      string `json:"url"`
+	Event    *Event `json:"event"`
+	Seq      uint64 `json:"seq"`
+	Attempts int    `json:"attempts,omitempty"`
+	Next     string `json:"next,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"event"`
+	Webhook string `json:"webhook"`
+	*Event
+}
+
+type webhooks struct {
+	server *Server
+	client *http.Client
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mutex  sync.Mutex
+	cache  map[string][]*webhook
+}
+
+func newWebhooks(server *Server) *webhooks {
+	// The transport doesn't use a proxy, since the proxy would dial the webhook instead
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: dialWebhook}
+	w := &webhooks{
+		server: server,
+		client: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		cache: map[string][]*webhook{},
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Close stops delivering webhooks. Queued deliveries are sent after the next start.
+func (w *webhooks) Close() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+// Wake tells the dispatcher that there are new events
+func (w *webhooks) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhooks) run() {
+	defer w.wg.Done()
+	for {
+		err := w.dispatch()
+		if err != nil {
+			log.Println("Error dispatching webhooks:", err)
+		}
+
+		next := w.deliver()
+		wait := webhookPollInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+		case <-w.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatch queues deliveries for the events after the cursor
+func (w *webhooks) dispatch() error {
+	db := w.server.db
+	var cursor uint64
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(webhookCursorKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			cursor = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	deliveries := []*delivery{}
+	last := cursor
+	err = w.server.replayEvents(cursor, func(event *Event) error {
+		hooks, err := w.subscriptions(event)
+		if err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			deliveries = append(deliveries, &delivery{Webhook: hook.ID, URL: hook.URL, Event: event, Seq: event.Seq})
+		}
+		last = event.Seq
+		return nil
+	})
+	if err != nil || last == cursor {
+		return err
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		for _, d := range deliveries {
+			value, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(deliveryKey(d.Seq, d.Webhook), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, last)
+		return txn.Set([]byte(webhookCursorKey), value)
+	})
+}
+
+func deliveryKey(seq uint64, id string) []byte {
+	key := make([]byte, len(deliveryPrefix)+8, len(deliveryPrefix)+8+len(id))
+	binary.BigEndian.PutUint64(key[copy(key, deliveryPrefix):], seq)
+	return append(key, id...)
+}
+
+// subscriptions returns the webhooks of the event's path and its ancestors that want the event
+func (w *webhooks) subscriptions(event *Event) ([]*webhook, error) {
+	txn := w.server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	key := types.ParsePath(event.Path)
+	hooks := []*webhook{}
+	for i := 0; i <= len(key); i++ {
+		scope := key[:i:i]
+		all, err := w.server.getWebhooks(context.Background(), scope, txn)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hook := range all {
+			if hook.wants(event) {
+				hooks = append(hooks, hook)
+			}
+		}
+	}
+
+	return hooks, nil
+}
+
+// deliver sends the deliveries that are due, and returns when the next one is
+func (w *webhooks) deliver() (next time.Time) {
+	due := []*delivery{}
+	now := time.Now()
+	err := w.server.db.View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.Prefix = []byte(deliveryPrefix)
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			d := &delivery{}
+			err := iter.Item().Value(func(val []byte) error { return json.Unmarshal(val, d) })
+			if err != nil {
+				return err
+			}
+
+			t, _ := time.Parse(time.RFC3339Nano, d.Next)
+			if !t.After(now) {
+				due = append(due, d)
+			} else if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error reading webhook deliveries:", err)
+		return
+	}
+
+	for _, d := range due {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		err = w.post(d)
+		key := deliveryKey(d.Seq, d.Webhook)
+		if err == nil {
+			err = w.server.db.Update(func(txn *badger.Txn) error { return txn.Delete(key) })
+		} else if d.Attempts++; d.Attempts >= webhookMaxAttempts {
+			log.Printf("Giving up on webhook %s delivery %d after %d attempts: %s\n", d.Webhook, d.Seq, d.Attempts, err.Error())
+			err = w.server.db.Update(func(txn *badger.Txn) error { return txn.Delete(key) })
+		} else {
+			backoff := webhookMinBackoff << uint(d.Attempts-1)
+			if backoff > webhookMaxBackoff || backoff <= 0 {
+				backoff = webhookMaxBackoff
+			}
+
+			t := time.Now().Add(backoff)
+			d.Next, d.Error = t.Format(time.RFC3339Nano), err.Error()
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+
+			err = w.server.db.Update(func(txn *badger.Txn) error {
+				value, err := json.Marshal(d)
+				if err != nil {
+					return err
+				}
+				return txn.Set(key, value)
+			})
+		}
+
+		if err != nil {
+			log.Println("Error updating webhook delivery:", err)
+		}
+	}
+
+	return
+}
+
+func (w *webhooks) post(d *delivery) error {
+	body, err := json.Marshal(&webhookPayload{ID: d.Seq, Name: d.Event.Name(), Webhook: d.Webhook, Event: d.Event})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Pkgs-Event", d.Event.Name())
+	req.Header.Add("X-Pkgs-Delivery", fmt.Sprintf("%d-%s", d.Seq, d.Webhook))
+
+	secret, err := w.server.getWebhookSecret(d.Webhook, d.URL)
+	if err != nil {
+		return err
+	} else if secret != nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		req.Header.Add(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New(res.Status)
+	}
+
+	return nil
+}
+
+// getWebhookSecret returns the secret of the webhook with the given id,
+// or nil if it doesn't have one or it was registered for a different URL
+func (server *Server) getWebhookSecret(id, u string) (secret []byte, err error) {
+	err = server.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(webhookSecretPrefix + id))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		s := &webhookSecret{}
+		err = item.Value(func(val []byte) error { return json.Unmarshal(val, s) })
+		if err == nil && s.URL == u {
+			secret = []byte(s.Secret)
+		}
+		return err
+	})
+	return
+}
+
+// getWebhooks returns the subscriptions in the .webhooks file of the package at key, if any
+func (server *Server) getWebhooks(ctx context.Context, key []string, txn *badger.Txn) ([]*webhook, error) {
+	r, err := getResource(append(key[:len(key):len(key)], webhooksName), txn)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, is := r.(*types.File)
+	if !is {
+		return nil, nil
+	}
+
+	w := server.webhooks
+	w.mutex.Lock()
+	hooks, has := w.cache[f.ID]
+	w.mutex.Unlock()
+	if has {
+		return hooks, nil
+	}
+
+	node, err := server.api.Unixfs().Get(ctx, f.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(files.ToFile(node))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks = []*webhook{}
+	err = json.Unmarshal(data, &hooks)
+	if err != nil {
+		// A malformed file just doesn't subscribe to anything
+		log.Printf("Error parsing /%s: %s\n", webhooksName, err.Error())
+		hooks = []*webhook{}
+	}
+
+	w.mutex.Lock()
+	w.cache[f.ID] = hooks
+	w.mutex.Unlock()
+	return hooks, nil
+}
+
+// setWebhooks writes a new revision of the .webhooks file of the package at key
+// (or deletes it, if hooks is empty) and commits txn.
+func (server *Server) setWebhooks(ctx context.Context, key []string, hooks []*webhook, txn *badger.Txn) error {
+	childKey := append(key[:len(key):len(key)], webhooksName)
+	timestamp := time.Now().Format(time.RFC3339)
+	if len(hooks) == 0 {
+		old, err := getResource(childKey, txn)
+		if err != nil {
+			return err
+		}
+
+		err = server.deleteEntry(childKey, old, txn)
+		if err != nil {
+			return err
+		}
+
+		return server.commit(ctx, timestamp, childKey, nil, txn)
+	}
+
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	resource := types.GetURI(server.resource, childKey)
+	f := &types.File{Resource: resource, Title: webhooksName, Created: timestamp, Modified: timestamp, Format: "application/json"}
+	err = server.setFile(ctx, f, files.NewBytesFile(data))
+	if err != nil {
+		return err
+	}
+
+	err = server.set(ctx, childKey, f, txn)
+	if err != nil {
+		return err
+	}
+
+	return server.commit(ctx, timestamp, childKey, f, txn)
+}
+
+// Webhooks handles requests to /_webhooks/{path}. GET lists the subscriptions for
+// the package at path, POST adds one, and DELETE removes the one given by the "id"
+// query parameter.
+func (server *Server) Webhooks(ctx context.Context, res http.ResponseWriter, req *http.Request, key []string) {
+	switch req.Method {
+	case "GET":
+		server.getWebhooksList(ctx, res, key)
+		return
+	case "POST", "DELETE":
+	default:
+		res.WriteHeader(405)
+		return
+	}
+
+	var hook *webhook
+	var secret string
+	if req.Method == "POST" {
+		var err error
+		hook, secret, err = readWebhook(req)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		id := make([]byte, 16)
+		_, err = rand.Read(id)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		hook.ID = hex.EncodeToString(id)
+	}
+
+	// The subscriptions are a file in the package, so changing them is a write
+	// of that file like any other, with its locks and preconditions
+	childKey := append(key[:len(key):len(key)], webhooksName)
+	var fetchErr error
+	err := server.write(childKey, func(txn *badger.Txn) error {
+		_, err := getPackage(key, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkLocks(req, childKey, writeResource, txn)
+		if err != nil {
+			return err
+		}
+
+		err = checkPreconditions(req, childKey, txn)
+		if err != nil {
+			return err
+		}
+
+		hooks, err := server.getWebhooks(ctx, key, txn)
+		if err != nil {
+			fetchErr = err
+			return err
+		}
+
+		if req.Method == "DELETE" {
+			id := req.URL.Query().Get("id")
+			next := make([]*webhook, 0, len(hooks))
+			for _, hook := range hooks {
+				if hook.ID != id {
+					next = append(next, hook)
+				}
+			}
+
+			if len(next) == len(hooks) {
+				return badger.ErrKeyNotFound
+			}
+
+			err = txn.Delete([]byte(webhookSecretPrefix + id))
+			if err != nil {
+				return err
+			}
+
+			return server.setWebhooks(ctx, key, next, txn)
+		}
+
+		if secret != "" {
+			value, _ := json.Marshal(&webhookSecret{URL: hook.URL, Secret: secret})
+			err = txn.Set([]byte(webhookSecretPrefix+hook.ID), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return server.setWebhooks(ctx, key, append(hooks, hook), txn)
+	})
+
+	if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+		res.WriteHeader(404)
+		return
+	} else if err == ErrPrecondition {
+		res.WriteHeader(412)
+		return
+	} else if err == ErrInvalidIf {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err == ErrLocked {
+		res.WriteHeader(423)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil && err == fetchErr {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if req.Method == "DELETE" {
+		res.WriteHeader(204)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(201)
+	json.NewEncoder(res).Encode(hook)
+}
+
+// getWebhooksList writes the subscriptions for the package at key
+func (server *Server) getWebhooksList(ctx context.Context, res http.ResponseWriter, key []string) {
+	txn := server.db.NewTransaction(false)
+	defer txn.Discard()
+
+	_, err := getPackage(key, txn)
+	if err == badger.ErrKeyNotFound || err == ErrNotPackage {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	hooks, err := server.getWebhooks(ctx, key, txn)
+	if err != nil {
+		res.WriteHeader(502)
+		res.Write([]byte(err.Error()))
+		return
+	} else if hooks == nil {
+		hooks = []*webhook{}
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(hooks)
+}
+
+// readWebhook reads and checks a new subscription (without an ID) and its secret
+// from the body of a POST request
+func readWebhook(req *http.Request) (*webhook, string, error) {
+	registration := &struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}{}
+
+	err := json.NewDecoder(req.Body).Decode(registration)
+	if err != nil {
+		return nil, "", err
+	}
+
+	u, err := url.Parse(registration.URL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", ErrInvalidWebhook
+	}
+
+	err = checkWebhookHost(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, name := range registration.Events {
+		if !webhookEvents[name] {
+			return nil, "", ErrInvalidWebhook
+		}
+	}
+
+	return &webhook{URL: u.String(), Events: registration.Events}, registration.Secret, nil
+}
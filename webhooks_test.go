@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestWebhookTargets checks that webhooks can't be registered for or delivered to
+// loopback, link-local, and private addresses
+func TestWebhookTargets(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, u := range []string{
+		"http://127.0.0.1:8080/", "http://localhost/", "http://[::1]/", "http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/", "http://172.20.0.1/", "http://192.168.1.1/", "http://100.100.100.200/", "http://[fd00::1]/",
+	} {
+		res := do(server, "POST", "/_webhooks/", `{"url": "`+u+`"}`, nil)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("registering %s: %d %s", u, res.Code, res.Body.String())
+		}
+	}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		t.Error("a webhook was delivered to a loopback address")
+	}))
+	defer receiver.Close()
+
+	// A .webhooks file can be written directly, so the address is checked again when it's delivered
+	err := server.webhooks.post(&delivery{Webhook: "test", URL: receiver.URL, Event: &Event{Path: "/"}})
+	if !errors.Is(err, ErrWebhookTarget) {
+		t.Errorf("delivering to %s: %v", receiver.URL, err)
+	}
+}
+
+// TestWebhookSecret checks that deliveries are signed with the subscription's secret,
+// and that they aren't signed after its URL is changed in the .webhooks file
+func TestWebhookSecret(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	webhookAllow = []*net.IPNet{loopback}
+	t.Cleanup(func() { webhookAllow = nil })
+
+	server, _ := newTestServer(t)
+
+	type received struct {
+		body      []byte
+		signature string
+	}
+	newReceiver := func() (*httptest.Server, chan *received) {
+		c := make(chan *received, 16)
+		receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			c <- &received{body, req.Header.Get(WebhookSignatureHeader)}
+		}))
+		t.Cleanup(receiver.Close)
+		return receiver, c
+	}
+
+	wait := func(c chan *received) *received {
+		t.Helper()
+		select {
+		case r := <-c:
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for a delivery")
+			return nil
+		}
+	}
+
+	a, fromA := newReceiver()
+	b, fromB := newReceiver()
+
+	res := do(server, "POST", "/_webhooks/", `{"url": "`+a.URL+`", "secret": "secret"}`, nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("registering %s: %d %s", a.URL, res.Code, res.Body.String())
+	}
+
+	hook := &webhook{}
+	err := json.Unmarshal(res.Body.Bytes(), hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = putFile(server, "/a.txt", "a\n", nil)
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body.String())
+	}
+
+	r := wait(fromA)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(r.body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.signature != expected {
+		t.Errorf("the delivery was signed %q, expected %q", r.signature, expected)
+	}
+
+	hooks, _ := json.Marshal([]*webhook{{ID: hook.ID, URL: b.URL}})
+	res = putFile(server, "/"+webhooksName, string(hooks), map[string]string{"Content-Type": "application/json"})
+	if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+		t.Fatalf("PUT /%s: %d %s", webhooksName, res.Code, res.Body.String())
+	}
+
+	r = wait(fromB)
+	if r.signature != "" {
+		t.Errorf("the delivery to %s was signed with the secret for %s", b.URL, a.URL)
+	}
+}
+
+// TestWebhookLocks checks that registering and removing subscriptions respects
+// locks and preconditions on the .webhooks file, like any other write to it
+func TestWebhookLocks(t *testing.T) {
+	server, _ := newTestServer(t)
+	register := `{"url": "http://example.com/hook"}`
+
+	res := do(server, "LOCK", "/", lockBody, map[string]string{"Content-Type": "application/xml"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("LOCK: %d %s", res.Code, res.Body.String())
+	}
+	token := res.Header().Get("Lock-Token")
+
+	res = do(server, "POST", "/_webhooks/", register, nil)
+	if res.Code != http.StatusLocked {
+		t.Errorf("registering without the lock token: expected 423, got %d", res.Code)
+	}
+
+	res = do(server, "POST", "/_webhooks/", register, map[string]string{"If": "(" + token + ")"})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("registering with the lock token: %d %s", res.Code, res.Body.String())
+	}
+
+	hook := &webhook{}
+	err := json.Unmarshal(res.Body.Bytes(), hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = do(server, "DELETE", "/_webhooks/?id="+hook.ID, "", nil)
+	if res.Code != http.StatusLocked {
+		t.Errorf("removing without the lock token: expected 423, got %d", res.Code)
+	}
+
+	res = do(server, "UNLOCK", "/", "", map[string]string{"Lock-Token": token})
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "POST", "/_webhooks/", register, map[string]string{"If-None-Match": "*"})
+	if res.Code != http.StatusPreconditionFailed {
+		t.Errorf("registering with If-None-Match: * : expected 412, got %d", res.Code)
+	}
+
+	res = do(server, "DELETE", "/_webhooks/?id="+hook.ID, "", nil)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("removing: %d %s", res.Code, res.Body.String())
+	}
+
+	res = do(server, "DELETE", "/_webhooks/?id="+hook.ID, "", nil)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("removing again: expected 404, got %d", res.Code)
+	}
+}